@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const peersFile = "peers_%s.dat"
+const maxAddrPerMessage = 1000
+const addrStaleAfter = 7 * 24 * time.Hour
+const maxFailedAttempts = 10
+
+// KnownAddress is an entry of the peer database
+type KnownAddress struct {
+	Addr        string
+	LastSeen    time.Time
+	LastAttempt time.Time
+	LastSuccess time.Time
+	Attempts    int
+}
+
+// AddrManager learns peer addresses from gossip and remembers how reaching them went
+type AddrManager struct {
+	Addresses map[string]*KnownAddress
+
+	nodeID string
+	mu     sync.Mutex
+}
+
+// NewAddrManager loads the peer database of a node
+func NewAddrManager(nodeID string) *AddrManager {
+	am := &AddrManager{Addresses: make(map[string]*KnownAddress), nodeID: nodeID}
+	am.loadFromFile()
+
+	return am
+}
+
+// AddAddress records that an address was announced to us, reporting whether it is new
+func (am *AddrManager) addAddress(addr string) bool {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	ka, ok := am.Addresses[addr]
+	if !ok {
+		ka = &KnownAddress{Addr: addr}
+		am.Addresses[addr] = ka
+	}
+	ka.LastSeen = time.Now()
+
+	return !ok
+}
+
+// MarkAttempt records the outcome of connecting to a known address
+func (am *AddrManager) markAttempt(addr string, success bool) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	ka, ok := am.Addresses[addr]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	ka.LastAttempt = now
+	if success {
+		ka.LastSuccess = now
+		ka.LastSeen = now
+		ka.Attempts = 0
+	} else {
+		ka.Attempts++
+	}
+}
+
+// GetAddresses returns up to max addresses worth gossiping or connecting to,
+// most recently seen first
+func (am *AddrManager) getAddresses(max int) []string {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	var known []*KnownAddress
+	for _, ka := range am.Addresses {
+		if !ka.isBad() {
+			known = append(known, ka)
+		}
+	}
+	sort.Slice(known, func(i, j int) bool {
+		return known[i].LastSeen.After(known[j].LastSeen)
+	})
+
+	var addresses []string
+	for _, ka := range known {
+		if len(addresses) == max {
+			break
+		}
+		addresses = append(addresses, ka.Addr)
+	}
+
+	return addresses
+}
+
+// Count returns the number of addresses in the database
+func (am *AddrManager) count() int {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	return len(am.Addresses)
+}
+
+// getKnownAddresses returns a copy of every entry ordered by address
+func (am *AddrManager) getKnownAddresses() []KnownAddress {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	var known []KnownAddress
+	for _, ka := range am.Addresses {
+		known = append(known, *ka)
+	}
+	sort.Slice(known, func(i, j int) bool {
+		return known[i].Addr < known[j].Addr
+	})
+
+	return known
+}
+
+// isBad tells whether an address isn't worth keeping: not heard of for a long
+// time, or unreachable over many attempts in a row
+func (ka *KnownAddress) isBad() bool {
+	if time.Since(ka.LastSeen) > addrStaleAfter {
+		return true
+	}
+
+	return ka.Attempts >= maxFailedAttempts && ka.LastSuccess.Before(ka.LastAttempt)
+}
+
+// prune drops the bad addresses
+func (am *AddrManager) prune() {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	for addr, ka := range am.Addresses {
+		if ka.isBad() {
+			delete(am.Addresses, addr)
+		}
+	}
+}
+
+func (am *AddrManager) saveToFile() {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	var content bytes.Buffer
+	peersFile := fmt.Sprintf(peersFile, am.nodeID)
+
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(am)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = ioutil.WriteFile(peersFile, content.Bytes(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (am *AddrManager) loadFromFile() error {
+	peersFile := fmt.Sprintf(peersFile, am.nodeID)
+	if _, err := os.Stat(peersFile); os.IsNotExist(err) {
+		return err
+	}
+	fileContent, err := ioutil.ReadFile(peersFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	var addrManager AddrManager
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&addrManager)
+	if err != nil {
+		log.Panic(err)
+	}
+	if addrManager.Addresses != nil {
+		am.Addresses = addrManager.Addresses
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const banFile = "banlist_%s.dat"
+const defaultBanTime = 24 * time.Hour
+
+// BanList keeps the addresses we refuse to talk to and when each ban expires
+type BanList struct {
+	Bans map[string]time.Time
+
+	nodeID  string
+	modTime time.Time
+	mu      sync.Mutex
+}
+
+// NewBanList loads the ban list of a node, starting an empty one if there is no file yet
+func NewBanList(nodeID string) *BanList {
+	bl := &BanList{Bans: make(map[string]time.Time), nodeID: nodeID}
+	bl.loadFromFile()
+
+	return bl
+}
+
+// Ban bans an address for the given duration and saves the list
+func (bl *BanList) ban(address string, duration time.Duration) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.refresh()
+	bl.Bans[address] = time.Now().Add(duration)
+	bl.saveToFile()
+}
+
+// Unban lifts the ban on an address, reporting whether it was banned
+func (bl *BanList) unban(address string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.refresh()
+	if _, ok := bl.Bans[address]; !ok {
+		return false
+	}
+	delete(bl.Bans, address)
+	bl.saveToFile()
+
+	return true
+}
+
+// IsBanned checks whether an address is currently banned
+func (bl *BanList) isBanned(address string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.refresh()
+	until, ok := bl.Bans[address]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(bl.Bans, address)
+		return false
+	}
+
+	return true
+}
+
+// GetBanned returns the banned addresses ordered by address
+func (bl *BanList) getBanned() []string {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.refresh()
+	var addresses []string
+	now := time.Now()
+	for address, until := range bl.Bans {
+		if now.Before(until) {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+
+	return addresses
+}
+
+// refresh reloads the list when the file was changed by another process,
+// so setban takes effect on a running node
+func (bl *BanList) refresh() {
+	info, err := os.Stat(fmt.Sprintf(banFile, bl.nodeID))
+	if err != nil || !info.ModTime().After(bl.modTime) {
+		return
+	}
+	bl.loadFromFile()
+}
+
+func (bl *BanList) saveToFile() {
+	var content bytes.Buffer
+	banFile := fmt.Sprintf(banFile, bl.nodeID)
+
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(bl)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = ioutil.WriteFile(banFile, content.Bytes(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	info, err := os.Stat(banFile)
+	if err == nil {
+		bl.modTime = info.ModTime()
+	}
+}
+
+func (bl *BanList) loadFromFile() error {
+	banFile := fmt.Sprintf(banFile, bl.nodeID)
+	info, err := os.Stat(banFile)
+	if os.IsNotExist(err) {
+		return err
+	}
+	fileContent, err := ioutil.ReadFile(banFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	var banList BanList
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&banList)
+	if err != nil {
+		log.Panic(err)
+	}
+	bl.Bans = banList.Bans
+	if bl.Bans == nil {
+		bl.Bans = make(map[string]time.Time)
+	}
+	bl.modTime = info.ModTime()
+
+	return nil
+}
@@ -23,7 +23,8 @@ func Base58Encode(input []byte) []byte {
 	}
 
 	ReverseBytes(result)
-	for c := range input {
+	// every leading zero byte is a leading 1, big.Int drops them
+	for _, c := range input {
 		if c == 0x00 {
 			result = append([]byte{alphabet[0]}, result...)
 		} else {
@@ -38,9 +39,11 @@ func Base58Decode(input []byte) []byte {
 	result := big.NewInt(0)
 	zeroBytes := 0
 
-	for c := range input {
-		if c == 0x00 {
+	for _, c := range input {
+		if c == alphabet[0] {
 			zeroBytes++
+		} else {
+			break
 		}
 	}
 
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBase58(t *testing.T) {
+	assert.Equal(t, []byte("1112"), Base58Encode([]byte{0, 0, 0, 1}))
+	assert.Equal(t, []byte{0, 0, 0, 1}, Base58Decode([]byte("1112")))
+
+	// an address whose public key hash starts with a zero byte
+	payload := append([]byte{mainNetParams.AddressVersion, 0}, make([]byte, 23)...)
+	payload[2] = 0x42
+	assert.Equal(t, payload, Base58Decode(Base58Encode(payload)))
+}
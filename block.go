@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"log"
 	"time"
 )
@@ -26,10 +29,6 @@ func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Bl
 	return block
 }
 
-func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{},0)
-}
-
 func (block *Block) Serialize() []byte {
 	var result bytes.Buffer
 	encoder := gob.NewEncoder(&result)
@@ -41,13 +40,26 @@ func (block *Block) Serialize() []byte {
 }
 
 func DeserializeBlock(b []byte) *Block {
+	block, err := decodeBlock(b)
+	if err != nil {
+		log.Panic(err)
+	}
+	return block
+}
+
+// decodeBlock deserializes a block received from the network,
+// where a decoding error is the sender's fault
+func decodeBlock(b []byte) (*Block, error) {
 	var block *Block
 	decoder := gob.NewDecoder(bytes.NewReader(b))
 	err := decoder.Decode(&block)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	return block
+	if block == nil {
+		return nil, errors.New("empty block")
+	}
+	return block, nil
 }
 
 // HashTransactions returns a hash of the transactions in the block
@@ -56,8 +68,42 @@ func (block *Block) hashTransactions() []byte {
 
 	//loop transactions of current block
 	for _, tx := range block.Transactions {
-		transactions = append(transactions, tx.serialize())
+		transactions = append(transactions, tx.encode())
 	}
 	mTree := NewMerkleTree(transactions)
 	return mTree.RootNode.Data
 }
+
+// Validate performs the checks that don't need the rest of the chain
+func (block *Block) validate() error {
+	if len(block.Transactions) == 0 {
+		return errors.New("block has no transactions")
+	}
+
+	pow := NewProofOfWork(block)
+	data := pow.prepareData(block.Nonce)
+	hash := sha256.Sum256(data)
+	if bytes.Compare(hash[:], block.Hash) != 0 {
+		return errors.New("block hash doesn't match its content")
+	}
+	if !pow.validate() {
+		return errors.New("proof of work is not valid")
+	}
+
+	coinbases := 0
+	for _, tx := range block.Transactions {
+		if tx.isCoinbase() {
+			coinbases++
+		}
+	}
+	if coinbases != 1 {
+		return fmt.Errorf("block has %d coinbase transactions", coinbases)
+	}
+	for _, tx := range block.Transactions {
+		if tx.LockTime < 0 || !tx.isFinal(block.Height, block.Timestamp) {
+			return fmt.Errorf("transaction %x is locked until after %s", tx.ID, formatLockTime(tx.LockTime))
+		}
+	}
+
+	return nil
+}
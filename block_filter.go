@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+// Every block has a compact filter of the public key hashes it pays and
+// the outputs it spends, so a light client can tell whether a block is of
+// interest without telling anyone what it looks for. The filter headers
+// chain the filters like blocks: each commits to its filter and the header
+// of the parent, so a client can check filters from one peer against the
+// headers of others.
+
+const cfiltersBucket = "cfilters"
+const cfheadersBucket = "cfheaders"
+
+// maxCFiltersPerMessage and maxCFHeadersPerMessage cap the blocks a single
+// getcfilters or getcfheaders covers
+const maxCFiltersPerMessage = 1000
+const maxCFHeadersPerMessage = 2000
+
+// BlockFilter is the filter of a block as sent to light clients
+type BlockFilter struct {
+	BlockHash []byte
+	Filter    []byte
+}
+
+// blockFilterElements lists what the filter of a block matches
+func blockFilterElements(block *Block) [][]byte {
+	var elements [][]byte
+	for _, tx := range block.Transactions {
+		for _, out := range tx.Vout {
+			elements = append(elements, out.PubKeyHash)
+		}
+		if tx.isCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			elements = append(elements, outpoint(vin.Txid, vin.Vout))
+		}
+	}
+
+	return elements
+}
+
+// NewBlockFilter builds the filter of a block, keyed with its hash
+func NewBlockFilter(block *Block) []byte {
+	return buildGCS(block.Hash, blockFilterElements(block))
+}
+
+// matchBlockFilter tells whether a block filter may match any of the elements
+func matchBlockFilter(blockHash, filter []byte, elements [][]byte) (bool, error) {
+	return gcsMatchAny(filter, blockHash, elements)
+}
+
+func filterHash(filter []byte) []byte {
+	hash := sha256.Sum256(filter)
+
+	return hash[:]
+}
+
+// filterHeader chains the hash of a filter to the header of the parent's filter
+func filterHeader(filterHash, prevHeader []byte) []byte {
+	header := sha256.Sum256(append(append([]byte{}, filterHash...), prevHeader...))
+
+	return header[:]
+}
+
+// filterHeaders chains the hashes of consecutive filters from the header
+// of the filter before them
+func filterHeaders(prevHeader []byte, filterHashes [][]byte) [][]byte {
+	var headers [][]byte
+	for _, hash := range filterHashes {
+		prevHeader = filterHeader(hash, prevHeader)
+		headers = append(headers, prevHeader)
+	}
+
+	return headers
+}
+
+// indexFilters stores the filter and filter header of a block, and of the
+// ancestors that don't have them yet. A block whose ancestors aren't all
+// stored is left for later.
+func indexFilters(tx *bolt.Tx, blockHash []byte) {
+	blocks := tx.Bucket([]byte(blocksBucket))
+	filters, err := tx.CreateBucketIfNotExists([]byte(cfiltersBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+	headers, err := tx.CreateBucketIfNotExists([]byte(cfheadersBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// walk back to the last block with a header, then index forward
+	var pending []*Block
+	prevHeader := make([]byte, sha256.Size)
+	for hash := blockHash; headers.Get(hash) == nil; {
+		blockData := blocks.Get(hash)
+		if blockData == nil {
+			return
+		}
+		block := DeserializeBlock(blockData)
+		pending = append(pending, block)
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+		hash = block.PrevBlockHash
+	}
+	if len(pending) == 0 {
+		return
+	}
+	if oldest := pending[len(pending)-1]; len(oldest.PrevBlockHash) > 0 {
+		prevHeader = append([]byte{}, headers.Get(oldest.PrevBlockHash)...)
+	}
+
+	for i := len(pending) - 1; i >= 0; i-- {
+		block := pending[i]
+		filter := NewBlockFilter(block)
+		header := filterHeader(filterHash(filter), prevHeader)
+
+		err = filters.Put(block.Hash, filter)
+		if err != nil {
+			log.Panic(err)
+		}
+		err = headers.Put(block.Hash, header)
+		if err != nil {
+			log.Panic(err)
+		}
+		prevHeader = header
+	}
+}
+
+// getFilter returns the filter and filter header of a block
+func (bc *Blockchain) getFilter(blockHash []byte) ([]byte, []byte, error) {
+	var filter, header []byte
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		filters := tx.Bucket([]byte(cfiltersBucket))
+		headers := tx.Bucket([]byte(cfheadersBucket))
+		if filters == nil || headers == nil {
+			return errors.New("Filter is not found")
+		}
+		filter = append([]byte{}, filters.Get(blockHash)...)
+		header = append([]byte{}, headers.Get(blockHash)...)
+		if len(header) == 0 {
+			return errors.New("Filter is not found")
+		}
+
+		return nil
+	})
+
+	return filter, header, err
+}
+
+// getBlockRange returns the hashes of the blocks from startHeight up to
+// the block stopHash, on the chain of stopHash
+func (bc *Blockchain) getBlockRange(startHeight int, stopHash []byte, max int) ([][]byte, error) {
+	stop, err := bc.getBlock(stopHash)
+	if err != nil {
+		return nil, err
+	}
+	if startHeight < 0 || startHeight > stop.Height {
+		return nil, errors.New("start height is out of range")
+	}
+	if stop.Height-startHeight >= max {
+		return nil, errors.New("too many blocks requested")
+	}
+
+	hashes := make([][]byte, stop.Height-startHeight+1)
+	bci := &BlockchainIterator{stopHash, bc.db}
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block := bci.next()
+		hashes[i] = block.Hash
+	}
+
+	return hashes, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCS(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	var elements [][]byte
+	for i := 0; i < 100; i++ {
+		elements = append(elements, []byte(fmt.Sprintf("element%d", i)))
+	}
+	filter := buildGCS(key, append(elements, elements[0]))
+
+	for _, element := range elements {
+		matched, err := gcsMatchAny(filter, key, [][]byte{element})
+		assert.NoError(t, err)
+		assert.True(t, matched, "Element %s matches", element)
+	}
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		matched, err := gcsMatchAny(filter, key, [][]byte{[]byte(fmt.Sprintf("other%d", i))})
+		assert.NoError(t, err)
+		if matched {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 5, "%d false positives", falsePositives)
+
+	matched, err := gcsMatchAny(filter, key, [][]byte{[]byte("other"), elements[42]})
+	assert.NoError(t, err)
+	assert.True(t, matched, "Any matching element makes a match")
+
+	matched, err = gcsMatchAny(buildGCS(key, nil), key, elements)
+	assert.NoError(t, err)
+	assert.False(t, matched, "An empty set matches nothing")
+
+	_, err = gcsMatchAny(filter[:1], key, [][]byte{elements[99]})
+	assert.Error(t, err, "A set cut after its size is an error")
+}
+
+func TestBlockFilter(t *testing.T) {
+	funding := testTransaction(1)
+	spending := &Transaction{nil, []TXInput{{funding.ID, 0, []byte("sig"), []byte("pubkey"), nil, 0}}, []TXOutput{{1, []byte{2}, nil}}, false, 0}
+	spending.ID = spending.hash()
+	block := &Block{1, []*Transaction{spending}, []byte("prev"), []byte("0123456789abcdef"), 7, 3}
+	filter := NewBlockFilter(block)
+
+	for _, element := range [][]byte{{2}, outpoint(funding.ID, 0)} {
+		matched, err := matchBlockFilter(block.Hash, filter, [][]byte{element})
+		assert.NoError(t, err)
+		assert.True(t, matched)
+	}
+	matched, err := matchBlockFilter(block.Hash, filter, [][]byte{outpoint(funding.ID, 1)})
+	assert.NoError(t, err)
+	assert.False(t, matched)
+
+	headers := filterHeaders(make([]byte, 32), [][]byte{filterHash(filter), filterHash(filter)})
+	assert.Len(t, headers, 2)
+	assert.Equal(t, filterHeader(filterHash(filter), headers[0]), headers[1])
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"bytes"
@@ -16,9 +18,31 @@ const dbFile = "blockchain_%s.db"
 const blocksBucket = "vchain"
 const genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
 
+var errTxNotFound = errors.New("Transaction is not found")
+
 type Blockchain struct {
 	tip []byte
 	db  *bolt.DB
+	// tipMutex guards tip, blocks are added while peers read the chain
+	tipMutex sync.RWMutex
+	// updateMutex keeps the writes building on what they read of the chain,
+	// adding blocks and reindexing the UTXO set, from interleaving
+	updateMutex sync.Mutex
+}
+
+// getTip returns the hash of the last block of the best chain
+func (bc *Blockchain) getTip() []byte {
+	bc.tipMutex.RLock()
+	defer bc.tipMutex.RUnlock()
+
+	return bc.tip
+}
+
+func (bc *Blockchain) setTip(hash []byte) {
+	bc.tipMutex.Lock()
+	defer bc.tipMutex.Unlock()
+
+	bc.tip = hash
 }
 
 func dbExists(dbFile string) bool {
@@ -33,17 +57,26 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction)  *Block{
 	var prevHash []byte
 	var lastHeight int
 
+	// a transaction may spend the outputs of one before it in the block
+	pending := make(map[string]Transaction)
+	height := bc.getBestHeight() + 1
 	for _, tx := range transactions{
 		// TODO: ignore transaction if it's not valid
-		if !bc.verifyTransaction(tx) {
+		if !bc.verifyTransaction(tx, pending) {
 			log.Panic("ERROR: Invalid transaction")
 		}
+		err := bc.checkLocks(tx, height, time.Now().Unix(), pending)
+		if err != nil {
+			log.Panic(err)
+		}
+		pending[hex.EncodeToString(tx.ID)] = *tx
 	}
 
 	err := bc.db.View(func(tx *bolt.Tx) error {
 
 		b := tx.Bucket([]byte(blocksBucket))
-		prevHash = b.Get([]byte("l"))
+		// values returned by bolt are only valid inside the transaction
+		prevHash = append([]byte{}, b.Get([]byte("l"))...)
 		blockData := b.Get(prevHash)
 		block := DeserializeBlock(blockData)
 		lastHeight =block.Height
@@ -63,10 +96,17 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction)  *Block{
 		if err != nil {
 			log.Panic(err)
 		}
-		bc.tip = newBlock.Hash
+		indexFilters(tx, newBlock.Hash)
+		indexChain(tx, newBlock.Hash)
 
 		return nil
 	})
+	if err != nil {
+		log.Panic(err)
+	}
+	// the tip moves once the block is committed, iterating from it before
+	// would miss the block
+	bc.setTip(newBlock.Hash)
 
 	return newBlock
 }
@@ -84,18 +124,29 @@ func NewBlockChain(nodeID string) *Blockchain {
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
+		if b.Get(activeNet.genesisHash()) == nil {
+			return fmt.Errorf("The blockchain in %s doesn't start from the genesis block of %s.", dbFile, activeNet.Name)
+		}
+		tip = append([]byte{}, b.Get([]byte("l"))...)
+		// databases from before block filters and the chain index get them now
+		indexFilters(tx, tip)
+		indexChain(tx, tip)
 		return nil
 	})
 	if err != nil {
-		log.Panic(err)
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	bc := Blockchain{tip, db}
+	bc := Blockchain{tip: tip, db: db}
 	return &bc
 }
 
-// CreateBlockchain creates a new blockchain DB
+// CreateBlockchain creates a new blockchain DB from the genesis block of the
+// network, mining a first block rewarding address unless it's empty. Nodes
+// created with an address each mine a block 1 of their own and fork right
+// away, so only the first node of a network takes one, the others start from
+// the genesis block and sync.
 func CreateBlockchain(address string, nodeID string) *Blockchain {
 	dbFile := fmt.Sprintf(dbFile, nodeID)
 	if dbExists(dbFile) {
@@ -104,8 +155,7 @@ func CreateBlockchain(address string, nodeID string) *Blockchain {
 	}
 	var tip []byte
 
-	cbtx := NewCoinbaseTransaction(address, genesisCoinbaseData)
-	genesis := NewGenesisBlock(cbtx)
+	genesis := activeNet.genesisBlock()
 
 	db, err := bolt.Open(dbFile, 0600, nil)
 	if err != nil {
@@ -129,6 +179,8 @@ func CreateBlockchain(address string, nodeID string) *Blockchain {
 			log.Panic(err)
 		}
 		tip = genesis.Hash
+		indexFilters(tx, tip)
+		indexChain(tx, tip)
 
 		return nil
 	})
@@ -137,7 +189,10 @@ func CreateBlockchain(address string, nodeID string) *Blockchain {
 		log.Panic(err)
 	}
 
-	bc := Blockchain{tip, db}
+	bc := Blockchain{tip: tip, db: db}
+	if address != "" {
+		bc.MineBlock([]*Transaction{NewCoinbaseTransaction(address, "")})
+	}
 	return &bc
 }
 
@@ -159,39 +214,100 @@ func (bc *Blockchain) findTransaction(ID []byte) (Transaction, error) {
 		}
 	}
 
-	return Transaction{}, errors.New("Transaction is not found")
+	return Transaction{}, errTxNotFound
 }
 
-func (bc *Blockchain) signTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+// prevTransactions finds the transactions the inputs of tx spend from, in
+// the chain or, for unconfirmed ones, in pending by their hex ID
+func (bc *Blockchain) prevTransactions(tx *Transaction, pending map[string]Transaction) (map[string]Transaction, error) {
 	prevTXs := make(map[string]Transaction)
 
 	for _, vin := range tx.Vin {
+		txID := hex.EncodeToString(vin.Txid)
+		if prevTx, ok := pending[txID]; ok {
+			prevTXs[txID] = prevTx
+			continue
+		}
 		prevTx, err := bc.findTransaction(vin.Txid)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
-		prevTXs[hex.EncodeToString(vin.Txid)] = prevTx
+		prevTXs[txID] = prevTx
+	}
+
+	return prevTXs, nil
+}
+
+func (bc *Blockchain) signTransaction(tx *Transaction, privKey ecdsa.PrivateKey, pending map[string]Transaction) {
+	prevTXs, err := bc.prevTransactions(tx, pending)
+	if err != nil {
+		log.Panic(err)
 	}
 
 	tx.sign(privKey, prevTXs)
 }
 
-func (bc *Blockchain) verifyTransaction(tx *Transaction) bool {
+func (bc *Blockchain) verifyTransaction(tx *Transaction, pending map[string]Transaction) bool {
 	if(tx.isCoinbase()) {
 		return true
 	}
 
-	prevTXs := make(map[string]Transaction)
+	prevTXs, err := bc.prevTransactions(tx, pending)
+	if err != nil {
+		return false
+	}
 
-	for _, vin := range tx.Vin {
-		prevTx, err := bc.findTransaction(vin.Txid)
-		if err != nil {
-			log.Panic(err)
+	return tx.verify(prevTXs)
+}
+
+// findUnspentOutput looks an output no transaction of the chain spends yet
+// up in the UTXO set. The transaction returned holds the unspent outputs of
+// the one it stands for at their index, which is what verifying an input
+// takes. Outputs the chain spent are told from unknown ones by the spent
+// index, only unknown ones give errTxNotFound.
+func (bc *Blockchain) findUnspentOutput(txID []byte, vout int) (Transaction, error) {
+	var outs *TXOutputs
+	spent := false
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		if spentIndex := tx.Bucket([]byte(spentIndexBucket)); spentIndex != nil {
+			spent = spentIndex.Get(outpoint(txID, vout)) != nil
 		}
-		prevTXs[hex.EncodeToString(prevTx.ID)] = prevTx
+		b := tx.Bucket([]byte(utxoBucket))
+		if b == nil {
+			return nil
+		}
+		if outsBytes := b.Get(txID); outsBytes != nil {
+			found := DeserializeOutputs(outsBytes)
+			outs = &found
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if spent {
+		return Transaction{}, fmt.Errorf("output %x:%d is already spent", txID, vout)
+	}
+	if outs == nil {
+		return Transaction{}, errTxNotFound
 	}
 
-	return tx.verify(prevTXs)
+	prevTx := Transaction{ID: txID}
+	unspent := false
+	for i, out := range outs.Outputs {
+		index := outs.index(i)
+		for len(prevTx.Vout) <= index {
+			prevTx.Vout = append(prevTx.Vout, TXOutput{})
+		}
+		prevTx.Vout[index] = out
+		unspent = unspent || index == vout
+	}
+	if !unspent {
+		return Transaction{}, fmt.Errorf("output %x:%d is spent or doesn't exist", txID, vout)
+	}
+
+	return prevTx, nil
 }
 
 func (bc *Blockchain) findUTXO() map[string]TXOutputs {
@@ -202,7 +318,9 @@ func (bc *Blockchain) findUTXO() map[string]TXOutputs {
 	for {
 		block := bci.next()
 
-		for _, tx := range block.Transactions {
+		// last first, a transaction may spend one before it in the block
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
 			txID := hex.EncodeToString(tx.ID)
 
 		Outputs:
@@ -218,6 +336,7 @@ func (bc *Blockchain) findUTXO() map[string]TXOutputs {
 
 				outs := UTXO[txID]
 				outs.Outputs = append(outs.Outputs, out)
+				outs.Indexes = append(outs.Indexes, outIdx)
 				UTXO[txID] = outs
 			}
 
@@ -274,8 +393,13 @@ func (bc *Blockchain) getBlock(blockhash []byte) (Block,error) {
 	return block, nil
 }
 
-// AddBlock saves the block into the blockchain
-func (bc *Blockchain) addBlock(block *Block) {
+// AddBlock saves the block into the blockchain, returning the blocks that
+// joined the best chain with it, oldest first
+func (bc *Blockchain) addBlock(block *Block) []*Block {
+	bc.updateMutex.Lock()
+	defer bc.updateMutex.Unlock()
+
+	var connected []*Block
 	err :=bc.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		blockInDb := b.Get(block.Hash)
@@ -290,17 +414,19 @@ func (bc *Blockchain) addBlock(block *Block) {
 			log.Panic(err)
 		}
 
-		//check whether the added block is the latest, update the cursor state
+		//check whether the added block is the latest, update the cursor state.
+		//a block without its parent can't be the tip, the chain would have a gap
 		lastHash := b.Get([]byte("l"))
 		lastBlockData := b.Get(lastHash)
 		lastBlock := *DeserializeBlock(lastBlockData)
-		if block.Height > lastBlock.Height {
+		if block.Height > lastBlock.Height && b.Get(block.PrevBlockHash) != nil {
 			err =b.Put([]byte("l"),block.Hash)
 			if err != nil {
 				log.Panic(err)
 			}
-			bc.tip = block.Hash
+			connected = indexChain(tx, block.Hash)
 		}
+		indexFilters(tx, block.Hash)
 
 		return nil
 	})
@@ -308,7 +434,13 @@ func (bc *Blockchain) addBlock(block *Block) {
 	if err != nil {
 		log.Panic(err)
 	}
+	// the tip moves once the block is committed, iterating from it before
+	// would miss the block
+	if len(connected) > 0 {
+		bc.setTip(block.Hash)
+	}
 
+	return connected
 }
 
 // GetBestHeight returns the height of the latest block
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Bloom filters let a light client ask for the transactions it cares about
+// without naming them: the filter matches them, and some others at a
+// chosen false positive rate. They work as in BIP 37.
+
+const maxFilterSize = 36000
+const maxFilterHashFuncs = 50
+
+// maxFilterElementSize caps what filteradd may add, a public key is 64 bytes
+const maxFilterElementSize = 520
+
+// Flags telling what the filter learns when an output matches
+const (
+	// BloomUpdateNone leaves the filter as it is
+	BloomUpdateNone = 0
+	// BloomUpdateAll adds the output, so the transaction spending it matches too
+	BloomUpdateAll = 1
+)
+
+// BloomFilter is a probabilistic set of transaction IDs, public key hashes,
+// public keys and spent outputs
+type BloomFilter struct {
+	Data      []byte
+	HashFuncs uint32
+	Tweak     uint32
+	Flags     byte
+}
+
+// NewBloomFilter sizes a filter for elements items at a false positive rate
+func NewBloomFilter(elements int, fpRate float64, tweak uint32, flags byte) *BloomFilter {
+	size := int(-1 / (math.Ln2 * math.Ln2) * float64(elements) * math.Log(fpRate) / 8)
+	if size > maxFilterSize {
+		size = maxFilterSize
+	}
+	if size < 1 {
+		size = 1
+	}
+	hashFuncs := uint32(float64(size*8) / float64(elements) * math.Ln2)
+	if hashFuncs > maxFilterHashFuncs {
+		hashFuncs = maxFilterHashFuncs
+	}
+	if hashFuncs < 1 {
+		hashFuncs = 1
+	}
+
+	return &BloomFilter{make([]byte, size), hashFuncs, tweak, flags}
+}
+
+// validate checks the limits on a filter received from the network
+func (filter *BloomFilter) validate() error {
+	if len(filter.Data) == 0 || len(filter.Data) > maxFilterSize {
+		return errors.New("filter size is out of bounds")
+	}
+	if filter.HashFuncs == 0 || filter.HashFuncs > maxFilterHashFuncs {
+		return errors.New("filter hash function count is out of bounds")
+	}
+
+	return nil
+}
+
+func (filter *BloomFilter) bit(n uint32, data []byte) uint32 {
+	return murmur3(n*0xfba4c795+filter.Tweak, data) % uint32(len(filter.Data)*8)
+}
+
+// Add puts an element in the filter
+func (filter *BloomFilter) add(data []byte) {
+	for n := uint32(0); n < filter.HashFuncs; n++ {
+		bit := filter.bit(n, data)
+		filter.Data[bit>>3] |= 1 << (bit & 7)
+	}
+}
+
+// Contains tells whether an element may be in the filter
+func (filter *BloomFilter) contains(data []byte) bool {
+	for n := uint32(0); n < filter.HashFuncs; n++ {
+		bit := filter.bit(n, data)
+		if filter.Data[bit>>3]&(1<<(bit&7)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchTransaction tells whether a transaction is of interest to the
+// filter owner: its ID, the public key hash of an output, or the outputs it
+// spends and the public keys spending them are in the filter
+func (filter *BloomFilter) matchTransaction(tx *Transaction) bool {
+	matched := filter.contains(tx.ID)
+
+	for i, out := range tx.Vout {
+		if !filter.contains(out.PubKeyHash) {
+			continue
+		}
+		matched = true
+		if filter.Flags == BloomUpdateAll {
+			filter.add(outpoint(tx.ID, i))
+		}
+	}
+	if matched {
+		return true
+	}
+
+	for _, vin := range tx.Vin {
+		if tx.isCoinbase() {
+			break
+		}
+		if filter.contains(outpoint(vin.Txid, vin.Vout)) || filter.contains(vin.PubKey) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// outpoint identifies an output as the ID of its transaction followed by
+// its index
+func outpoint(txID []byte, vout int) []byte {
+	key := make([]byte, len(txID)+4)
+	copy(key, txID)
+	binary.LittleEndian.PutUint32(key[len(txID):], uint32(vout))
+
+	return key
+}
+
+// murmur3 is the 32 bit MurmurHash3 the filter bits are picked with
+func murmur3(seed uint32, data []byte) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+
+	h := seed
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	tail := data[n*4:]
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
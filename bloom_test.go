@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMurmur3(t *testing.T) {
+	// reference vectors of the 32 bit MurmurHash3
+	assert.Equal(t, uint32(0x00000000), murmur3(0x00000000, nil))
+	assert.Equal(t, uint32(0x6a396f08), murmur3(0xfba4c795, nil))
+	assert.Equal(t, uint32(0x514e28b7), murmur3(0x00000000, []byte{0x00}))
+	assert.Equal(t, uint32(0xea3f0b17), murmur3(0xfba4c795, []byte{0x00}))
+	assert.Equal(t, uint32(0xf55b516b), murmur3(0x00000000, []byte{0x21, 0x43, 0x65, 0x87}))
+	assert.Equal(t, uint32(0x2362f9de), murmur3(0x5082edee, []byte{0x21, 0x43, 0x65, 0x87}))
+	assert.Equal(t, uint32(0x7e4a8634), murmur3(0x00000000, []byte{0x21, 0x43, 0x65}))
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter := NewBloomFilter(3, 0.01, 0, BloomUpdateNone)
+	assert.NoError(t, filter.validate())
+
+	filter.add([]byte("one"))
+	filter.add([]byte("two"))
+	assert.True(t, filter.contains([]byte("one")))
+	assert.True(t, filter.contains([]byte("two")))
+	assert.False(t, filter.contains([]byte("three")))
+
+	assert.Error(t, (&BloomFilter{Data: make([]byte, maxFilterSize+1), HashFuncs: 1}).validate())
+	assert.Error(t, (&BloomFilter{Data: make([]byte, 10), HashFuncs: maxFilterHashFuncs + 1}).validate())
+}
+
+func TestBloomFilterMatchTransaction(t *testing.T) {
+	funding := testTransaction(1)
+	spending := &Transaction{nil, []TXInput{{funding.ID, 0, []byte("sig"), []byte("pubkey"), nil, 0}}, []TXOutput{{1, []byte{2}, nil}}, false, 0}
+	spending.ID = spending.hash()
+	other := testTransaction(3)
+
+	// watching a public key hash finds the transaction paying it, and the
+	// one spending that output once the filter learned it
+	filter := NewBloomFilter(10, 0.0001, 0, BloomUpdateAll)
+	filter.add(funding.Vout[0].PubKeyHash)
+	assert.True(t, filter.matchTransaction(funding))
+	assert.True(t, filter.matchTransaction(spending))
+	assert.False(t, filter.matchTransaction(other))
+
+	filter = NewBloomFilter(10, 0.0001, 0, BloomUpdateNone)
+	filter.add(funding.Vout[0].PubKeyHash)
+	assert.True(t, filter.matchTransaction(funding))
+	assert.False(t, filter.matchTransaction(spending), "Without updates the filter doesn't learn outputs")
+
+	filter.add([]byte("pubkey"))
+	assert.True(t, filter.matchTransaction(spending), "The public key of an input matches")
+
+	filter = NewBloomFilter(10, 0.0001, 0, BloomUpdateNone)
+	filter.add(other.ID)
+	assert.True(t, filter.matchTransaction(other), "The transaction ID matches")
+}
+
+func TestMerkleBlock(t *testing.T) {
+	coinbase := NewCoinbaseTransaction(string(NewWallet("").getAddress()), "")
+	txs := []*Transaction{coinbase}
+	for i := byte(1); i <= 4; i++ {
+		txs = append(txs, testTransaction(i))
+	}
+	block := NewBlock(txs, []byte("prev"), 1)
+
+	filter := NewBloomFilter(10, 0.0001, 0, BloomUpdateNone)
+	filter.add(txs[3].ID)
+	mb, err := decodeMerkleBlock(NewMerkleBlock(block, filter).Serialize())
+	assert.NoError(t, err)
+	assert.Len(t, mb.Transactions, 1, "Only the matching transaction is sent")
+
+	matched, err := mb.validate()
+	assert.NoError(t, err)
+	assert.Len(t, matched, 1)
+	assert.Equal(t, txs[3].ID, matched[0].ID)
+
+	mb.Transactions = [][]byte{txs[2].serialize()}
+	_, err = mb.validate()
+	assert.Error(t, err, "A transaction outside the proof is refused")
+
+	mb.Transactions = [][]byte{txs[3].serialize()}
+	mb.Nonce++
+	_, err = mb.validate()
+	assert.Error(t, err, "The header must match the proof")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+var errUnknownParent = errors.New("block's parent is unknown")
+
+// chainView is the chain ending at a block as the blocks built on it see it,
+// whether it's the best chain or a branch. The blocks of the branch down to
+// the fork with the best chain are held in memory, the best chain up to the
+// fork is read from the chain index. A view lives in the database
+// transaction it was made in.
+type chainView struct {
+	tx *bolt.Tx
+	// fork is the height of the last block shared with the best chain
+	fork int
+	// branch holds the block of each transaction of the branch by hex ID,
+	// and spent the outputs the branch spends
+	branch map[string]*Block
+	spent  map[string]bool
+}
+
+// newChainView returns the view of the chain ending at the block hash
+func newChainView(tx *bolt.Tx, hash []byte) (*chainView, error) {
+	view := &chainView{tx: tx, branch: make(map[string]*Block), spent: make(map[string]bool)}
+	blocks := tx.Bucket([]byte(blocksBucket))
+	heights := tx.Bucket([]byte(heightsBucket))
+	if heights == nil {
+		return nil, errors.New("chain isn't indexed")
+	}
+
+	var branch []*Block
+	for {
+		blockData := blocks.Get(hash)
+		if blockData == nil {
+			return nil, errUnknownParent
+		}
+		block := DeserializeBlock(blockData)
+		if bytes.Equal(heights.Get(heightKey(block.Height)), block.Hash) {
+			view.fork = block.Height
+			break
+		}
+		branch = append(branch, block)
+		hash = block.PrevBlockHash
+	}
+	for i := len(branch) - 1; i >= 0; i-- {
+		for _, transaction := range branch[i].Transactions {
+			view.addTransaction(transaction, branch[i])
+		}
+	}
+
+	return view, nil
+}
+
+// addTransaction adds a transaction of a block at the end of the view
+func (view *chainView) addTransaction(tx *Transaction, block *Block) {
+	view.branch[hex.EncodeToString(tx.ID)] = block
+	if tx.isCoinbase() {
+		return
+	}
+	for _, vin := range tx.Vin {
+		view.spent[string(outpoint(vin.Txid, vin.Vout))] = true
+	}
+}
+
+// findTransactionBlock finds the block of the view a transaction is in
+func (view *chainView) findTransactionBlock(ID []byte) (*Block, error) {
+	if block, ok := view.branch[hex.EncodeToString(ID)]; ok {
+		return block, nil
+	}
+	block := indexedBlock(view.tx, ID)
+	// the best chain past the fork isn't part of the view
+	if block == nil || block.Height > view.fork {
+		return nil, errTxNotFound
+	}
+
+	return block, nil
+}
+
+// unspentTransaction returns the transaction of an output of the view no
+// transaction of the view spends yet
+func (view *chainView) unspentTransaction(txID []byte, vout int) (Transaction, error) {
+	key := outpoint(txID, vout)
+	if view.spent[string(key)] {
+		return Transaction{}, fmt.Errorf("output %x:%d is already spent", txID, vout)
+	}
+	block, err := view.findTransactionBlock(txID)
+	if err != nil {
+		return Transaction{}, fmt.Errorf("output %x:%d is not in the chain", txID, vout)
+	}
+	// spends on the best chain past the fork don't count
+	if _, ok := view.branch[hex.EncodeToString(txID)]; !ok {
+		spentAt := indexedHeight(view.tx.Bucket([]byte(spentIndexBucket)).Get(key))
+		if spentAt >= 0 && spentAt <= view.fork {
+			return Transaction{}, fmt.Errorf("output %x:%d is already spent", txID, vout)
+		}
+	}
+
+	for _, tx := range block.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			if vout < 0 || vout >= len(tx.Vout) {
+				return Transaction{}, fmt.Errorf("transaction %x has no output %d", txID, vout)
+			}
+			return *tx, nil
+		}
+	}
+
+	return Transaction{}, errTxNotFound
+}
+
+// connect checks a block extending the view, running the scripts of its
+// inputs against the outputs they spend, and adds it. The coinbase takes no
+// more than the subsidy and the fees.
+func (view *chainView) connect(block *Block) error {
+	fees := 0
+	var coinbase *Transaction
+	for _, tx := range block.Transactions {
+		if tx.isCoinbase() {
+			coinbase = tx
+			view.addTransaction(tx, block)
+			continue
+		}
+
+		fee, err := view.connectTransaction(tx, block)
+		if err != nil {
+			return err
+		}
+		fees += fee
+	}
+
+	if coinbase == nil {
+		return errors.New("block has no coinbase")
+	}
+	reward := 0
+	for _, vout := range coinbase.Vout {
+		reward += vout.Value
+	}
+	if reward > activeNet.Subsidy+fees {
+		return fmt.Errorf("coinbase takes %d, the subsidy and fees are %d", reward, activeNet.Subsidy+fees)
+	}
+
+	return nil
+}
+
+// connectTransaction checks a transaction of a block extending the view and
+// adds it, returning the fee it pays. A transaction that doesn't check out
+// leaves the view as it was.
+func (view *chainView) connectTransaction(tx *Transaction, block *Block) (int, error) {
+	prevTXs := make(map[string]Transaction)
+	spends := make(map[string]bool)
+	in := 0
+	for _, vin := range tx.Vin {
+		key := string(outpoint(vin.Txid, vin.Vout))
+		if spends[key] {
+			return 0, fmt.Errorf("transaction %x spends output %x:%d twice", tx.ID, vin.Txid, vin.Vout)
+		}
+		spends[key] = true
+		prevTx, err := view.unspentTransaction(vin.Txid, vin.Vout)
+		if err != nil {
+			return 0, fmt.Errorf("transaction %x: %s", tx.ID, err)
+		}
+		prevTXs[hex.EncodeToString(vin.Txid)] = prevTx
+		in += prevTx.Vout[vin.Vout].Value
+	}
+	out := 0
+	for _, vout := range tx.Vout {
+		if vout.Value <= 0 {
+			return 0, fmt.Errorf("transaction %x has an output without value", tx.ID)
+		}
+		out += vout.Value
+	}
+	if out > in {
+		return 0, fmt.Errorf("transaction %x spends %d but has only %d", tx.ID, out, in)
+	}
+	if !tx.verify(prevTXs) {
+		return 0, fmt.Errorf("transaction %x doesn't unlock the outputs it spends", tx.ID)
+	}
+	err := checkTxLocks(view, tx, block.Height, block.Timestamp, nil)
+	if err != nil {
+		return 0, fmt.Errorf("transaction %x: %s", tx.ID, err)
+	}
+	view.addTransaction(tx, block)
+
+	return in - out, nil
+}
+
+// checkBlock checks the transactions of a block against the chain it
+// extends, which needn't be the best one. Blocks from peers go through it
+// before they're added.
+func (bc *Blockchain) checkBlock(block *Block) error {
+	return bc.db.View(func(tx *bolt.Tx) error {
+		view, err := newChainView(tx, block.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+
+		return view.connect(block)
+	})
+}
+
+// pickTransactions returns the transactions of txs the next block of the best
+// chain can take, in their order, so a miner doesn't mine transactions the
+// chain already has or that spend the same outputs
+func (bc *Blockchain) pickTransactions(txs []Transaction, timestamp int64) []*Transaction {
+	var picked []*Transaction
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		tip := tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))
+		view, err := newChainView(tx, tip)
+		if err != nil {
+			return err
+		}
+		// the block isn't mined yet, the transactions picked only need its
+		// height and time, and to be found in it
+		next := &Block{Timestamp: timestamp, Height: view.fork + 1}
+		for i := range txs {
+			if _, err := view.connectTransaction(&txs[i], next); err == nil {
+				next.Transactions = append(next.Transactions, &txs[i])
+			}
+		}
+		picked = next.Transactions
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return picked
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckBlock(t *testing.T) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(dir)
+	activeNet = &regTestParams
+	defer func() { activeNet = &mainNetParams }()
+
+	wallet := NewWallet("")
+	address := string(wallet.getAddress())
+	bc := CreateBlockchain(address, "0")
+	defer bc.db.Close()
+	var funding []*Transaction
+	for i := 0; i < 2; i++ {
+		funding = append(funding, bc.MineBlock([]*Transaction{NewCoinbaseTransaction(address, "")}).Transactions[0])
+	}
+	fork := bc.getTip()
+	height := bc.getBestHeight()
+
+	pay := func(prev *Transaction, value int, pending map[string]Transaction) *Transaction {
+		tx := &Transaction{nil, []TXInput{{prev.ID, 0, nil, wallet.PublicKey, nil, 0}}, []TXOutput{*NewTXOutput(value, address)}, false, 0}
+		tx.ID = tx.hash()
+		bc.signTransaction(tx, wallet.PrivateKey, pending)
+		return tx
+	}
+	block := func(prev []byte, height int, txs ...*Transaction) *Block {
+		return NewBlock(append([]*Transaction{NewCoinbaseTransaction(address, "")}, txs...), prev, height)
+	}
+
+	spend := pay(funding[0], activeNet.Subsidy-1, nil)
+	assert.NoError(t, bc.checkBlock(block(fork, height+1, spend)))
+	assert.Error(t, bc.checkBlock(block(fork, height+1, spend, pay(funding[0], activeNet.Subsidy-2, nil))), "An output is spent once")
+	assert.Error(t, bc.checkBlock(block(fork, height+1, pay(funding[1], activeNet.Subsidy+1, nil))), "Outputs can't exceed the inputs")
+	forged := *pay(funding[1], activeNet.Subsidy, nil)
+	forged.Vin = []TXInput{forged.Vin[0]}
+	forged.Vin[0].Signature = append([]byte{}, spend.Vin[0].Signature...)
+	assert.Error(t, bc.checkBlock(block(fork, height+1, &forged)), "Signatures are checked")
+	greedy := NewCoinbaseTransaction(address, "")
+	greedy.Vout[0].Value += 2
+	greedy.ID = greedy.hash()
+	assert.Error(t, bc.checkBlock(NewBlock([]*Transaction{greedy, spend}, fork, height+1)), "The coinbase takes the subsidy and fees only")
+	greedy.Vout[0].Value--
+	greedy.ID = greedy.hash()
+	assert.NoError(t, bc.checkBlock(NewBlock([]*Transaction{greedy, spend}, fork, height+1)))
+	assert.Equal(t, errUnknownParent, bc.checkBlock(block([]byte("unknown"), height+1)))
+
+	// once the spend is mined the output is gone from the best chain, but
+	// not from a branch forking before it
+	bc.MineBlock([]*Transaction{spend, NewCoinbaseTransaction(address, "")})
+	again := pay(funding[0], activeNet.Subsidy-2, nil)
+	assert.Error(t, bc.checkBlock(block(bc.getTip(), height+2, again)))
+	branch := block(fork, height+1, again)
+	require.NoError(t, bc.checkBlock(branch))
+	bc.addBlock(branch)
+	child := pay(again, activeNet.Subsidy-3, map[string]Transaction{hex.EncodeToString(again.ID): *again})
+	assert.NoError(t, bc.checkBlock(block(branch.Hash, height+2, child)), "Branches spend their own outputs")
+	assert.Error(t, bc.checkBlock(block(bc.getTip(), height+2, child)), "The best chain doesn't have the outputs of a branch")
+	assert.Error(t, bc.checkBlock(block(branch.Hash, height+2, pay(funding[0], activeNet.Subsidy-3, nil))))
+}
+
+func TestPickTransactions(t *testing.T) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(dir)
+	activeNet = &regTestParams
+	defer func() { activeNet = &mainNetParams }()
+
+	wallet := NewWallet("")
+	address := string(wallet.getAddress())
+	bc := CreateBlockchain(address, "0")
+	defer bc.db.Close()
+	var funding []*Transaction
+	for i := 0; i < 2; i++ {
+		funding = append(funding, bc.MineBlock([]*Transaction{NewCoinbaseTransaction(address, "")}).Transactions[0])
+	}
+
+	pay := func(prev *Transaction, value int, pending map[string]Transaction) *Transaction {
+		tx := &Transaction{nil, []TXInput{{prev.ID, 0, nil, wallet.PublicKey, nil, 0}}, []TXOutput{*NewTXOutput(value, address)}, false, 0}
+		tx.ID = tx.hash()
+		bc.signTransaction(tx, wallet.PrivateKey, pending)
+		return tx
+	}
+	confirmed := pay(funding[0], activeNet.Subsidy-1, nil)
+	bc.MineBlock([]*Transaction{confirmed, NewCoinbaseTransaction(address, "")})
+
+	spend := pay(funding[1], activeNet.Subsidy-1, nil)
+	child := pay(spend, activeNet.Subsidy-2, map[string]Transaction{hex.EncodeToString(spend.ID): *spend})
+	conflict := pay(funding[1], activeNet.Subsidy-3, nil)
+	picked := bc.pickTransactions([]Transaction{*confirmed, *spend, *conflict, *child}, time.Now().Unix())
+
+	require.Len(t, picked, 2, "Confirmed and conflicting transactions aren't picked")
+	assert.Equal(t, spend.ID, picked[0].ID)
+	assert.Equal(t, child.ID, picked[1].ID, "Children spend the parents picked before them")
+	assert.NoError(t, bc.checkBlock(NewBlock(append(picked, NewCoinbaseTransaction(address, "")), bc.getTip(), bc.getBestHeight()+1)))
+}
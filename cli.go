@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"time"
 )
 
 type CLI struct {
@@ -16,12 +19,35 @@ func (cli CLI) printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  printchain - print all the blocks of the blockchain")
 	fmt.Println("  listaddresses - Lists all addresses from the wallet file")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine - Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set.")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT -fee FEE -locktime LOCKTIME -rbf -mine -encrypt - Send AMOUNT of coins from FROM address to TO paying FEE, the estimate for confirming within 6 blocks by default. Keep it out of the blocks up to LOCKTIME, a height or a unix time from 500000000 on, which has to be past for the next block already. Let a higher fee replace it while unconfirmed when -rbf is set. Mine on the same node, when -mine is set. Use the encrypted transport when -encrypt is set.")
+	fmt.Println("  bumpfee -txid TXID -fee FEE -encrypt - Replace the replaceable transaction TXID sent from the wallets with one paying FEE, twice its fee by default, and at least its fee plus the relay fee of the replacement")
 	fmt.Println("  createwallet - Generates a new key-pair and saves it into the wallet file")
-	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
-	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
+	fmt.Println("  getpubkey -address ADDRESS - Prints the public key of ADDRESS from the wallet file, to share for a multisig address")
+	fmt.Println("  createmultisig -required M -pubkeys PUBKEYS - Prints the address and the P2SH address of the outputs M of the comma separated hex PUBKEYS have to sign for, with the redeem script")
+	fmt.Println("  multisigtx -from FROM -script SCRIPT -to TO -amount AMOUNT -fee FEE -file FILE - Saves to FILE a transaction sending AMOUNT from the multisig address FROM to TO, signed with the keys of the wallet file. A P2SH address FROM takes its hex redeem SCRIPT.")
+	fmt.Println("  signmultisig -file FILE -send -encrypt - Adds the signatures of the wallet file to the transaction in FILE, and sends it once complete when -send is set")
+	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain from the genesis block of the network, mining a first block rewarding ADDRESS when given. Only the first node of a network may take ADDRESS, the others start from the genesis block and sync the first block from it")
+	fmt.Println("  getbalance -address ADDRESS -spv - Get balance of ADDRESS, as the light client sees it when -spv is set")
 	fmt.Println("  startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println("    -listen HOST:PORT - Accept connections on HOST:PORT, default the port of the network")
+	fmt.Println("    -externalip HOST[:PORT] - Advertise HOST[:PORT] to other nodes instead of the listen address")
+	fmt.Println("    -seeds ADDRESSES - Comma separated peers to bootstrap from")
+	fmt.Println("    -addnode ADDRESSES - Comma separated peers to connect to in addition to the seeds")
+	fmt.Println("    -connect ADDRESSES - Connect to these comma separated peers only")
+	fmt.Println("    -bantime DURATION - How long misbehaving peers are banned")
+	fmt.Println("    -encrypt - Encrypt and authenticate peer connections with the node key")
+	fmt.Println("    -allowkeys FILE - Only talk to peers whose node keys are listed in FILE, implies -encrypt")
+	fmt.Println("    -spv - Run a light client keeping block headers only, following the wallets of NODE_ID")
+	fmt.Println("  nodekey - Prints the public node key used by the encrypted transport")
+	fmt.Println("  listpeers - Lists the addresses in the peer database")
+	fmt.Println("  getpeerinfo - Shows the peers the running node is connected to")
+	fmt.Println("  getmetrics - Shows how often the running node hit its connection and message limits")
 	fmt.Println("  reindexutxo - Rebuilds the UTXO set")
+	fmt.Println("  estimatefee -blocks N - Estimates the fee per 1000 bytes confirming a transaction within N blocks, from what the node saw")
+	fmt.Println("  listbanned - Lists banned peer addresses, hosts and node keys")
+	fmt.Println("  setban -addr ADDRESS -bantime DURATION -remove - Ban the peer at ADDRESS, every peer of a host given without a port, or a node key, for DURATION, or lift its ban when -remove is set")
+	fmt.Println("Every command takes -network NAME to run on mainnet, the default, testnet or regtest.")
+	fmt.Println("Nodes listen on port 3000, 13000 and 23000 of them by default, and keep their files apart.")
 
 }
 
@@ -32,8 +58,9 @@ func (cli CLI) validateArgs() {
 	}
 }
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
-	fmt.Printf("Starting node %s\n", nodeID)
+func (cli *CLI) startNode(config ServerConfig) {
+	fmt.Printf("Starting node %s\n", config.NodeID)
+	minerAddress := config.MinerAddress
 	if len(minerAddress) > 0 {
 		if ValidateAddress(minerAddress) {
 			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
@@ -41,7 +68,7 @@ func (cli *CLI) startNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	StartServer(nodeID, minerAddress)
+	StartServer(config)
 
 }
 
@@ -55,8 +82,106 @@ func (cli *CLI) reindexUTXO(nodeID string) {
 
 }
 
+func (cli CLI) estimateFee(blocks int, nodeID string) {
+	estimator, err := LoadFeeEstimator(nodeID)
+	if err != nil {
+		fmt.Println("No fee statistics yet, has the node run?")
+		return
+	}
+
+	rate, ok := estimator.estimate(blocks)
+	if !ok {
+		fmt.Printf("Not enough transactions confirmed to estimate the fee for %d blocks, the wallet pays %d per 1000 bytes\n", blocks, fallbackFeeRate)
+		return
+	}
+	fmt.Printf("%d per 1000 bytes to confirm within %d blocks\n", rate, blocks)
+}
+
+// estimatedFeeRate returns the fee rate the wallet pays when none is given
+func estimatedFeeRate(nodeID string) int {
+	estimator, _ := LoadFeeEstimator(nodeID)
+	rate, ok := estimator.estimate(sendConfirmTarget)
+	if !ok {
+		return fallbackFeeRate
+	}
+
+	return rate
+}
+
+func (cli CLI) listPeers(nodeID string) {
+	addrManager := NewAddrManager(nodeID)
+
+	for _, ka := range addrManager.getKnownAddresses() {
+		fmt.Printf("%s last seen %s, last success %s, %d failed attempts\n",
+			ka.Addr, formatTime(ka.LastSeen), formatTime(ka.LastSuccess), ka.Attempts)
+	}
+}
+
+func (cli CLI) getPeerInfo(nodeID string) {
+	connected, err := LoadPeerInfo(nodeID)
+	if err != nil {
+		fmt.Println("No peer info yet, is the node running?")
+		return
+	}
+
+	for _, peer := range connected {
+		latency := "unknown"
+		if peer.Latency > 0 {
+			latency = peer.Latency.String()
+		}
+		fmt.Printf("%s latency %s, last pong %s, best height %d, misbehavior %d",
+			peer.Addr, latency, formatTime(peer.LastPong), peer.BestHeight, peer.Misbehavior)
+		if len(peer.NodeKey) > 0 {
+			fmt.Printf(", node key %x", peer.NodeKey)
+		}
+		if peer.Light {
+			fmt.Printf(", light client")
+		}
+		fmt.Println()
+	}
+}
+
+func (cli CLI) getMetrics(nodeID string) {
+	m, err := LoadMetrics(nodeID)
+	if err != nil {
+		fmt.Println("No metrics yet, is the node running?")
+		return
+	}
+
+	for _, name := range m.names() {
+		fmt.Printf("%s %d\n", name, m.Counters[name])
+	}
+}
+
+func (cli CLI) listBanned(nodeID string) {
+	bans := NewBanList(nodeID)
+
+	for _, address := range bans.getBanned() {
+		fmt.Printf("%s banned until %s\n", address, bans.Bans[address].Format(time.RFC3339))
+	}
+}
+
+func (cli CLI) setBan(address string, banTime time.Duration, remove bool, nodeID string) {
+	bans := NewBanList(nodeID)
+	// nodes ban peers by the address they advertise, a host without a port
+	// stands for every peer on it
+	address = normalizeAddress(address)
+
+	if remove {
+		if !bans.unban(address) {
+			fmt.Printf("%s is not banned\n", address)
+			return
+		}
+		fmt.Printf("Unbanned %s\n", address)
+		return
+	}
+
+	bans.ban(address, banTime)
+	fmt.Printf("Banned %s for %s\n", address, banTime)
+}
+
 func (cli *CLI) createBlockchain(address string, nodeID string) {
-	if !ValidateAddress(address) {
+	if address != "" && !ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
 	}
 	bc := CreateBlockchain(address,nodeID)
@@ -86,28 +211,41 @@ func (cli CLI) listAddresses(nodeID string) {
 
 }
 
-func (cli CLI) getBalance(address string, nodeID string) {
+func (cli CLI) getBalance(address string, nodeID string, spv bool) {
 	if !ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
 	}
 
+	//get all unspentTXs by address
+	pubKeyHash := Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+
+	if spv {
+		chain := NewSPVChain(nodeID, walletPubKeys(nodeID))
+		defer chain.db.Close()
+		fmt.Printf("Balance of '%s': %d\n", address, chain.getBalance(pubKeyHash))
+		return
+	}
+
 	bc := NewBlockChain(nodeID)
 	utxoSet := UTXOSet{bc}
 	defer bc.db.Close()
 
 	balance := 0
-	//get all unspentTXs by address
-	pubKeyHash := Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
 	//utxos := bc.findUTXOs(pubKeyHash)
-	utxos := utxoSet.findUTXO(pubKeyHash)
+	utxos := utxoSet.findUTXO(addressScript(address))
 	for _, out := range utxos {
 		balance += out.Value
 	}
 	fmt.Printf("Balance of '%s': %d\n", address, balance)
 }
 
-func (cli *CLI) send(from, to string, value int, nodeID string, mineNow bool) {
+func (cli CLI) printNodeKey(nodeID string) {
+	key := LoadNodeKey(nodeID)
+	fmt.Printf("%x\n", key.PublicKey().Bytes())
+}
+
+func (cli *CLI) send(from, to string, value int, options TxOptions, nodeID string, mineNow bool, encrypt bool) {
 	if !ValidateAddress(from) {
 		log.Panic("ERROR: From address is not valid")
 	}
@@ -126,22 +264,220 @@ func (cli *CLI) send(from, to string, value int, nodeID string, mineNow bool) {
 	}
 	wallet := wallets.GetWallet(from)
 
-
-	tx := bc.NewUTXOTransaction(&wallet, to, value, utxoSet)
-
+	// the change of the transactions sent before and not mined yet can be
+	// spent already
+	pool := wallets.pendingPool(bc)
+	tx := bc.NewUTXOTransaction(&wallet, to, value, options, utxoSet, pool)
+	// nodes only take the transactions the next block can have, and would
+	// drop one locked past it
+	height := bc.getBestHeight() + 1
+	err = bc.checkLocks(tx, height, time.Now().Unix(), pool.pending())
+	if err != nil {
+		fmt.Printf("ERROR: Not sending, the %s and the next block is %d. Send it once the lock time is past.\n", err, height)
+		bc.db.Close()
+		os.Exit(1)
+	}
 
 	if mineNow {
 		coinbase := NewCoinbaseTransaction(from,"")   // add coinbase reward to tx sender
-		txs := []*Transaction{coinbase,tx}
-		newBlock := bc.MineBlock(txs)
+		txs := []*Transaction{coinbase}
+		for _, pending := range pool.transactions() {
+			pending := pending
+			txs = append(txs, &pending)
+		}
+		newBlock := bc.MineBlock(append(txs, tx))
 		utxoSet.update(newBlock)
+		wallets.Sent = nil
 	} else {
-		SendTx(knownNodes[0], tx)
+		wallets.Sent = append(wallets.Sent, *tx)
+		cli.broadcast(tx, nodeID, bc, encrypt)
 	}
+	wallets.saveToFile(nodeID)
 
 	fmt.Printf("Send amount successfuly!")
 }
 
+// bumpFee replaces a replaceable transaction sent from the wallets with one
+// paying fee, taking the difference from its change
+func (cli *CLI) bumpFee(txID []byte, fee int, nodeID string, encrypt bool) {
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	pool := wallets.pendingPool(bc)
+	original, ok := pool.get(txID)
+	if !ok {
+		log.Panic("ERROR: Transaction isn't a pending one sent from the wallets")
+	}
+	if !original.Replaceable {
+		log.Panic("ERROR: Transaction isn't replaceable")
+	}
+	oldFee, _ := pool.fee(txID)
+	minFee := oldFee + feeForRate(minRelayFeeRate, len(original.encode()))
+	if fee == 0 {
+		fee = 2 * oldFee
+		if fee < minFee {
+			fee = minFee
+		}
+	}
+	if fee < minFee {
+		log.Panic("ERROR: The new fee has to be at least ", minFee)
+	}
+
+	var wallet *Wallet
+	for _, w := range wallets.Wallets {
+		if bytes.Equal(w.PublicKey, original.Vin[0].PubKey) {
+			wallet = w
+		}
+	}
+	if wallet == nil {
+		log.Panic("ERROR: The wallet sending the transaction is not found")
+	}
+
+	tx := Transaction{nil, nil, nil, true, original.LockTime}
+	for _, vin := range original.Vin {
+		tx.Vin = append(tx.Vin, TXInput{vin.Txid, vin.Vout, nil, vin.PubKey, nil, vin.Sequence})
+	}
+	change := -1
+	pubKeyHash := HashPubKey(wallet.PublicKey)
+	for i, out := range original.Vout {
+		tx.Vout = append(tx.Vout, out)
+		if out.Unlock(pubKeyHash) {
+			change = i
+		}
+	}
+	if change < 0 || tx.Vout[change].Value <= fee-oldFee {
+		log.Panic("ERROR: The change of the transaction can't pay the fee")
+	}
+	tx.Vout[change].Value -= fee - oldFee
+	tx.ID = tx.hash()
+	bc.signTransaction(&tx, wallet.PrivateKey, pool.pending())
+
+	err = pool.add(&tx, bc)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets.replaceSent(txID, &tx)
+	wallets.saveToFile(nodeID)
+	cli.broadcast(&tx, nodeID, bc, encrypt)
+
+	fmt.Printf("Replaced transaction %x with %x paying %d\n", txID, tx.ID, fee)
+}
+
+func (cli CLI) getPubKey(address, nodeID string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("ERROR: Address is not in the wallet file")
+	}
+	fmt.Printf("%x\n", wallet.PublicKey)
+}
+
+func (cli CLI) createMultisig(required int, pubKeys [][]byte) {
+	address, err := multisigAddress(required, pubKeys)
+	if err != nil {
+		log.Panic(err)
+	}
+	_, script, _ := decodeAddress(address)
+	fmt.Printf("Address:       %s\n", address)
+	p2shAddress, err := scriptHashAddress(script)
+	if err == nil {
+		fmt.Printf("P2SH address:  %s\n", p2shAddress)
+	} else {
+		fmt.Printf("P2SH address:  none, %s\n", err)
+	}
+	fmt.Printf("Redeem script: %x\n", script)
+	fmt.Printf("Script:        %s\n", disassembleScript(script))
+}
+
+// multisigTx starts a transaction spending from a multisig address, signed
+// with the keys the wallets hold, for the other key holders to sign
+func (cli *CLI) multisigTx(from string, redeemScript []byte, to string, value int, options TxOptions, file, nodeID string) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: From address is not valid")
+	}
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: To address is not valid")
+	}
+
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	ptx := bc.NewMultisigTransaction(from, redeemScript, to, value, options, UTXOSet{bc}, wallets.pendingPool(bc))
+	cli.signPartial(ptx, wallets, file)
+}
+
+// signMultisig adds the signatures of the wallets to a transaction being
+// signed, sending it when asked once it has all it needs
+func (cli *CLI) signMultisig(file, nodeID string, send, encrypt bool) {
+	ptx, err := LoadPartialTransaction(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	cli.signPartial(ptx, wallets, file)
+	if !send {
+		return
+	}
+
+	tx, err := ptx.finalize()
+	if err != nil {
+		log.Panic(err)
+	}
+	bc := NewBlockChain(nodeID)
+	defer bc.db.Close()
+
+	err = wallets.pendingPool(bc).add(tx, bc)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets.Sent = append(wallets.Sent, *tx)
+	wallets.saveToFile(nodeID)
+	cli.broadcast(tx, nodeID, bc, encrypt)
+
+	fmt.Printf("Sent transaction %x\n", tx.ID)
+}
+
+// signPartial signs a partial transaction with every wallet and saves it
+func (cli *CLI) signPartial(ptx *PartialTransaction, wallets *Wallets, file string) {
+	added := 0
+	for _, wallet := range wallets.Wallets {
+		added += ptx.sign(wallet)
+	}
+	ptx.saveToFile(file)
+
+	fmt.Printf("Added %d signatures, %d more needed\n", added, ptx.missing())
+}
+
+// broadcast hands a transaction to the peers we know, they relay it on
+func (cli *CLI) broadcast(tx *Transaction, nodeID string, bc *Blockchain, encrypt bool) {
+	var transport Transport = TCPTransport{}
+	if encrypt {
+		transport = &SecureTransport{Inner: transport, Key: LoadNodeKey(nodeID)}
+	}
+	client := NewServer(ServerConfig{NodeID: nodeID}, bc, transport)
+	nodes := client.addrManager.getAddresses(maxOutboundPeers)
+	if len(nodes) == 0 {
+		nodes = activeNet.DefaultSeeds
+	}
+	for _, node := range nodes {
+		client.SendTx(node, tx)
+	}
+}
+
 func (cli CLI) printChain(nodeID string) {
 	bc := NewBlockChain(nodeID)
 	defer bc.db.Close()
@@ -186,11 +522,62 @@ func (cli CLI) run() {
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendEncrypt := sendCmd.Bool("encrypt", false, "Send over the encrypted transport")
+	sendFee := sendCmd.Int("fee", 0, "Fee to pay, estimated by default")
+	sendLockTime := sendCmd.Int64("locktime", 0, "Height or unix time the transaction can't be mined before or at")
+	estimateFeeCmd := flag.NewFlagSet("estimatefee", flag.ExitOnError)
+	estimateFeeBlocks := estimateFeeCmd.Int("blocks", sendConfirmTarget, "The number of blocks to confirm within")
+	sendRBF := sendCmd.Bool("rbf", false, "Let a transaction paying more replace it while unconfirmed")
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
+	bumpFeeTxID := bumpFeeCmd.String("txid", "", "The transaction to replace")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "The fee of the replacement, twice the original by default")
+	bumpFeeEncrypt := bumpFeeCmd.Bool("encrypt", false, "Send over the encrypted transport")
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
-	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	getBalanceSPV := getBalanceCmd.Bool("spv", false, "Read the balance from the light client")
+	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to reward the first block with, on the first node of a network only")
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeBanTime := startNodeCmd.Duration("bantime", defaultBanTime, "How long misbehaving peers are banned")
+	startNodeSeeds := startNodeCmd.String("seeds", "", "Comma separated peer addresses to bootstrap from, default the seeds of the network")
+	startNodeListen := startNodeCmd.String("listen", "", "Address to accept connections on, default the port of the network")
+	startNodeExternalIP := startNodeCmd.String("externalip", "", "Address advertised to other nodes")
+	startNodeAddNode := startNodeCmd.String("addnode", "", "Comma separated peer addresses to connect to in addition to the seeds")
+	startNodeConnect := startNodeCmd.String("connect", "", "Comma separated peer addresses to connect to exclusively")
+	listPeersCmd := flag.NewFlagSet("listpeers", flag.ExitOnError)
+	getPeerInfoCmd := flag.NewFlagSet("getpeerinfo", flag.ExitOnError)
+	startNodeEncrypt := startNodeCmd.Bool("encrypt", false, "Encrypt and authenticate peer connections")
+	startNodeAllowKeys := startNodeCmd.String("allowkeys", "", "File of node keys allowed to connect")
+	startNodeSPV := startNodeCmd.Bool("spv", false, "Run a light client keeping block headers only")
+	getMetricsCmd := flag.NewFlagSet("getmetrics", flag.ExitOnError)
+	nodeKeyCmd := flag.NewFlagSet("nodekey", flag.ExitOnError)
+	listBannedCmd := flag.NewFlagSet("listbanned", flag.ExitOnError)
+	setBanCmd := flag.NewFlagSet("setban", flag.ExitOnError)
+	setBanAddress := setBanCmd.String("addr", "", "The peer address, host or node key to ban")
+	setBanTime := setBanCmd.Duration("bantime", defaultBanTime, "How long to ban the address")
+	setBanRemove := setBanCmd.Bool("remove", false, "Lift the ban instead")
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "The address to print the public key of")
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	createMultisigRequired := createMultisigCmd.Int("required", 0, "How many of the keys have to sign")
+	createMultisigPubKeys := createMultisigCmd.String("pubkeys", "", "Comma separated hex public keys")
+	multisigTxCmd := flag.NewFlagSet("multisigtx", flag.ExitOnError)
+	multisigTxFrom := multisigTxCmd.String("from", "", "Source multisig address")
+	multisigTxScript := multisigTxCmd.String("script", "", "Hex redeem script of a P2SH source address")
+	multisigTxTo := multisigTxCmd.String("to", "", "Destination wallet address")
+	multisigTxAmount := multisigTxCmd.Int("amount", 0, "Amount to send")
+	multisigTxFee := multisigTxCmd.Int("fee", 0, "Fee to pay, estimated by default")
+	multisigTxFile := multisigTxCmd.String("file", "", "File to save the transaction to")
+	signMultisigCmd := flag.NewFlagSet("signmultisig", flag.ExitOnError)
+	signMultisigFile := signMultisigCmd.String("file", "", "File of the transaction to sign")
+	signMultisigSend := signMultisigCmd.Bool("send", false, "Send the transaction once it has enough signatures")
+	signMultisigEncrypt := signMultisigCmd.Bool("encrypt", false, "Send over the encrypted transport")
+	var network string
+	for _, cmd := range []*flag.FlagSet{sendCmd, printChainCmd, getBalanceCmd, listAddressesCmd, createBlockchainCmd,
+		createWalletCmd, reindexUTXOCmd, startNodeCmd, listPeersCmd, getPeerInfoCmd, getMetricsCmd, nodeKeyCmd,
+		listBannedCmd, setBanCmd, bumpFeeCmd, estimateFeeCmd, getPubKeyCmd, createMultisigCmd, multisigTxCmd, signMultisigCmd} {
+		cmd.StringVar(&network, "network", mainNetParams.Name, "The network to use: mainnet, testnet or regtest")
+	}
 
 
 	switch os.Args[1] {
@@ -234,17 +621,95 @@ func (cli CLI) run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "listpeers":
+		err := listPeersCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpeerinfo":
+		err := getPeerInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getmetrics":
+		err := getMetricsCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "nodekey":
+		err := nodeKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "listbanned":
+		err := listBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "setban":
+		err := setBanCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "bumpfee":
+		err := bumpFeeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "estimatefee":
+		err := estimateFeeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpubkey":
+		err := getPubKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "multisigtx":
+		err := multisigTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signmultisig":
+		err := signMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		os.Exit(1)
 	}
 
+	params, err := netParamsByName(network)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	activeNet = params
+	nodeID = activeNet.dataID(nodeID)
+
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendLockTime < 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		options := TxOptions{Fee: *sendFee, Replaceable: *sendRBF, LockTime: *sendLockTime}
+		feeSet := false
+		sendCmd.Visit(func(f *flag.Flag) {
+			if f.Name == "fee" {
+				feeSet = true
+			}
+		})
+		if !feeSet {
+			options.FeeRate = estimatedFeeRate(nodeID)
+		}
+		cli.send(*sendFrom, *sendTo, *sendAmount, options, nodeID, *sendMine, *sendEncrypt)
 	}
 
 	if printChainCmd.Parsed() {
@@ -256,13 +721,9 @@ func (cli CLI) run() {
 			getBalanceCmd.Usage()
 			os.Exit(1)
 		}
-		cli.getBalance(*getBalanceAddress, nodeID)
+		cli.getBalance(*getBalanceAddress, nodeID, *getBalanceSPV)
 	}
 	if createBlockchainCmd.Parsed() {
-		if *createBlockchainAddress == "" {
-			createBlockchainCmd.Usage()
-			os.Exit(1)
-		}
 		cli.createBlockchain(*createBlockchainAddress,nodeID)
 	}
 	if createWalletCmd.Parsed() {
@@ -275,6 +736,108 @@ func (cli CLI) run() {
 		cli.reindexUTXO(nodeID)
 	}
 	if startNodeCmd.Parsed() {
-		cli.startNode(nodeID, *startNodeMiner)
+		if *startNodeListen == "" {
+			*startNodeListen = defaultListenAddress()
+		}
+		seeds := activeNet.DefaultSeeds
+		startNodeCmd.Visit(func(f *flag.Flag) {
+			if f.Name == "seeds" {
+				seeds = splitAddresses(*startNodeSeeds)
+			}
+		})
+		cli.startNode(ServerConfig{
+			NodeID:        nodeID,
+			MinerAddress:  *startNodeMiner,
+			ListenAddr:    *startNodeListen,
+			ExternalAddr:  *startNodeExternalIP,
+			Seeds:         seeds,
+			AddNodes:      splitAddresses(*startNodeAddNode),
+			Connect:       splitAddresses(*startNodeConnect),
+			BanTime:       *startNodeBanTime,
+			Encrypt:       *startNodeEncrypt,
+			AllowKeysFile: *startNodeAllowKeys,
+			SPV:           *startNodeSPV,
+		})
+	}
+	if listPeersCmd.Parsed() {
+		cli.listPeers(nodeID)
+	}
+	if getPeerInfoCmd.Parsed() {
+		cli.getPeerInfo(nodeID)
+	}
+	if getMetricsCmd.Parsed() {
+		cli.getMetrics(nodeID)
+	}
+	if nodeKeyCmd.Parsed() {
+		cli.printNodeKey(nodeID)
+	}
+	if listBannedCmd.Parsed() {
+		cli.listBanned(nodeID)
+	}
+	if setBanCmd.Parsed() {
+		if *setBanAddress == "" {
+			setBanCmd.Usage()
+			os.Exit(1)
+		}
+		cli.setBan(*setBanAddress, *setBanTime, *setBanRemove, nodeID)
+	}
+	if estimateFeeCmd.Parsed() {
+		if *estimateFeeBlocks <= 0 || *estimateFeeBlocks > maxConfirmBlocks {
+			estimateFeeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.estimateFee(*estimateFeeBlocks, nodeID)
+	}
+	if bumpFeeCmd.Parsed() {
+		txID, err := hex.DecodeString(*bumpFeeTxID)
+		if err != nil || len(txID) == 0 || *bumpFeeFee < 0 {
+			bumpFeeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.bumpFee(txID, *bumpFeeFee, nodeID, *bumpFeeEncrypt)
+	}
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getPubKey(*getPubKeyAddress, nodeID)
+	}
+	if createMultisigCmd.Parsed() {
+		var pubKeys [][]byte
+		for _, key := range splitAddresses(*createMultisigPubKeys) {
+			pubKey, err := hex.DecodeString(key)
+			if err != nil {
+				createMultisigCmd.Usage()
+				os.Exit(1)
+			}
+			pubKeys = append(pubKeys, pubKey)
+		}
+		cli.createMultisig(*createMultisigRequired, pubKeys)
+	}
+	if multisigTxCmd.Parsed() {
+		redeemScript, err := hex.DecodeString(*multisigTxScript)
+		if err != nil || *multisigTxFrom == "" || *multisigTxTo == "" || *multisigTxAmount <= 0 || *multisigTxFee < 0 || *multisigTxFile == "" {
+			multisigTxCmd.Usage()
+			os.Exit(1)
+		}
+		options := TxOptions{Fee: *multisigTxFee}
+		feeSet := false
+		multisigTxCmd.Visit(func(f *flag.Flag) {
+			if f.Name == "fee" {
+				feeSet = true
+			}
+		})
+		if !feeSet {
+			options.FeeRate = estimatedFeeRate(nodeID)
+		}
+		cli.multisigTx(*multisigTxFrom, redeemScript, *multisigTxTo, *multisigTxAmount, options, *multisigTxFile, nodeID)
+	}
+	if signMultisigCmd.Parsed() {
+		if *signMultisigFile == "" {
+			signMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signMultisig(*signMultisigFile, nodeID, *signMultisigSend, *signMultisigEncrypt)
 	}
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// shortIDMask keeps the 6 low bytes of a short transaction ID
+const shortIDMask = 1<<48 - 1
+
+// CompactBlock announces a block as its header and short IDs of its
+// transactions, leaving out the ones the receiver most likely has in its
+// mempool already. The coinbase can't be in anyone's mempool, so it travels
+// in full as a prefilled transaction.
+type CompactBlock struct {
+	Timestamp     int64
+	PrevBlockHash []byte
+	Hash          []byte
+	Nonce         int
+	Height        int
+	// Salt keys the short IDs, so they differ from block to block
+	Salt      uint64
+	ShortIDs  []uint64
+	Prefilled []PrefilledTransaction
+}
+
+// PrefilledTransaction is a transaction sent in full with its position in the block
+type PrefilledTransaction struct {
+	Index       int
+	Transaction []byte
+}
+
+// NewCompactBlock builds the compact form of a block
+func NewCompactBlock(block *Block) *CompactBlock {
+	var salt [8]byte
+	_, err := rand.Read(salt[:])
+	if err != nil {
+		log.Panic(err)
+	}
+
+	cb := &CompactBlock{
+		Timestamp:     block.Timestamp,
+		PrevBlockHash: block.PrevBlockHash,
+		Hash:          block.Hash,
+		Nonce:         block.Nonce,
+		Height:        block.Height,
+		Salt:          binary.LittleEndian.Uint64(salt[:]),
+	}
+	for i, tx := range block.Transactions {
+		if tx.isCoinbase() {
+			cb.Prefilled = append(cb.Prefilled, PrefilledTransaction{i, tx.serialize()})
+		} else {
+			cb.ShortIDs = append(cb.ShortIDs, cb.shortID(tx.ID))
+		}
+	}
+
+	return cb
+}
+
+// ShortID maps a transaction ID to its 6 byte ID in this block
+func (cb *CompactBlock) shortID(txID []byte) uint64 {
+	var salt [8]byte
+	binary.LittleEndian.PutUint64(salt[:], cb.Salt)
+	key := sha256.Sum256(append(append([]byte{}, cb.Hash...), salt[:]...))
+
+	k0 := binary.LittleEndian.Uint64(key[0:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+
+	return sipHash(k0, k1, txID) & shortIDMask
+}
+
+func (cb *CompactBlock) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(cb)
+	if err != nil {
+		log.Panic(err)
+	}
+	return result.Bytes()
+}
+
+// decodeCompactBlock deserializes a compact block received from the network
+func decodeCompactBlock(data []byte) (*CompactBlock, error) {
+	var cb CompactBlock
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&cb)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cb, nil
+}
+
+// partialBlock is a compact block being rebuilt from the mempool,
+// with nil in the slots still waiting for their transaction
+type partialBlock struct {
+	header       *CompactBlock
+	transactions []*Transaction
+	// peer is the node asked for the missing transactions
+	peer string
+}
+
+// newPartialBlock places the prefilled transactions and those of the
+// mempool matching a short ID. Short IDs that are ambiguous, matching more
+// than one mempool transaction or appearing twice in the block, leave their
+// slots empty, to be requested like the missing transactions.
+func newPartialBlock(cb *CompactBlock, mempool []Transaction) (*partialBlock, error) {
+	total := len(cb.ShortIDs) + len(cb.Prefilled)
+	if total == 0 {
+		return nil, errors.New("compact block has no transactions")
+	}
+
+	pb := &partialBlock{header: cb, transactions: make([]*Transaction, total)}
+	for _, prefilled := range cb.Prefilled {
+		if prefilled.Index < 0 || prefilled.Index >= total || pb.transactions[prefilled.Index] != nil {
+			return nil, fmt.Errorf("invalid prefilled transaction index %d", prefilled.Index)
+		}
+		tx, err := decodeTransaction(prefilled.Transaction)
+		if err != nil {
+			return nil, err
+		}
+		pb.transactions[prefilled.Index] = &tx
+	}
+
+	// the short IDs fill the slots left free by the prefilled transactions, in order
+	slots := make(map[uint64]int)
+	ambiguous := make(map[uint64]bool)
+	next := 0
+	for _, id := range cb.ShortIDs {
+		for pb.transactions[next] != nil {
+			next++
+		}
+		if _, ok := slots[id]; ok {
+			ambiguous[id] = true
+		}
+		slots[id] = next
+		next++
+	}
+
+	matched := make(map[uint64]*Transaction)
+	for i := range mempool {
+		tx := &mempool[i]
+		id := cb.shortID(tx.ID)
+		if _, ok := slots[id]; !ok {
+			continue
+		}
+		if _, ok := matched[id]; ok {
+			ambiguous[id] = true
+		}
+		matched[id] = tx
+	}
+	for id, tx := range matched {
+		if !ambiguous[id] {
+			pb.transactions[slots[id]] = tx
+		}
+	}
+
+	return pb, nil
+}
+
+// missing returns the positions of the transactions still to fetch
+func (pb *partialBlock) missing() []int {
+	var indexes []int
+	for i, tx := range pb.transactions {
+		if tx == nil {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return indexes
+}
+
+// fill places the transactions received for the missing positions
+func (pb *partialBlock) fill(txs []*Transaction) error {
+	missing := pb.missing()
+	if len(txs) != len(missing) {
+		return fmt.Errorf("got %d transactions for %d missing", len(txs), len(missing))
+	}
+	for i, index := range missing {
+		if pb.header.shortID(txs[i].ID) != pb.header.ShortIDs[pb.shortIDPosition(index)] {
+			return fmt.Errorf("transaction %x doesn't match its short ID", txs[i].ID)
+		}
+		pb.transactions[index] = txs[i]
+	}
+
+	return nil
+}
+
+// shortIDPosition tells which short ID stands for the transaction at index
+func (pb *partialBlock) shortIDPosition(index int) int {
+	position := index
+	for _, prefilled := range pb.header.Prefilled {
+		if prefilled.Index < index {
+			position--
+		}
+	}
+
+	return position
+}
+
+// block assembles the full block once nothing is missing
+func (pb *partialBlock) block() *Block {
+	cb := pb.header
+
+	return &Block{cb.Timestamp, pb.transactions, cb.PrevBlockHash, cb.Hash, cb.Nonce, cb.Height}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSipHash(t *testing.T) {
+	// reference vectors of SipHash-2-4 with key 00 01 .. 0f
+	key0, key1 := uint64(0x0706050403020100), uint64(0x0f0e0d0c0b0a0908)
+	message := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14}
+
+	assert.Equal(t, uint64(0x726fdb47dd0e0e31), sipHash(key0, key1, nil))
+	assert.Equal(t, uint64(0xa129ca6149be45e5), sipHash(key0, key1, message))
+}
+
+// testTransaction builds a distinct transaction spending a made up output
+func testTransaction(n byte) *Transaction {
+	tx := &Transaction{nil, []TXInput{{[]byte{n}, 0, nil, nil, nil, 0}}, []TXOutput{{int(n), []byte{n}, nil}}, false, 0}
+	tx.ID = tx.hash()
+
+	return tx
+}
+
+func TestCompactBlock(t *testing.T) {
+	var txs []*Transaction
+	for i := byte(1); i <= 3; i++ {
+		txs = append(txs, testTransaction(i))
+	}
+	coinbase := &Transaction{[]byte("coinbase"), []TXInput{{[]byte{}, -1, nil, []byte("reward"), nil, 0}}, nil, false, 0}
+	block := &Block{1, append(txs, coinbase), []byte("prev"), []byte("hash"), 7, 3}
+
+	cb, err := decodeCompactBlock(NewCompactBlock(block).Serialize())
+	assert.NoError(t, err)
+	assert.Len(t, cb.ShortIDs, 3)
+	assert.Len(t, cb.Prefilled, 1, "The coinbase is sent in full")
+
+	// the mempool lacks the second transaction and holds an unrelated one
+	mempool := []Transaction{*testTransaction(9), *txs[2], *txs[0]}
+	pb, err := newPartialBlock(cb, mempool)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, pb.missing())
+
+	assert.Error(t, pb.fill([]*Transaction{txs[2]}), "A transaction not matching the short ID is refused")
+	assert.NoError(t, pb.fill([]*Transaction{txs[1]}))
+	assert.Empty(t, pb.missing())
+
+	rebuilt := pb.block()
+	assert.Equal(t, block.hashTransactions(), rebuilt.hashTransactions())
+	assert.Equal(t, block.Hash, rebuilt.Hash)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// defaultListenAddress is where nodes of the network listen by default
+func defaultListenAddress() string {
+	return ":" + activeNet.DefaultPort
+}
+
+// ServerConfig collects the startnode options
+type ServerConfig struct {
+	NodeID       string
+	MinerAddress string
+	// ListenAddr is the host:port the node accepts connections on
+	ListenAddr string
+	// ExternalAddr is the address advertised to other nodes, it defaults
+	// to the listen address
+	ExternalAddr string
+	// Seeds are contacted on startup together with the peer database
+	Seeds []string
+	// AddNodes are contacted on startup in addition to the seeds
+	AddNodes []string
+	// Connect makes the node talk to these peers only, ignoring seeds,
+	// the peer database and gossiped addresses
+	Connect []string
+	BanTime time.Duration
+	// Encrypt wraps every peer connection in the encrypted transport
+	Encrypt bool
+	// AllowKeysFile lists the node keys allowed to connect, it implies Encrypt
+	AllowKeysFile string
+	// SPV runs a light client keeping block headers only, following the
+	// wallets of the node
+	SPV bool
+}
+
+// advertisedAddress works out the address other nodes can reach us on
+func (config *ServerConfig) advertisedAddress() (string, error) {
+	listenHost, listenPort, err := net.SplitHostPort(config.ListenAddr)
+	if err != nil {
+		return "", err
+	}
+
+	if config.ExternalAddr == "" {
+		if ip := net.ParseIP(listenHost); listenHost == "" || (ip != nil && ip.IsUnspecified()) {
+			listenHost = "localhost"
+		}
+		return net.JoinHostPort(listenHost, listenPort), nil
+	}
+
+	host, port, err := net.SplitHostPort(config.ExternalAddr)
+	if err != nil {
+		// no port given, we are reachable on the one we listen on
+		host, port = config.ExternalAddr, listenPort
+	}
+	if host == "" {
+		return "", errors.New("external address has no host")
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// initialPeers lists the nodes to connect to on startup
+func (config *ServerConfig) initialPeers(addrManager *AddrManager) []string {
+	if len(config.Connect) > 0 {
+		return config.Connect
+	}
+
+	// the seeds, then whatever we learned in earlier runs
+	peers := append([]string{}, config.Seeds...)
+	peers = append(peers, config.AddNodes...)
+
+	return append(peers, addrManager.getAddresses(maxOutboundPeers)...)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"sync"
+)
+
+const feeEstimatesFile = "fee_estimates_%s.dat"
+
+// feeBuckets is how many fee rate buckets are tracked. Fee rates are per
+// 1000 bytes, bucket 0 holds the transactions paying nothing and bucket i
+// the ones paying from 2^(i-1) up to 2^i.
+const feeBuckets = 16
+
+// maxConfirmBlocks is the longest confirmation target tracked, a
+// transaction waiting longer counts as never confirmed
+const maxConfirmBlocks = 25
+
+// estimateDecay weighs down the older statistics with every block, so the
+// estimates follow the fees paid lately
+const estimateDecay = 0.998
+
+// estimateSuccess is the share of the transactions of a bucket that have to
+// confirm within the target for its fee rate to be estimated
+const estimateSuccess = 0.85
+
+// minEstimateSamples is how many transactions an estimate takes, decayed
+const minEstimateSamples = 2
+
+// fallbackFeeRate is what the wallet pays before there's enough data for
+// an estimate
+const fallbackFeeRate = 1
+
+// sendConfirmTarget is the number of blocks the wallet wants its
+// transactions confirmed within
+const sendConfirmTarget = 6
+
+// trackedTx is a transaction of the mempool waiting for a block
+type trackedTx struct {
+	bucket int
+	height int
+}
+
+// FeeEstimator learns how many blocks the transactions of each fee rate
+// bucket wait for, from the ones going through the mempool
+type FeeEstimator struct {
+	// Confirmed counts, per bucket, the transactions confirmed within i+1
+	// blocks for every i
+	Confirmed [][]float64
+	// Total counts, per bucket, the transactions confirmed or given up on
+	Total []float64
+	// Height is the height of the last block taken into account
+	Height int
+
+	tracked map[string]trackedTx
+	mu      sync.Mutex
+}
+
+func NewFeeEstimator() *FeeEstimator {
+	estimator := &FeeEstimator{
+		Confirmed: make([][]float64, feeBuckets),
+		Total:     make([]float64, feeBuckets),
+		tracked:   make(map[string]trackedTx),
+	}
+	for i := range estimator.Confirmed {
+		estimator.Confirmed[i] = make([]float64, maxConfirmBlocks)
+	}
+
+	return estimator
+}
+
+// feeRate returns the fee a transaction pays per 1000 bytes
+func feeRate(fee, size int) int {
+	return fee * 1000 / size
+}
+
+// feeForRate returns the fee paying rate for size bytes, rounded up
+func feeForRate(rate, size int) int {
+	return (rate*size + 999) / 1000
+}
+
+func feeBucket(rate int) int {
+	if rate <= 0 {
+		return 0
+	}
+	bucket := bits.Len(uint(rate))
+	if bucket >= feeBuckets {
+		bucket = feeBuckets - 1
+	}
+
+	return bucket
+}
+
+// bucketRate returns the lowest fee rate of a bucket
+func bucketRate(bucket int) int {
+	if bucket == 0 {
+		return 0
+	}
+
+	return 1 << uint(bucket-1)
+}
+
+// track starts timing a transaction that entered the mempool when the chain
+// was at height
+func (e *FeeEstimator) track(txID []byte, fee, size, height int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.tracked[hex.EncodeToString(txID)] = trackedTx{feeBucket(feeRate(fee, size)), height}
+}
+
+// processBlock records how long the tracked transactions of a connected
+// block waited. The ones waiting too long count as never confirmed, and
+// the ones no longer in the pool, like replaced ones, aren't tracked anymore.
+func (e *FeeEstimator) processBlock(block *Block, pool *TxPool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// blocks connected again after a reorg don't count twice
+	if block.Height <= e.Height {
+		return
+	}
+	decay := math.Pow(estimateDecay, float64(block.Height-e.Height))
+	for bucket := range e.Total {
+		e.Total[bucket] *= decay
+		for i := range e.Confirmed[bucket] {
+			e.Confirmed[bucket][i] *= decay
+		}
+	}
+	e.Height = block.Height
+
+	for _, tx := range block.Transactions {
+		txID := hex.EncodeToString(tx.ID)
+		tracked, ok := e.tracked[txID]
+		if !ok {
+			continue
+		}
+		delete(e.tracked, txID)
+		blocks := block.Height - tracked.height
+		if blocks < 1 {
+			blocks = 1
+		}
+		e.Total[tracked.bucket]++
+		for i := blocks - 1; i < maxConfirmBlocks; i++ {
+			e.Confirmed[tracked.bucket][i]++
+		}
+	}
+
+	for txID, tracked := range e.tracked {
+		if block.Height-tracked.height >= maxConfirmBlocks {
+			e.Total[tracked.bucket]++
+			delete(e.tracked, txID)
+			continue
+		}
+		ID, _ := hex.DecodeString(txID)
+		if !pool.has(ID) {
+			delete(e.tracked, txID)
+		}
+	}
+}
+
+// estimate returns the lowest fee rate that confirmed within blocks often
+// enough. Starting from the highest buckets, the ones with too few
+// transactions are taken together with the next ones.
+func (e *FeeEstimator) estimate(blocks int) (int, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if blocks < 1 {
+		blocks = 1
+	}
+	if blocks > maxConfirmBlocks {
+		blocks = maxConfirmBlocks
+	}
+
+	best := -1
+	confirmed, total := 0.0, 0.0
+	for bucket := feeBuckets - 1; bucket >= 0; bucket-- {
+		confirmed += e.Confirmed[bucket][blocks-1]
+		total += e.Total[bucket]
+		if total < minEstimateSamples {
+			continue
+		}
+		if confirmed/total < estimateSuccess {
+			break
+		}
+		best = bucket
+		confirmed, total = 0, 0
+	}
+	if best < 0 {
+		return 0, false
+	}
+
+	return bucketRate(best), true
+}
+
+func (e *FeeEstimator) saveToFile(nodeID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var content bytes.Buffer
+	feeEstimatesFile := fmt.Sprintf(feeEstimatesFile, nodeID)
+
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(e)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = ioutil.WriteFile(feeEstimatesFile, content.Bytes(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// LoadFeeEstimator reads the statistics a node saved last
+func LoadFeeEstimator(nodeID string) (*FeeEstimator, error) {
+	e := NewFeeEstimator()
+
+	feeEstimatesFile := fmt.Sprintf(feeEstimatesFile, nodeID)
+	if _, err := os.Stat(feeEstimatesFile); os.IsNotExist(err) {
+		return e, err
+	}
+	fileContent, err := ioutil.ReadFile(feeEstimatesFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	var saved FeeEstimator
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&saved)
+	if err != nil {
+		log.Panic(err)
+	}
+	// files from builds tracking other buckets or targets start over
+	if len(saved.Total) != feeBuckets || len(saved.Confirmed) != feeBuckets {
+		return e, nil
+	}
+	for _, confirmed := range saved.Confirmed {
+		if len(confirmed) != maxConfirmBlocks {
+			return e, nil
+		}
+	}
+	e.Confirmed = saved.Confirmed
+	e.Total = saved.Total
+	e.Height = saved.Height
+
+	return e, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeeEstimator(t *testing.T) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(dir)
+
+	estimator := NewFeeEstimator()
+	pool := NewTxPool(maxMempoolSize, mempoolExpiry)
+	address := string(NewWallet("").getAddress())
+	height := 0
+	// confirm tracks n transactions paying rate that wait blocks for a block
+	confirm := func(rate, blocks, n int) {
+		var txs []*Transaction
+		for i := 0; i < n; i++ {
+			tx := NewCoinbaseTransaction(address, "")
+			estimator.track(tx.ID, rate, 1000, height)
+			txs = append(txs, tx)
+		}
+		height += blocks
+		estimator.processBlock(&Block{Height: height, Transactions: txs}, pool)
+	}
+
+	_, ok := estimator.estimate(1)
+	assert.False(t, ok, "No estimate without data")
+
+	for i := 0; i < 10; i++ {
+		confirm(64, 1, 1)
+		confirm(4, 10, 1)
+	}
+	// one paying 1 never confirms
+	estimator.track(NewCoinbaseTransaction(address, "").ID, 1, 1000, height)
+	height += maxConfirmBlocks
+	estimator.processBlock(&Block{Height: height}, pool)
+
+	rate, ok := estimator.estimate(1)
+	assert.True(t, ok)
+	assert.Equal(t, 64, rate)
+	rate, _ = estimator.estimate(10)
+	assert.Equal(t, 4, rate)
+	rate, _ = estimator.estimate(maxConfirmBlocks)
+	assert.Equal(t, 4, rate, "The transactions that never confirmed keep the rate up")
+
+	estimator.saveToFile("0")
+	loaded, err := LoadFeeEstimator("0")
+	require.NoError(t, err)
+	rate, _ = loaded.estimate(10)
+	assert.Equal(t, 4, rate)
+	assert.Equal(t, height, loaded.Height)
+
+	assert.Equal(t, 3, feeForRate(10, 201), "Fees round up")
+}
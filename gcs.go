@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// A Golomb-coded set is a compact probabilistic set like a bloom filter,
+// built once from all its elements: they are hashed into the range
+// [0, N*M), sorted, and the differences between them Golomb-Rice coded
+// with P bits for the remainder. The parameters are those of BIP 158.
+const gcsP = 19
+const gcsM = 784931
+
+// gcsKey turns the first 16 bytes of a key into the SipHash key
+func gcsKey(key []byte) (uint64, uint64) {
+	return binary.LittleEndian.Uint64(key[0:8]), binary.LittleEndian.Uint64(key[8:16])
+}
+
+// gcsValues hashes the elements into the range of a set of n elements,
+// sorted
+func gcsValues(key []byte, n uint64, elements [][]byte) []uint64 {
+	k0, k1 := gcsKey(key)
+
+	var values []uint64
+	for _, element := range elements {
+		value, _ := bits.Mul64(sipHash(k0, k1, element), n*gcsM)
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i] < values[j]
+	})
+
+	return values
+}
+
+// buildGCS encodes the set of elements, keyed with at least 16 bytes.
+// Duplicates are left out.
+func buildGCS(key []byte, elements [][]byte) []byte {
+	seen := make(map[string]bool)
+	var unique [][]byte
+	for _, element := range elements {
+		if !seen[string(element)] {
+			seen[string(element)] = true
+			unique = append(unique, element)
+		}
+	}
+
+	var header [binary.MaxVarintLen64]byte
+	n := uint64(len(unique))
+	filter := append([]byte{}, header[:binary.PutUvarint(header[:], n)]...)
+
+	w := &bitWriter{}
+	var last uint64
+	for _, value := range gcsValues(key, n, unique) {
+		delta := value - last
+		last = value
+
+		for q := delta >> gcsP; q > 0; q-- {
+			w.writeBit(1)
+		}
+		w.writeBit(0)
+		w.writeBits(delta, gcsP)
+	}
+
+	return append(filter, w.bytes...)
+}
+
+// gcsMatchAny tells whether any of the elements may be in the set
+func gcsMatchAny(filter, key []byte, elements [][]byte) (bool, error) {
+	r := bytes.NewReader(filter)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return false, err
+	}
+	if n == 0 || len(elements) == 0 {
+		return false, nil
+	}
+	if n > uint64(len(filter))*8 {
+		return false, errors.New("filter has more elements than bits")
+	}
+
+	queries := gcsValues(key, n, elements)
+	br := &bitReader{data: filter[len(filter)-r.Len():]}
+
+	var value uint64
+	for i := uint64(0); i < n; i++ {
+		var q uint64
+		for {
+			bit, err := br.readBit()
+			if err != nil {
+				return false, err
+			}
+			if bit == 0 {
+				break
+			}
+			q++
+		}
+		remainder, err := br.readBits(gcsP)
+		if err != nil {
+			return false, err
+		}
+		value += q<<gcsP | remainder
+
+		for len(queries) > 0 && queries[0] < value {
+			queries = queries[1:]
+		}
+		if len(queries) == 0 {
+			return false, nil
+		}
+		if queries[0] == value {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// bitWriter appends bits most significant first
+type bitWriter struct {
+	bytes []byte
+	used  uint
+}
+
+func (w *bitWriter) writeBit(bit uint64) {
+	if w.used%8 == 0 {
+		w.bytes = append(w.bytes, 0)
+	}
+	if bit != 0 {
+		w.bytes[len(w.bytes)-1] |= 0x80 >> (w.used % 8)
+	}
+	w.used++
+}
+
+func (w *bitWriter) writeBits(value uint64, n uint) {
+	for i := n; i > 0; i-- {
+		w.writeBit(value >> (i - 1) & 1)
+	}
+}
+
+type bitReader struct {
+	data []byte
+	read uint
+}
+
+func (r *bitReader) readBit() (uint64, error) {
+	if r.read/8 >= uint(len(r.data)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	bit := r.data[r.read/8] >> (7 - r.read%8) & 1
+	r.read++
+
+	return uint64(bit), nil
+}
+
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	var value uint64
+	for i := uint(0); i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<1 | bit
+	}
+
+	return value, nil
+}
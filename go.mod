@@ -0,0 +1,16 @@
+module vBlockchain
+
+go 1.21
+
+require (
+	github.com/boltdb/bolt v1.3.1
+	github.com/stretchr/testify v1.8.4
+	golang.org/x/crypto v0.9.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
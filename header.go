@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"log"
+)
+
+// maxHeadersPerMessage caps the headers a single headers message carries,
+// a light client asks again when it gets that many
+const maxHeadersPerMessage = 2000
+
+// maxLocatorSize caps the hashes of a block locator, enough to reach back
+// through 2^90 blocks
+const maxLocatorSize = 101
+
+// BlockHeader is a block without its transactions, which it commits to
+// through the merkle root. It's all a light client keeps of a block.
+type BlockHeader struct {
+	Timestamp     int64
+	PrevBlockHash []byte
+	MerkleRoot    []byte
+	Hash          []byte
+	Nonce         int
+	Height        int
+}
+
+// header returns the header of a block
+func (block *Block) header() BlockHeader {
+	return BlockHeader{
+		Timestamp:     block.Timestamp,
+		PrevBlockHash: block.PrevBlockHash,
+		MerkleRoot:    block.hashTransactions(),
+		Hash:          block.Hash,
+		Nonce:         block.Nonce,
+		Height:        block.Height,
+	}
+}
+
+// validate checks that the hash of the header is its own and meets the
+// proof of work target
+func (header *BlockHeader) validate() error {
+	hash := sha256.Sum256(headerData(header.PrevBlockHash, header.MerkleRoot, header.Timestamp, activeNet.TargetBits, header.Nonce))
+	if !bytes.Equal(hash[:], header.Hash) {
+		return errors.New("header hash doesn't match its content")
+	}
+	if !meetsTarget(header.Hash) {
+		return errors.New("proof of work is not valid")
+	}
+
+	return nil
+}
+
+func (header *BlockHeader) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(header)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return result.Bytes()
+}
+
+func DeserializeHeader(data []byte) *BlockHeader {
+	var header BlockHeader
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&header)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return &header
+}
+
+// getHeaders returns up to max headers of our chain following the first
+// block of the locator we have, or from the genesis block when we have none
+func (bc *Blockchain) getHeaders(locator [][]byte, max int) []BlockHeader {
+	hashes := bc.getBlockHashes()
+	heights := make(map[string]int)
+	for i, hash := range hashes {
+		heights[string(hash)] = len(hashes) - 1 - i
+	}
+
+	start := 0
+	for _, hash := range locator {
+		if height, ok := heights[string(hash)]; ok {
+			start = height + 1
+			break
+		}
+	}
+
+	var headers []BlockHeader
+	for height := start; height < len(hashes) && len(headers) < max; height++ {
+		block, err := bc.getBlock(hashes[len(hashes)-1-height])
+		if err != nil {
+			log.Panic(err)
+		}
+		headers = append(headers, block.header())
+	}
+
+	return headers
+}
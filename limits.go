@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// maxConnections caps the connections handled at once, further ones are refused
+const maxConnections = 125
+
+// maxMessageSize caps a single message
+const maxMessageSize = 8 << 20
+
+// maxBufferedBytes caps the messages held in memory by all connections together
+const maxBufferedBytes = 64 << 20
+
+// readTimeout bounds how long a peer may take to send its message
+const readTimeout = time.Minute
+
+// messageRate is how many messages per second a peer may send on average,
+// with bursts of up to messageBurst
+const messageRate = 100
+const messageBurst = 500
+
+// maxInflightPerPeer caps the messages of one peer being handled at once
+const maxInflightPerPeer = 32
+
+var errMessageTooLarge = errors.New("message is too large")
+var errBufferFull = errors.New("too many bytes buffered")
+
+// bufferedBytes is the size of all messages held in memory
+var bufferedBytes int64
+
+// limitReached counts a triggered limit and logs it
+func (m *Metrics) limitReached(name, format string, args ...interface{}) {
+	m.inc(name)
+	fmt.Printf("Limit %s reached: %s\n", name, fmt.Sprintf(format, args...))
+}
+
+// readMessage reads a whole message, counting it against maxBufferedBytes
+// as it arrives. The caller gives the bytes back with releaseMessage.
+func readMessage(r io.Reader) ([]byte, error) {
+	var message []byte
+	chunk := make([]byte, 32*1024)
+
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			if len(message)+n > maxMessageSize {
+				releaseMessage(message)
+				return nil, errMessageTooLarge
+			}
+			if atomic.AddInt64(&bufferedBytes, int64(n)) > maxBufferedBytes {
+				atomic.AddInt64(&bufferedBytes, -int64(n))
+				releaseMessage(message)
+				return nil, errBufferFull
+			}
+			message = append(message, chunk[:n]...)
+		}
+		if err == io.EOF {
+			return message, nil
+		}
+		if err != nil {
+			releaseMessage(message)
+			return nil, err
+		}
+	}
+}
+
+// releaseMessage gives back the bytes of a message read with readMessage
+func releaseMessage(message []byte) {
+	atomic.AddInt64(&bufferedBytes, -int64(len(message)))
+}
+
+// allowMessage takes a token from the bucket of a peer ID, reporting
+// whether it stays within its message rate
+func (server *Server) allowMessage(id string) bool {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	state := server.getIdentity(id)
+	now := time.Now()
+	if state.lastRefill.IsZero() {
+		state.tokens = messageBurst
+	} else {
+		state.tokens += now.Sub(state.lastRefill).Seconds() * messageRate
+		if state.tokens > messageBurst {
+			state.tokens = messageBurst
+		}
+	}
+	state.lastRefill = now
+
+	if state.tokens < 1 {
+		return false
+	}
+	state.tokens--
+
+	return true
+}
+
+// startRequest counts a message of a peer ID being handled, reporting false
+// when it has too many already; finishRequest undoes it
+func (server *Server) startRequest(id string) bool {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	state := server.getIdentity(id)
+	if state.inflight >= maxInflightPerPeer {
+		return false
+	}
+	state.inflight++
+
+	return true
+}
+
+func (server *Server) finishRequest(id string) {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	if state, ok := server.identities[id]; ok && state.inflight > 0 {
+		state.inflight--
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadMessage(t *testing.T) {
+	message, err := readMessage(bytes.NewReader(make([]byte, 100000)))
+	assert.NoError(t, err)
+	assert.Len(t, message, 100000)
+	assert.Equal(t, int64(100000), bufferedBytes, "A message counts as buffered until released")
+
+	releaseMessage(message)
+	assert.Equal(t, int64(0), bufferedBytes)
+
+	_, err = readMessage(bytes.NewReader(make([]byte, maxMessageSize+1)))
+	assert.Equal(t, errMessageTooLarge, err)
+	assert.Equal(t, int64(0), bufferedBytes, "A refused message is released")
+}
+
+func TestAllowMessage(t *testing.T) {
+	server := &Server{peers: make(map[string]*Peer), identities: make(map[string]*identity)}
+	id := "127.0.0.1"
+
+	// tokens refill as the loop runs, a slow machine gets a few more
+	allowed := 0
+	for allowed < 2*messageBurst && server.allowMessage(id) {
+		allowed++
+	}
+	assert.True(t, allowed >= messageBurst, "A burst is allowed")
+	assert.True(t, allowed < 2*messageBurst, "Messages over the burst are refused")
+}
+
+func TestBanPeer(t *testing.T) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(dir)
+
+	server := &Server{peers: make(map[string]*Peer), identities: make(map[string]*identity), bans: NewBanList("0"), banTime: time.Hour, metrics: NewMetrics()}
+	server.addNode("localhost:3000")
+	server.addNode("localhost:3001")
+	conn := &memConn{remote: memAddr("127.0.0.1:50000")}
+	server.misbehaving(peerID(conn, "localhost:3000"), banThreshold, "test")
+
+	assert.True(t, server.isBanned(peerID(&memConn{remote: memAddr("127.0.0.1:50001")}, "127.0.0.1:3000")), "Bans go by the address a peer advertises however it's spelled")
+	assert.True(t, server.addressIsBanned("LOCALHOST:3000"))
+	assert.False(t, server.isBanned(peerID(conn, "localhost:3001")), "Peers sharing a host aren't banned together")
+	assert.False(t, server.nodeIsKnown("localhost:3000"), "The banned peer is dropped")
+	assert.True(t, server.nodeIsKnown("localhost:3001"))
+
+	// setban given a host bans every peer on it
+	server.bans.ban(normalizeAddress("10.0.0.5"), time.Hour)
+	assert.True(t, server.addressIsBanned("10.0.0.5:3000"))
+}
+
+func TestAllowMessagePerPeer(t *testing.T) {
+	server := &Server{peers: make(map[string]*Peer), identities: make(map[string]*identity)}
+	conn := &memConn{remote: memAddr("127.0.0.1:50000")}
+	for i := 0; i < 2*messageBurst && server.allowMessage(peerID(conn, "localhost:3000")); i++ {
+	}
+	require.False(t, server.allowMessage(peerID(conn, "localhost:3000")))
+
+	assert.True(t, server.allowMessage(peerID(conn, "localhost:3001")), "Peers sharing a host have buckets of their own")
+}
+
+func TestPeerEntriesCapped(t *testing.T) {
+	server := &Server{peers: make(map[string]*Peer), identities: make(map[string]*identity)}
+	for i := 0; i <= maxPeerEntries; i++ {
+		server.getPeer(fmt.Sprintf("node%d:3000", i))
+		server.allowMessage(fmt.Sprintf("10.0.%d.%d:3000", i/256, i%256))
+	}
+	assert.Len(t, server.peers, maxPeerEntries)
+	assert.Len(t, server.identities, maxPeerEntries)
+	assert.NotContains(t, server.peers, "node0:3000", "The least recently seen peer goes first")
+
+	server.peers["node1:3000"].lastSeen = time.Now().Add(-2 * peerEntryExpiry)
+	server.identities["10.0.0.1:3000"].lastSeen = time.Now().Add(-2 * peerEntryExpiry)
+	server.prunePeers()
+	assert.NotContains(t, server.peers, "node1:3000")
+	assert.NotContains(t, server.identities, "10.0.0.1:3000")
+}
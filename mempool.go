@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const mempoolFile = "mempool_%s.dat"
+
+// maxMempoolSize caps the encoded size of the transactions in the mempool,
+// the ones paying the lowest fee rate make room for better paying ones
+const maxMempoolSize = 5 << 20
+
+// mempoolExpiry is how long a transaction may wait in the mempool for a block
+const mempoolExpiry = 14 * 24 * time.Hour
+
+// maxAncestors and maxDescendants cap the chains of unconfirmed transactions
+// a transaction is part of, counting itself
+const maxAncestors = 25
+const maxDescendants = 25
+
+// maxReplacementEvictions caps the transactions a replacement evicts,
+// counting the descendants of the ones it conflicts with
+const maxReplacementEvictions = 100
+
+// minRelayFeeRate is the fee per 1000 bytes paying for relaying a
+// transaction. A replacement pays it on top of the fees of the transactions
+// it evicts, or replacing one again and again would relay it for free.
+const minRelayFeeRate = 10
+
+var errTxInPool = errors.New("transaction is already in the mempool")
+var errTxConflict = errors.New("transaction spends an output another one in the mempool spends, which isn't replaceable")
+var errMempoolFull = errors.New("mempool is full of transactions paying a higher fee rate")
+
+// missingParentsError rejects an orphan, a transaction spending outputs of
+// transactions that are neither in the chain nor in the pool
+type missingParentsError struct {
+	parents [][]byte
+}
+
+func (err *missingParentsError) Error() string {
+	return fmt.Sprintf("transaction spends the outputs of %d unknown transactions", len(err.parents))
+}
+
+// savedTx is a transaction of the mempool file. Added is kept so the
+// transaction expires when it would have without the restart.
+type savedTx struct {
+	Tx    Transaction
+	Added time.Time
+}
+
+// poolEntry is a transaction in the mempool with what it's ranked by
+type poolEntry struct {
+	tx    Transaction
+	fee   int
+	size  int
+	added time.Time
+	// seq orders the entries as they came in, parents before their children
+	seq int
+	// parents and children are the transactions of the pool it spends the
+	// outputs of and the ones spending its outputs, by hex ID
+	parents  map[string]bool
+	children map[string]bool
+}
+
+// lowerFeeRate tells whether fee for size pays less per byte than otherFee
+// for otherSize
+func lowerFeeRate(fee, size, otherFee, otherSize int) bool {
+	return fee*otherSize < otherFee*size
+}
+
+// TxPool holds the valid transactions waiting for a block. It indexes the
+// outputs they spend, so no two of them spend the same output. Its
+// transactions may spend the outputs of one another, the pool is a view
+// of the outputs on top of the UTXO set.
+type TxPool struct {
+	entries map[string]*poolEntry
+	// spent maps the outpoints spent by the pool to the transaction spending them
+	spent   map[string]string
+	size    int
+	maxSize int
+	expiry  time.Duration
+	seq     int
+	mu      sync.Mutex
+}
+
+// NewTxPool creates an empty pool of up to maxSize bytes of transactions,
+// each kept for at most expiry
+func NewTxPool(maxSize int, expiry time.Duration) *TxPool {
+	return &TxPool{
+		entries: make(map[string]*poolEntry),
+		spent:   make(map[string]string),
+		maxSize: maxSize,
+		expiry:  expiry,
+	}
+}
+
+// add validates a transaction against the chain and the pool and adds it,
+// evicting the transactions paying the lowest fee rate when the pool is full
+func (pool *TxPool) add(tx *Transaction, bc *Blockchain) error {
+	return pool.addAt(tx, bc, time.Now())
+}
+
+// addAt adds a transaction that came in at added
+func (pool *TxPool) addAt(tx *Transaction, bc *Blockchain, added time.Time) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.expire()
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := pool.entries[txID]; ok {
+		return errTxInPool
+	}
+	// the pool stays locked while the chain is read, a block connected
+	// meanwhile removes the transaction only after it's in
+	fee, parents, conflicts, err := pool.validate(tx, bc)
+	if err != nil {
+		return err
+	}
+	size := len(tx.encode())
+	if len(conflicts) > 0 {
+		err = pool.checkReplacement(fee, size, parents, conflicts)
+		if err != nil {
+			return err
+		}
+		for conflict := range conflicts {
+			fmt.Printf("Replacing transaction %s with %s\n", conflict, txID)
+			pool.removeWithDescendants(conflict)
+		}
+	}
+
+	pool.seq++
+	entry := &poolEntry{*tx, fee, size, added, pool.seq, parents, make(map[string]bool)}
+	pool.insert(entry)
+	pool.trim()
+	if _, ok := pool.entries[txID]; !ok {
+		return errMempoolFull
+	}
+
+	return nil
+}
+
+// validate checks a transaction could go in the next block, after the
+// transactions of the pool it spends from. It returns its fee, those
+// transactions and the ones of the pool spending the same outputs.
+func (pool *TxPool) validate(tx *Transaction, bc *Blockchain) (int, map[string]bool, map[string]bool, error) {
+	if tx.isCoinbase() {
+		return 0, nil, nil, errors.New("a coinbase can only come in a block")
+	}
+	if len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+		return 0, nil, nil, errors.New("transaction has no inputs or no outputs")
+	}
+
+	spends := make(map[string]bool)
+	parents := make(map[string]bool)
+	conflicts := make(map[string]bool)
+	missing := make(map[string]bool)
+	var missingParents [][]byte
+	prevTXs := make(map[string]Transaction)
+	in := 0
+	for _, vin := range tx.Vin {
+		key := string(outpoint(vin.Txid, vin.Vout))
+		if spends[key] {
+			return 0, nil, nil, fmt.Errorf("transaction spends %x:%d twice", vin.Txid, vin.Vout)
+		}
+		spends[key] = true
+		if conflict, ok := pool.spent[key]; ok {
+			conflicts[conflict] = true
+		}
+
+		prevID := hex.EncodeToString(vin.Txid)
+		var prevTx Transaction
+		if parent, ok := pool.entries[prevID]; ok {
+			if vin.Vout < 0 || vin.Vout >= len(parent.tx.Vout) {
+				return 0, nil, nil, fmt.Errorf("transaction %x has no output %d", vin.Txid, vin.Vout)
+			}
+			prevTx = parent.tx
+			parents[prevID] = true
+		} else {
+			var err error
+			prevTx, err = bc.findUnspentOutput(vin.Txid, vin.Vout)
+			if err == errTxNotFound {
+				if !missing[prevID] {
+					missing[prevID] = true
+					missingParents = append(missingParents, vin.Txid)
+				}
+				continue
+			}
+			if err != nil {
+				return 0, nil, nil, err
+			}
+		}
+		prevTXs[prevID] = prevTx
+
+		out := prevTx.Vout[vin.Vout]
+		// the scripts of the other outputs are run with the signatures
+		if len(out.Script) == 0 && !vin.canUnlockedWith(out.PubKeyHash) {
+			return 0, nil, nil, fmt.Errorf("input %x:%d has the wrong public key", vin.Txid, vin.Vout)
+		}
+		in += out.Value
+	}
+	if len(missingParents) > 0 {
+		return 0, nil, nil, &missingParentsError{missingParents}
+	}
+
+	out := 0
+	for _, vout := range tx.Vout {
+		if vout.Value <= 0 {
+			return 0, nil, nil, errors.New("transaction has an output without value")
+		}
+		out += vout.Value
+	}
+	if out > in {
+		return 0, nil, nil, fmt.Errorf("transaction spends %d but has only %d", out, in)
+	}
+
+	err := pool.checkLimits(parents)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	// the pool holds what could go in the next block
+	pending := make(map[string]Transaction)
+	for parent := range parents {
+		pending[parent] = pool.entries[parent].tx
+	}
+	err = bc.checkLocks(tx, bc.getBestHeight()+1, time.Now().Unix(), pending)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	if !tx.verify(prevTXs) {
+		return 0, nil, nil, errors.New("transaction signature is not valid")
+	}
+
+	return in - out, parents, conflicts, nil
+}
+
+// checkReplacement checks a transaction may replace the ones it conflicts
+// with: they all have to be replaceable, and it has to pay a higher fee rate
+// than each of them and a higher fee than them and their descendants together
+func (pool *TxPool) checkReplacement(fee, size int, parents, conflicts map[string]bool) error {
+	evicted := make(map[string]bool)
+	for txID := range conflicts {
+		entry := pool.entries[txID]
+		if !entry.tx.Replaceable {
+			return errTxConflict
+		}
+		if !lowerFeeRate(entry.fee, entry.size, fee, size) {
+			return fmt.Errorf("replacement doesn't pay a higher fee rate than transaction %s", txID)
+		}
+		evicted[txID] = true
+		for descendant := range pool.descendants(txID) {
+			evicted[descendant] = true
+		}
+	}
+	if len(evicted) > maxReplacementEvictions {
+		return fmt.Errorf("replacement would evict %d transactions, the limit is %d", len(evicted), maxReplacementEvictions)
+	}
+
+	evictedFee := 0
+	for txID := range evicted {
+		if parents[txID] {
+			return fmt.Errorf("replacement spends transaction %s it replaces", txID)
+		}
+		evictedFee += pool.entries[txID].fee
+	}
+	if needed := evictedFee + feeForRate(minRelayFeeRate, size); fee < needed {
+		return fmt.Errorf("replacement pays a fee of %d, replacing transactions paying %d takes %d", fee, evictedFee, needed)
+	}
+
+	return nil
+}
+
+// checkLimits checks a transaction spending from parents doesn't make a
+// chain of unconfirmed transactions longer than the limits
+func (pool *TxPool) checkLimits(parents map[string]bool) error {
+	ancestors := pool.ancestors(parents)
+	if len(ancestors)+1 > maxAncestors {
+		return fmt.Errorf("transaction has %d unconfirmed ancestors, the limit is %d", len(ancestors), maxAncestors-1)
+	}
+	for txID := range ancestors {
+		if len(pool.descendants(txID))+2 > maxDescendants {
+			return fmt.Errorf("transaction %s already has %d unconfirmed descendants", txID, maxDescendants-1)
+		}
+	}
+
+	return nil
+}
+
+// ancestors returns the transactions of the pool the given ones descend
+// from, them included
+func (pool *TxPool) ancestors(txIDs map[string]bool) map[string]bool {
+	ancestors := make(map[string]bool)
+	var visit func(txID string)
+	visit = func(txID string) {
+		if ancestors[txID] {
+			return
+		}
+		ancestors[txID] = true
+		for parent := range pool.entries[txID].parents {
+			visit(parent)
+		}
+	}
+	for txID := range txIDs {
+		visit(txID)
+	}
+
+	return ancestors
+}
+
+// descendants returns the transactions of the pool spending the outputs of
+// a transaction, directly or not
+func (pool *TxPool) descendants(txID string) map[string]bool {
+	descendants := make(map[string]bool)
+	var visit func(txID string)
+	visit = func(txID string) {
+		for child := range pool.entries[txID].children {
+			if !descendants[child] {
+				descendants[child] = true
+				visit(child)
+			}
+		}
+	}
+	visit(txID)
+
+	return descendants
+}
+
+func (pool *TxPool) insert(entry *poolEntry) {
+	txID := hex.EncodeToString(entry.tx.ID)
+	pool.entries[txID] = entry
+	for _, vin := range entry.tx.Vin {
+		pool.spent[string(outpoint(vin.Txid, vin.Vout))] = txID
+	}
+	for parent := range entry.parents {
+		pool.entries[parent].children[txID] = true
+	}
+	pool.size += entry.size
+}
+
+// remove drops a transaction, its children stay and spend its outputs
+// from the chain once it's mined
+func (pool *TxPool) remove(txID string) {
+	entry, ok := pool.entries[txID]
+	if !ok {
+		return
+	}
+	delete(pool.entries, txID)
+	for _, vin := range entry.tx.Vin {
+		delete(pool.spent, string(outpoint(vin.Txid, vin.Vout)))
+	}
+	for parent := range entry.parents {
+		delete(pool.entries[parent].children, txID)
+	}
+	for child := range entry.children {
+		delete(pool.entries[child].parents, txID)
+	}
+	pool.size -= entry.size
+}
+
+// removeWithDescendants drops a transaction that won't be mined, and the
+// ones spending its outputs which can't be either
+func (pool *TxPool) removeWithDescendants(txID string) {
+	if _, ok := pool.entries[txID]; !ok {
+		return
+	}
+	for descendant := range pool.descendants(txID) {
+		pool.remove(descendant)
+	}
+	pool.remove(txID)
+}
+
+// evictionRate returns the fee and size a transaction is ranked by when the
+// pool is full: its own or with its descendants, whichever pays more per
+// byte, so a child paying for its parent keeps it in
+func (pool *TxPool) evictionRate(txID string) (int, int) {
+	entry := pool.entries[txID]
+	fee, size := entry.fee, entry.size
+	for descendant := range pool.descendants(txID) {
+		fee += pool.entries[descendant].fee
+		size += pool.entries[descendant].size
+	}
+	if lowerFeeRate(fee, size, entry.fee, entry.size) {
+		return entry.fee, entry.size
+	}
+
+	return fee, size
+}
+
+// trim evicts the transactions ranking lowest by fee rate, the oldest first
+// among equals, until the pool fits in its size
+func (pool *TxPool) trim() {
+	if pool.size <= pool.maxSize {
+		return
+	}
+
+	type ranked struct {
+		entry     *poolEntry
+		fee, size int
+	}
+	var entries []ranked
+	for txID, entry := range pool.entries {
+		fee, size := pool.evictionRate(txID)
+		entries = append(entries, ranked{entry, fee, size})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if lowerFeeRate(a.fee, a.size, b.fee, b.size) || lowerFeeRate(b.fee, b.size, a.fee, a.size) {
+			return lowerFeeRate(a.fee, a.size, b.fee, b.size)
+		}
+		return a.entry.seq < b.entry.seq
+	})
+	for _, r := range entries {
+		if pool.size <= pool.maxSize {
+			break
+		}
+		txID := hex.EncodeToString(r.entry.tx.ID)
+		if _, ok := pool.entries[txID]; ok {
+			fmt.Printf("Evicting transaction %s from the full mempool\n", txID)
+			pool.removeWithDescendants(txID)
+		}
+	}
+}
+
+// expire drops the transactions that waited longer than the expiry
+func (pool *TxPool) expire() {
+	now := time.Now()
+	for txID, entry := range pool.entries {
+		if now.Sub(entry.added) > pool.expiry {
+			fmt.Printf("Transaction %s expired from the mempool\n", txID)
+			pool.removeWithDescendants(txID)
+		}
+	}
+}
+
+// removeForBlock drops the transactions of a connected block, and the ones
+// spending an output one of them spends, which can't be mined anymore along
+// with their descendants
+func (pool *TxPool) removeForBlock(block *Block) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, tx := range block.Transactions {
+		pool.remove(hex.EncodeToString(tx.ID))
+		if tx.isCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			if txID, ok := pool.spent[string(outpoint(vin.Txid, vin.Vout))]; ok {
+				fmt.Printf("Dropping transaction %s, block %x spends its input\n", txID, block.Hash)
+				pool.removeWithDescendants(txID)
+			}
+		}
+	}
+}
+
+// get returns a transaction of the pool
+func (pool *TxPool) get(txID []byte) (Transaction, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	entry, ok := pool.entries[hex.EncodeToString(txID)]
+	if !ok {
+		return Transaction{}, false
+	}
+
+	return entry.tx, true
+}
+
+// fee returns the fee a transaction of the pool pays
+func (pool *TxPool) fee(txID []byte) (int, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	entry, ok := pool.entries[hex.EncodeToString(txID)]
+	if !ok {
+		return 0, false
+	}
+
+	return entry.fee, true
+}
+
+// has tells whether a transaction is in the pool
+func (pool *TxPool) has(txID []byte) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	_, ok := pool.entries[hex.EncodeToString(txID)]
+	return ok
+}
+
+// count returns the number of transactions in the pool
+func (pool *TxPool) count() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return len(pool.entries)
+}
+
+// spends tells whether a transaction of the pool spends an output
+func (pool *TxPool) spends(txID []byte, vout int) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	_, ok := pool.spent[string(outpoint(txID, vout))]
+	return ok
+}
+
+// transactions returns a snapshot of the pool, parents before their children
+func (pool *TxPool) transactions() []Transaction {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var txs []Transaction
+	for _, entry := range pool.sortedEntries() {
+		txs = append(txs, entry.tx)
+	}
+
+	return txs
+}
+
+// sortedEntries returns the entries in the order they came in
+func (pool *TxPool) sortedEntries() []*poolEntry {
+	var entries []*poolEntry
+	for _, entry := range pool.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+
+	return entries
+}
+
+// pending returns the transactions of the pool by hex ID, to find the
+// unconfirmed transactions others spend from
+func (pool *TxPool) pending() map[string]Transaction {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	txs := make(map[string]Transaction)
+	for txID, entry := range pool.entries {
+		txs[txID] = entry.tx
+	}
+
+	return txs
+}
+
+// saveToFile writes the transactions of the pool to the mempool file of the
+// node, parents before their children
+func (pool *TxPool) saveToFile(nodeID string) {
+	pool.mu.Lock()
+	entries := pool.sortedEntries()
+	pool.mu.Unlock()
+
+	var saved []savedTx
+	for _, entry := range entries {
+		saved = append(saved, savedTx{entry.tx, entry.added})
+	}
+
+	var content bytes.Buffer
+	mempoolFile := fmt.Sprintf(mempoolFile, nodeID)
+
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(saved)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// a node killed while writing would otherwise leave half a file
+	err = ioutil.WriteFile(mempoolFile+".tmp", content.Bytes(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = os.Rename(mempoolFile+".tmp", mempoolFile)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// loadFromFile adds the transactions of the mempool file of the node again,
+// validating them against the chain as it is now. It returns how many were
+// saved and how many of them are still valid.
+func (pool *TxPool) loadFromFile(nodeID string, bc *Blockchain) (int, int, error) {
+	mempoolFile := fmt.Sprintf(mempoolFile, nodeID)
+	if _, err := os.Stat(mempoolFile); os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	fileContent, err := ioutil.ReadFile(mempoolFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	var saved []savedTx
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&saved)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	loaded := 0
+	for i := range saved {
+		if time.Since(saved[i].Added) > pool.expiry {
+			continue
+		}
+		if pool.addAt(&saved[i].Tx, bc, saved[i].Added) == nil {
+			loaded++
+		}
+	}
+
+	return len(saved), loaded, nil
+}
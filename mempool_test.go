@@ -0,0 +1,201 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPoolTestChain creates a regtest chain with blocks paying a wallet, and
+// returns the coinbases of those blocks and a way to spend from the wallet
+func newPoolTestChain(t *testing.T, blocks int) (*Blockchain, []*Transaction, func(prev *Transaction, options TxOptions, pool *TxPool) *Transaction) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() { os.Chdir(dir) })
+	activeNet = &regTestParams
+	t.Cleanup(func() { activeNet = &mainNetParams })
+
+	wallet := NewWallet("")
+	address := string(wallet.getAddress())
+	bc := CreateBlockchain(address, "0")
+	t.Cleanup(func() { bc.db.Close() })
+	utxoSet := UTXOSet{bc}
+	utxoSet.reindex()
+	var funding []*Transaction
+	for i := 0; i < blocks; i++ {
+		block := mineBlock(bc, NewCoinbaseTransaction(address, ""))
+		funding = append(funding, block.Transactions[0])
+	}
+
+	// spend pays the first output of a transaction of the chain, or of the
+	// pool when given, back to the wallet less the fee
+	spend := func(prev *Transaction, options TxOptions, pool *TxPool) *Transaction {
+		value := prev.Vout[0].Value - options.Fee
+		tx := Transaction{nil, []TXInput{{prev.ID, 0, nil, wallet.PublicKey, nil, 0}}, []TXOutput{*NewTXOutput(value, address)}, options.Replaceable, 0}
+		tx.ID = tx.hash()
+		var pending map[string]Transaction
+		if pool != nil {
+			pending = pool.pending()
+		}
+		bc.signTransaction(&tx, wallet.PrivateKey, pending)
+		return &tx
+	}
+
+	return bc, funding, spend
+}
+
+// mineBlock mines a block and updates the UTXO set, like a node does
+func mineBlock(bc *Blockchain, txs ...*Transaction) *Block {
+	block := bc.MineBlock(txs)
+	utxoSet := UTXOSet{bc}
+	utxoSet.update(block)
+
+	return block
+}
+
+func TestTxPool(t *testing.T) {
+	bc, funding, spend := newPoolTestChain(t, 4)
+	address := string(NewWallet("").getAddress())
+
+	pool := NewTxPool(maxMempoolSize, mempoolExpiry)
+	tx := spend(funding[0], TxOptions{}, nil)
+	require.NoError(t, pool.add(tx, bc))
+	assert.Equal(t, errTxInPool, pool.add(tx, bc))
+	assert.Equal(t, errTxConflict, pool.add(spend(funding[0], TxOptions{Fee: 1}, nil), bc))
+	assert.Error(t, pool.add(spend(funding[1], TxOptions{Fee: -1}, nil), bc), "Outputs can't exceed the inputs")
+	stolen := spend(funding[1], TxOptions{}, nil)
+	stolen.Vin[0].PubKey = NewWallet("").PublicKey
+	assert.Error(t, pool.add(stolen, bc), "Only the owner spends an output")
+	assert.Error(t, pool.add(NewCoinbaseTransaction(address, ""), bc))
+
+	// a block spending the output the pool spends drops the transaction
+	block := mineBlock(bc, spend(funding[0], TxOptions{Fee: 5}, nil), NewCoinbaseTransaction(address, ""))
+	pool.removeForBlock(block)
+	assert.Equal(t, 0, pool.count())
+	err := pool.add(tx, bc)
+	assert.Error(t, err, "The output is spent in the chain")
+	_, orphan := err.(*missingParentsError)
+	assert.False(t, orphan, "A spent output isn't taken for a missing parent")
+
+	// a pool with room for one transaction keeps the one paying the most
+	cheap := spend(funding[1], TxOptions{Fee: 1}, nil)
+	pool = NewTxPool(len(cheap.encode()), mempoolExpiry)
+	require.NoError(t, pool.add(cheap, bc))
+	rich := spend(funding[2], TxOptions{Fee: 10}, nil)
+	require.NoError(t, pool.add(rich, bc))
+	assert.False(t, pool.has(cheap.ID), "The lower fee rate is evicted")
+	assert.Equal(t, errMempoolFull, pool.add(spend(funding[3], TxOptions{Fee: 2}, nil), bc))
+	assert.Equal(t, 1, pool.count())
+
+	pool = NewTxPool(maxMempoolSize, time.Millisecond)
+	require.NoError(t, pool.add(cheap, bc))
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, pool.add(rich, bc))
+	assert.False(t, pool.has(cheap.ID), "Stale transactions expire")
+	assert.Equal(t, 1, pool.count())
+}
+
+func TestTxPoolChains(t *testing.T) {
+	bc, funding, spend := newPoolTestChain(t, 3)
+	address := string(NewWallet("").getAddress())
+	pool := NewTxPool(maxMempoolSize, mempoolExpiry)
+
+	parent := spend(funding[0], TxOptions{Fee: 1}, nil)
+	require.NoError(t, pool.add(parent, bc))
+	child := spend(parent, TxOptions{Fee: 2}, pool)
+	require.NoError(t, pool.add(child, bc), "Transactions spend unconfirmed outputs")
+	txs := pool.transactions()
+	require.Len(t, txs, 2)
+	assert.Equal(t, parent.ID, txs[0].ID, "Parents come before their children")
+
+	// the child stays once the parent is mined, and goes in the next block
+	block := mineBlock(bc, parent, NewCoinbaseTransaction(address, ""))
+	pool.removeForBlock(block)
+	assert.True(t, pool.has(child.ID))
+	pool.removeForBlock(mineBlock(bc, child, NewCoinbaseTransaction(address, "")))
+	assert.Equal(t, 0, pool.count())
+
+	// a block spending the output of a parent drops the whole chain
+	parent = spend(funding[1], TxOptions{Fee: 1}, nil)
+	require.NoError(t, pool.add(parent, bc))
+	require.NoError(t, pool.add(spend(parent, TxOptions{Fee: 2}, pool), bc))
+	conflict := spend(funding[1], TxOptions{Fee: 3}, nil)
+	block = mineBlock(bc, conflict, NewCoinbaseTransaction(address, ""))
+	pool.removeForBlock(block)
+	assert.Equal(t, 0, pool.count())
+
+	prev := funding[2]
+	for i := 0; i < maxAncestors; i++ {
+		tx := spend(prev, TxOptions{Fee: 1}, pool)
+		require.NoError(t, pool.add(tx, bc))
+		prev = tx
+	}
+	assert.Error(t, pool.add(spend(prev, TxOptions{Fee: 1}, pool), bc), "Chains of unconfirmed transactions are limited")
+	assert.Equal(t, maxAncestors, pool.count())
+}
+
+func TestTxPoolReplacement(t *testing.T) {
+	bc, funding, spend := newPoolTestChain(t, 2)
+	pool := NewTxPool(maxMempoolSize, mempoolExpiry)
+
+	original := spend(funding[0], TxOptions{Fee: 2, Replaceable: true}, nil)
+	require.NoError(t, pool.add(original, bc))
+	assert.Error(t, pool.add(spend(funding[0], TxOptions{Fee: 1}, nil), bc), "A replacement pays more")
+	// the transactions are the same size
+	increment := feeForRate(minRelayFeeRate, len(original.encode()))
+	require.True(t, increment > 1)
+	assert.Error(t, pool.add(spend(funding[0], TxOptions{Fee: 2 + increment - 1}, nil), bc), "A replacement pays for relaying itself")
+	bumped := spend(funding[0], TxOptions{Fee: 2 + increment}, nil)
+	require.NoError(t, pool.add(bumped, bc))
+	assert.False(t, pool.has(original.ID))
+	assert.True(t, pool.has(bumped.ID))
+	assert.Equal(t, errTxConflict, pool.add(spend(funding[0], TxOptions{Fee: 4 * increment}, nil), bc), "Only replaceable transactions are replaced")
+
+	// the replacement pays for the children it evicts too
+	parent := spend(funding[1], TxOptions{Fee: 1, Replaceable: true}, nil)
+	require.NoError(t, pool.add(parent, bc))
+	child := spend(parent, TxOptions{Fee: 10}, pool)
+	require.NoError(t, pool.add(child, bc))
+	assert.Error(t, pool.add(spend(funding[1], TxOptions{Fee: 5}, nil), bc))
+	assert.True(t, pool.has(child.ID))
+	assert.Error(t, pool.add(spend(funding[1], TxOptions{Fee: 11 + increment - 1}, nil), bc))
+	require.NoError(t, pool.add(spend(funding[1], TxOptions{Fee: 11 + increment}, nil), bc))
+	assert.False(t, pool.has(parent.ID))
+	assert.False(t, pool.has(child.ID))
+	assert.Equal(t, 2, pool.count())
+}
+
+func TestTxPoolPersistence(t *testing.T) {
+	bc, funding, spend := newPoolTestChain(t, 3)
+	address := string(NewWallet("").getAddress())
+	pool := NewTxPool(maxMempoolSize, mempoolExpiry)
+
+	parent := spend(funding[0], TxOptions{Fee: 1}, nil)
+	require.NoError(t, pool.add(parent, bc))
+	child := spend(parent, TxOptions{Fee: 1}, pool)
+	require.NoError(t, pool.add(child, bc))
+	conflicted := spend(funding[1], TxOptions{Fee: 1}, nil)
+	require.NoError(t, pool.add(conflicted, bc))
+	stale := spend(funding[2], TxOptions{Fee: 1}, nil)
+	require.NoError(t, pool.addAt(stale, bc, time.Now().Add(-mempoolExpiry-time.Hour)))
+	pool.saveToFile("0")
+
+	// the node was down while the parent and a conflict were mined
+	mineBlock(bc, parent, spend(funding[1], TxOptions{Fee: 2}, nil), NewCoinbaseTransaction(address, ""))
+
+	loadedPool := NewTxPool(maxMempoolSize, mempoolExpiry)
+	saved, loaded, err := loadedPool.loadFromFile("0", bc)
+	require.NoError(t, err)
+	assert.Equal(t, 4, saved)
+	assert.Equal(t, 1, loaded)
+	assert.True(t, loadedPool.has(child.ID), "The child spends the mined parent now")
+	assert.False(t, loadedPool.has(conflicted.ID))
+	assert.False(t, loadedPool.has(stale.ID), "Expired transactions aren't loaded")
+
+	_, _, err = NewTxPool(maxMempoolSize, mempoolExpiry).loadFromFile("1", bc)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// MerkleBlock is a block filtered for a light client: its header, the
+// transactions matching the client's filter and the proof that they are in
+// the block. The transactions travel along rather than in tx messages of
+// their own, since every message takes a connection.
+type MerkleBlock struct {
+	Timestamp     int64
+	PrevBlockHash []byte
+	Hash          []byte
+	Nonce         int
+	Height        int
+	Proof         MerkleProof
+	Transactions  [][]byte
+}
+
+// NewMerkleBlock filters a block, the filter learns the outputs of matched
+// transactions when its flags say so
+func NewMerkleBlock(block *Block, filter *BloomFilter) *MerkleBlock {
+	mb := &MerkleBlock{
+		Timestamp:     block.Timestamp,
+		PrevBlockHash: block.PrevBlockHash,
+		Hash:          block.Hash,
+		Nonce:         block.Nonce,
+		Height:        block.Height,
+	}
+
+	var leaves [][]byte
+	var matches []bool
+	for _, tx := range block.Transactions {
+		matched := filter.matchTransaction(tx)
+		if matched {
+			mb.Transactions = append(mb.Transactions, tx.serialize())
+		}
+		leaves = append(leaves, tx.encode())
+		matches = append(matches, matched)
+	}
+	mb.Proof = *NewMerkleProof(leaves, matches)
+
+	return mb
+}
+
+// Validate checks the proof of work of the header and that the
+// transactions are the ones the proof leads to, returning them
+func (mb *MerkleBlock) validate() ([]*Transaction, error) {
+	root, matches, _, err := mb.Proof.extract()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(headerData(mb.PrevBlockHash, root, mb.Timestamp, activeNet.TargetBits, mb.Nonce))
+	if !bytes.Equal(hash[:], mb.Hash) {
+		return nil, errors.New("block hash doesn't match the proof")
+	}
+	if !meetsTarget(mb.Hash) {
+		return nil, errors.New("proof of work is not valid")
+	}
+
+	if len(mb.Transactions) != len(matches) {
+		return nil, fmt.Errorf("%d transactions for %d matches", len(mb.Transactions), len(matches))
+	}
+	var txs []*Transaction
+	for i, data := range mb.Transactions {
+		tx, err := decodeTransaction(data)
+		if err != nil {
+			return nil, err
+		}
+		leaf := sha256.Sum256(tx.encode())
+		if !bytes.Equal(leaf[:], matches[i]) {
+			return nil, fmt.Errorf("transaction %x isn't in the proof", tx.ID)
+		}
+		txs = append(txs, &tx)
+	}
+
+	return txs, nil
+}
+
+func (mb *MerkleBlock) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(mb)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return result.Bytes()
+}
+
+// decodeMerkleBlock deserializes a merkle block received from the network
+func decodeMerkleBlock(data []byte) (*MerkleBlock, error) {
+	var mb MerkleBlock
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&mb)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mb, nil
+}
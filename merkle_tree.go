@@ -1,6 +1,10 @@
 package main
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
 
 // MerkleTree represent a Merkle tree
 type MerkleTree struct {
@@ -13,7 +17,11 @@ type MerkleNode struct {
 	Data  []byte
 }
 
-// NewMerkleTree creates a new Merkle tree from a sequence of data
+// NewMerkleTree creates a new Merkle tree from a sequence of data. The last
+// node of every level with an odd number of nodes is paired with itself.
+// Blocks of up to four transactions get the same root as when the tree was
+// built in len(data)/2 rounds; blocks of five or more made that panic, so
+// their root is only defined since.
 func NewMerkleTree(data [][]byte) *MerkleTree {
 	var nodes []MerkleNode
 
@@ -26,7 +34,10 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 		nodes = append(nodes, *node)
 	}
 
-	for i := 0; i < len(data)/2; i++ {
+	for len(nodes) > 1 {
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
 		var newLevel []MerkleNode
 		for j := 0; j < len(nodes); j += 2 {
 			node := NewMerkleNode(&nodes[j],&nodes[j+1],nil)
@@ -58,4 +69,156 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	mNode.Right = right
 
 	return &mNode
-}
\ No newline at end of file
+}
+
+// MerkleProof shows that some leaves are in a Merkle tree without the
+// others. Walking the tree depth first, Flags tells for every node visited
+// whether a matched leaf is below it, and Hashes holds the nodes that
+// aren't descended into along with the matched leaves.
+type MerkleProof struct {
+	Total  int
+	Hashes [][]byte
+	Flags  []bool
+}
+
+// NewMerkleProof proves the leaves of data for which matches is true
+func NewMerkleProof(data [][]byte, matches []bool) *MerkleProof {
+	var leaves [][]byte
+	for _, d := range data {
+		hash := sha256.Sum256(d)
+		leaves = append(leaves, hash[:])
+	}
+
+	proof := &MerkleProof{Total: len(leaves)}
+	proof.build(proof.height(), 0, leaves, matches)
+
+	return proof
+}
+
+// width is the number of nodes at a height of the tree, leaves are at 0
+func (proof *MerkleProof) width(height int) int {
+	return (proof.Total + 1<<uint(height) - 1) >> uint(height)
+}
+
+// height of the root, a lone leaf is still hashed with itself like in
+// NewMerkleTree
+func (proof *MerkleProof) height() int {
+	height := 1
+	for proof.width(height) > 1 {
+		height++
+	}
+
+	return height
+}
+
+func (proof *MerkleProof) hash(height, pos int, leaves [][]byte) []byte {
+	if height == 0 {
+		return leaves[pos]
+	}
+
+	left := proof.hash(height-1, pos*2, leaves)
+	right := left
+	if pos*2+1 < proof.width(height-1) {
+		right = proof.hash(height-1, pos*2+1, leaves)
+	}
+
+	return hashPair(left, right)
+}
+
+func (proof *MerkleProof) build(height, pos int, leaves [][]byte, matches []bool) {
+	matched := false
+	for i := pos << uint(height); i < (pos+1)<<uint(height) && i < proof.Total; i++ {
+		matched = matched || matches[i]
+	}
+	proof.Flags = append(proof.Flags, matched)
+
+	if height == 0 || !matched {
+		proof.Hashes = append(proof.Hashes, proof.hash(height, pos, leaves))
+		return
+	}
+
+	proof.build(height-1, pos*2, leaves, matches)
+	if pos*2+1 < proof.width(height-1) {
+		proof.build(height-1, pos*2+1, leaves, matches)
+	}
+}
+
+// Extract walks the proof, returning the root it leads to and the hashes
+// and positions of the matched leaves
+func (proof *MerkleProof) extract() ([]byte, [][]byte, []int, error) {
+	if proof.Total == 0 {
+		return nil, nil, nil, errors.New("proof of an empty tree")
+	}
+	if len(proof.Hashes) > proof.Total {
+		return nil, nil, nil, errors.New("proof has more hashes than leaves")
+	}
+
+	walk := merkleWalk{proof: proof}
+	root, err := walk.extract(proof.height(), 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if walk.flagsUsed != len(proof.Flags) || walk.hashesUsed != len(proof.Hashes) {
+		return nil, nil, nil, errors.New("proof has unused flags or hashes")
+	}
+
+	return root, walk.matches, walk.positions, nil
+}
+
+// merkleWalk is the state of extracting a proof
+type merkleWalk struct {
+	proof      *MerkleProof
+	flagsUsed  int
+	hashesUsed int
+	matches    [][]byte
+	positions  []int
+}
+
+func (walk *merkleWalk) extract(height, pos int) ([]byte, error) {
+	if walk.flagsUsed >= len(walk.proof.Flags) {
+		return nil, errors.New("proof runs out of flags")
+	}
+	matched := walk.proof.Flags[walk.flagsUsed]
+	walk.flagsUsed++
+
+	if height == 0 || !matched {
+		if walk.hashesUsed >= len(walk.proof.Hashes) {
+			return nil, errors.New("proof runs out of hashes")
+		}
+		hash := walk.proof.Hashes[walk.hashesUsed]
+		walk.hashesUsed++
+		if height == 0 && matched {
+			walk.matches = append(walk.matches, hash)
+			walk.positions = append(walk.positions, pos)
+		}
+		return hash, nil
+	}
+
+	left, err := walk.extract(height-1, pos*2)
+	if err != nil {
+		return nil, err
+	}
+	right := left
+	if pos*2+1 < walk.proof.width(height-1) {
+		right, err = walk.extract(height-1, pos*2+1)
+		if err != nil {
+			return nil, err
+		}
+		// a right node equal to the left one would let a proof pass
+		// for a tree with duplicated leaves. Valid blocks never have
+		// identical siblings: a block has a single coinbase, whose
+		// input carries random data, and two identical transactions
+		// would spend the same outputs twice.
+		if bytes.Equal(left, right) {
+			return nil, errors.New("proof has identical sibling nodes")
+		}
+	}
+
+	return hashPair(left, right), nil
+}
+
+func hashPair(left, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, left...), right...))
+
+	return hash[:]
+}
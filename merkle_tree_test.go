@@ -73,3 +73,74 @@ func TestNewMerkleTree(t *testing.T) {
 	assert.Equal(t, rootHash, fmt.Sprintf("%x", mTree.RootNode.Data), "Merkle tree root hash is correct")
 }
 
+
+func TestMerkleProof(t *testing.T) {
+	for total := 1; total <= 7; total++ {
+		var data [][]byte
+		for i := 0; i < total; i++ {
+			data = append(data, []byte(fmt.Sprintf("node%d", i)))
+		}
+		root := NewMerkleTree(data).RootNode.Data
+
+		// prove every other leaf
+		matches := make([]bool, total)
+		var want []int
+		for i := 0; i < total; i += 2 {
+			matches[i] = true
+			want = append(want, i)
+		}
+
+		proof := NewMerkleProof(data, matches)
+		extracted, hashes, positions, err := proof.extract()
+		assert.NoError(t, err)
+		assert.Equal(t, root, extracted, "Proof of %d leaves leads to the root", total)
+		assert.Equal(t, want, positions)
+		for i, pos := range positions {
+			leaf := NewMerkleNode(nil, nil, data[pos])
+			assert.Equal(t, leaf.Data, hashes[i])
+		}
+	}
+}
+
+func TestMerkleProofTampered(t *testing.T) {
+	data := [][]byte{[]byte("node1"), []byte("node2"), []byte("node3")}
+	proof := NewMerkleProof(data, []bool{false, true, false})
+
+	proof.Hashes = proof.Hashes[:len(proof.Hashes)-1]
+	_, _, _, err := proof.extract()
+	assert.Error(t, err, "A proof missing a hash is refused")
+
+	// a duplicated last leaf makes a tree of four with the same root
+	dup := NewMerkleProof(append(data, data[2]), []bool{false, false, true, true})
+	_, _, _, err = dup.extract()
+	assert.Error(t, err, "Identical siblings are refused")
+}
+
+func TestMerkleTreeOddLevels(t *testing.T) {
+	var data [][]byte
+	for i := 0; i < 5; i++ {
+		data = append(data, []byte(fmt.Sprintf("node%d", i)))
+	}
+	var leaves []*MerkleNode
+	for _, d := range data {
+		leaves = append(leaves, NewMerkleNode(nil, nil, d))
+	}
+
+	// the fifth leaf is paired with itself, and so is its parent
+	n01 := NewMerkleNode(leaves[0], leaves[1], nil)
+	n23 := NewMerkleNode(leaves[2], leaves[3], nil)
+	n44 := NewMerkleNode(leaves[4], leaves[4], nil)
+	left := NewMerkleNode(n01, n23, nil)
+	right := NewMerkleNode(n44, n44, nil)
+	root := NewMerkleNode(left, right, nil)
+
+	assert.Equal(t, root.Data, NewMerkleTree(data).RootNode.Data)
+}
+
+func TestCoinbasesDiffer(t *testing.T) {
+	address := string(NewWallet("").getAddress())
+	first := NewCoinbaseTransaction(address, "")
+	second := NewCoinbaseTransaction(address, "")
+
+	assert.NotEqual(t, first.ID, second.ID, "Coinbases to the same address don't share a Merkle leaf")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+const metricsFile = "metrics_%s.dat"
+
+// Metrics counts the events worth watching on a running node, like the
+// limits that triggered
+type Metrics struct {
+	Counters map[string]uint64
+
+	mu sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{Counters: make(map[string]uint64)}
+}
+
+// Inc adds one to a counter
+func (m *Metrics) inc(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Counters[name]++
+}
+
+// names returns the counter names in order
+func (m *Metrics) names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var names []string
+	for name := range m.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (m *Metrics) saveToFile(nodeID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var content bytes.Buffer
+	metricsFile := fmt.Sprintf(metricsFile, nodeID)
+
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(m)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = ioutil.WriteFile(metricsFile, content.Bytes(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// LoadMetrics reads the metrics a running node saved last
+func LoadMetrics(nodeID string) (*Metrics, error) {
+	m := NewMetrics()
+
+	metricsFile := fmt.Sprintf(metricsFile, nodeID)
+	if _, err := os.Stat(metricsFile); os.IsNotExist(err) {
+		return m, err
+	}
+	fileContent, err := ioutil.ReadFile(metricsFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(m)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// An M-of-N multisig output is locked with
+//   OP_m <pubkey 1> ... <pubkey n> OP_n OP_CHECKMULTISIG
+// and spent with OP_0 followed by m signatures in the order of the keys.
+// A P2SH address pays the hash of that script instead, the spender pushes
+// the script after the signatures.
+// Every key holder signs the same transaction, a PartialTransaction carries
+// it between them until there are enough signatures.
+
+// multisigScript returns the script locking an output to m of the keys
+func multisigScript(m int, pubKeys [][]byte) []byte {
+	script := pushNum(nil, int64(m))
+	for _, pubKey := range pubKeys {
+		script = pushData(script, pubKey)
+	}
+	script = pushNum(script, int64(len(pubKeys)))
+
+	return append(script, OP_CHECKMULTISIG)
+}
+
+// parseMultisigScript returns how many signatures a multisig script takes
+// and its keys, or false when the script isn't one
+func parseMultisigScript(script []byte) (int, [][]byte, bool) {
+	var ops []byte
+	var pushes [][]byte
+	for pc := 0; pc < len(script); {
+		op, data, next, err := parseOp(script, pc)
+		if err != nil {
+			return 0, nil, false
+		}
+		ops = append(ops, op)
+		pushes = append(pushes, data)
+		pc = next
+	}
+	if len(ops) < 4 || ops[len(ops)-1] != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+
+	m, ok := smallNum(ops[0])
+	if !ok {
+		return 0, nil, false
+	}
+	n, ok := smallNum(ops[len(ops)-2])
+	if !ok {
+		return 0, nil, false
+	}
+	keys := pushes[1 : len(pushes)-2]
+	if n != len(keys) || m < 1 || m > n {
+		return 0, nil, false
+	}
+	for i, key := range keys {
+		if ops[i+1] == OP_0 || ops[i+1] > OP_PUSHDATA2 || len(key) == 0 {
+			return 0, nil, false
+		}
+	}
+
+	return m, keys, true
+}
+
+// smallNum returns the number an OP_1 to OP_16 pushes
+func smallNum(op byte) (int, bool) {
+	if op < OP_1 || op > OP_16 {
+		return 0, false
+	}
+
+	return int(op-OP_1) + 1, true
+}
+
+// multisigAddress returns the address of the outputs locked to m of the keys
+func multisigAddress(m int, pubKeys [][]byte) (string, error) {
+	if len(pubKeys) == 0 || len(pubKeys) > 16 {
+		return "", fmt.Errorf("a multisig address takes 1 to 16 keys, not %d", len(pubKeys))
+	}
+	if m < 1 || m > len(pubKeys) {
+		return "", fmt.Errorf("%d signatures can't be required from %d keys", m, len(pubKeys))
+	}
+	for _, pubKey := range pubKeys {
+		if len(pubKey) == 0 || len(pubKey) > maxScriptElementSize {
+			return "", errors.New("public key is empty or too large")
+		}
+	}
+
+	return fmt.Sprintf("%s", encodeAddress(activeNet.MultisigVersion, multisigScript(m, pubKeys))), nil
+}
+
+// scriptHashAddress returns the P2SH address paying the hash of a redeem
+// script. The script is pushed when spending, so it's bounded like stack items.
+func scriptHashAddress(redeemScript []byte) (string, error) {
+	if len(redeemScript) > maxScriptElementSize {
+		return "", fmt.Errorf("redeem script is %d bytes, the limit is %d", len(redeemScript), maxScriptElementSize)
+	}
+
+	return fmt.Sprintf("%s", encodeAddress(activeNet.ScriptHashVersion, HashPubKey(redeemScript))), nil
+}
+
+// multisigSigSize is about how much the unlocking script of an input
+// spending an m of n output takes, to estimate fees before it's signed
+func multisigSigSize(m int) int {
+	return 1 + m*(1+64)
+}
+
+// PartialTransaction is a transaction spending multisig outputs that is
+// being signed. Scripts holds the multisig script of each input, and
+// Signatures the signatures of each input by hex public key. P2SH tells the
+// outputs spent are locked with the hash of their script.
+type PartialTransaction struct {
+	Tx         Transaction
+	Scripts    [][]byte
+	Signatures []map[string][]byte
+	P2SH       bool
+}
+
+// prevOut returns the output an input spends, as far as signing goes
+func (ptx *PartialTransaction) prevOut(inID int) TXOutput {
+	if ptx.P2SH {
+		return TXOutput{0, nil, p2shScript(HashPubKey(ptx.Scripts[inID]))}
+	}
+
+	return TXOutput{0, nil, ptx.Scripts[inID]}
+}
+
+// sign adds the signatures of a wallet to the inputs it holds a key of,
+// returning how many it added
+func (ptx *PartialTransaction) sign(wallet *Wallet) int {
+	added := 0
+	pubKey := hex.EncodeToString(wallet.PublicKey)
+	for inID, script := range ptx.Scripts {
+		_, keys, ok := parseMultisigScript(script)
+		if !ok {
+			continue
+		}
+		for _, key := range keys {
+			if !bytes.Equal(key, wallet.PublicKey) {
+				continue
+			}
+			if _, ok := ptx.Signatures[inID][pubKey]; ok {
+				break
+			}
+			data := ptx.Tx.signatureData(inID, ptx.prevOut(inID))
+			ptx.Signatures[inID][pubKey] = signData(wallet.PrivateKey, data)
+			added++
+			break
+		}
+	}
+
+	return added
+}
+
+// missing returns how many signatures the inputs still need, taken together
+func (ptx *PartialTransaction) missing() int {
+	missing := 0
+	for inID, script := range ptx.Scripts {
+		m, keys, _ := parseMultisigScript(script)
+		for _, key := range keys {
+			if m == 0 {
+				break
+			}
+			if _, ok := ptx.Signatures[inID][hex.EncodeToString(key)]; ok {
+				m--
+			}
+		}
+		missing += m
+	}
+
+	return missing
+}
+
+// finalize returns the transaction with the signatures in its unlocking
+// scripts, once every input has enough of them
+func (ptx *PartialTransaction) finalize() (*Transaction, error) {
+	if missing := ptx.missing(); missing > 0 {
+		return nil, fmt.Errorf("transaction needs %d more signatures", missing)
+	}
+
+	tx := ptx.Tx
+	tx.Vin = append([]TXInput(nil), ptx.Tx.Vin...)
+	for inID, script := range ptx.Scripts {
+		m, keys, _ := parseMultisigScript(script)
+		scriptSig := []byte{OP_0}
+		for _, key := range keys {
+			if m == 0 {
+				break
+			}
+			sig, ok := ptx.Signatures[inID][hex.EncodeToString(key)]
+			if ok {
+				scriptSig = pushData(scriptSig, sig)
+				m--
+			}
+		}
+		if ptx.P2SH {
+			scriptSig = pushData(scriptSig, script)
+		}
+		tx.Vin[inID].ScriptSig = scriptSig
+	}
+
+	return &tx, nil
+}
+
+func (ptx *PartialTransaction) saveToFile(file string) {
+	var content bytes.Buffer
+
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(ptx)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = ioutil.WriteFile(file, content.Bytes(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// LoadPartialTransaction reads a transaction being signed from a file
+func LoadPartialTransaction(file string) (*PartialTransaction, error) {
+	fileContent, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var ptx PartialTransaction
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&ptx)
+	if err != nil {
+		return nil, err
+	}
+	if len(ptx.Scripts) != len(ptx.Tx.Vin) || len(ptx.Signatures) != len(ptx.Tx.Vin) {
+		return nil, errors.New("partial transaction doesn't have a script and signatures for each input")
+	}
+	// gob leaves the empty maps out
+	for i := range ptx.Signatures {
+		if ptx.Signatures[i] == nil {
+			ptx.Signatures[i] = make(map[string][]byte)
+		}
+	}
+
+	return &ptx, nil
+}
+
+// NewMultisigTransaction pays amount from a multisig address to another
+// address, returning the transaction for the key holders to sign. Spending
+// from a P2SH address takes the redeem script its hash is of.
+func (bc *Blockchain) NewMultisigTransaction(from string, redeemScript []byte, to string, amount int, options TxOptions, UTXOSet UTXOSet, mempool *TxPool) *PartialTransaction {
+	script := addressScript(from)
+	p2sh := isP2SHScript(script)
+	if p2sh {
+		if !bytes.Equal(script, p2shScript(HashPubKey(redeemScript))) {
+			log.Panic("ERROR: Redeem script doesn't match the address")
+		}
+		script = redeemScript
+	}
+	m, _, ok := parseMultisigScript(script)
+	if !ok {
+		log.Panic("ERROR: Address is not a multisig address")
+	}
+	sigSize := multisigSigSize(m)
+	if p2sh {
+		sigSize += len(pushData(nil, script))
+	}
+
+	fee := options.Fee
+	for {
+		tx := bc.newUnsignedPayment(from, nil, to, amount, fee, options, UTXOSet, mempool)
+		size := len(tx.encode()) + len(tx.Vin)*sigSize
+		needed := feeForRate(options.FeeRate, size)
+		if needed > fee {
+			fee = needed
+			continue
+		}
+
+		ptx := &PartialTransaction{Tx: *tx, P2SH: p2sh}
+		for range tx.Vin {
+			ptx.Scripts = append(ptx.Scripts, script)
+			ptx.Signatures = append(ptx.Signatures, make(map[string][]byte))
+		}
+
+		return ptx
+	}
+}
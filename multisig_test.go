@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultisigScript(t *testing.T) {
+	keys := [][]byte{{1}, {2}, {3}}
+	script := multisigScript(2, keys)
+	assert.Equal(t, "OP_2 01 02 03 OP_3 OP_CHECKMULTISIG", disassembleScript(script))
+	m, parsed, ok := parseMultisigScript(script)
+	require.True(t, ok)
+	assert.Equal(t, 2, m)
+	assert.Equal(t, keys, parsed)
+	_, _, ok = parseMultisigScript(multisigScript(4, keys))
+	assert.False(t, ok, "More signatures than keys can't be required")
+	_, _, ok = parseMultisigScript(p2pkhScript([]byte{1}))
+	assert.False(t, ok)
+
+	// a signature is valid when it's the key byte with 0x10 added
+	checkSig := sigChecker(func(sig, pubKey []byte) bool {
+		return len(sig) == 1 && len(pubKey) == 1 && sig[0] == pubKey[0]+0x10
+	})
+	run := func(sigs ...byte) error {
+		unlocking := []byte{OP_0}
+		for _, sig := range sigs {
+			unlocking = pushData(unlocking, []byte{sig})
+		}
+		return verifyScripts(unlocking, script, checkSig)
+	}
+	assert.NoError(t, run(0x11, 0x13))
+	assert.NoError(t, run(0x12, 0x13))
+	assert.Equal(t, errScriptFalse, run(0x13, 0x11), "Signatures go in the order of the keys")
+	assert.Equal(t, errScriptFalse, run(0x11, 0x11), "A key signs once")
+	assert.Error(t, run(0x11), "There are as many signatures as required")
+	assert.Error(t, verifyScripts(pushData(pushData([]byte{OP_1}, []byte{0x11}), []byte{0x12}), script, checkSig), "The dummy item is empty")
+
+	var manyKeys []byte
+	for i := 0; i < maxMultisigKeys; i++ {
+		manyKeys = append(manyKeys, OP_1)
+	}
+	zeroOfMany := append([]byte{OP_0, OP_0}, pushNum(manyKeys, maxMultisigKeys)...)
+	zeroOfMany = append(zeroOfMany, OP_CHECKMULTISIG)
+	assert.NoError(t, verifyScripts(nil, zeroOfMany, nil))
+	var tooMany []byte
+	for i := 0; i < 10; i++ {
+		tooMany = append(append(tooMany, zeroOfMany...), OP_DROP)
+	}
+	assert.Error(t, verifyScripts(nil, append(tooMany, OP_1), nil), "Each key counts as an operation")
+}
+
+// sigChecker checks the signatures of scripts with a function, and no locks
+type sigChecker func(sig, pubKey []byte) bool
+
+func (c sigChecker) checkSig(sig, pubKey []byte) bool  { return c(sig, pubKey) }
+func (c sigChecker) checkLockTime(lockTime int64) bool { return false }
+func (c sigChecker) checkSequence(sequence int64) bool { return false }
+
+func TestMultisigAddress(t *testing.T) {
+	activeNet = &regTestParams
+	defer func() { activeNet = &mainNetParams }()
+
+	keys := [][]byte{NewWallet("").PublicKey, NewWallet("").PublicKey}
+	address, err := multisigAddress(1, keys)
+	require.NoError(t, err)
+	assert.True(t, ValidateAddress(address))
+	assert.Equal(t, multisigScript(1, keys), addressScript(address))
+	assert.True(t, ValidateAddress(string(NewWallet("").getAddress())))
+	tampered := address[:len(address)-1] + "1"
+	if tampered == address {
+		tampered = address[:len(address)-1] + "2"
+	}
+	assert.False(t, ValidateAddress(tampered), "The checksum covers the script")
+	assert.False(t, ValidateAddress("1"))
+	_, err = multisigAddress(3, keys)
+	assert.Error(t, err)
+
+	p2shAddress, err := scriptHashAddress(addressScript(address))
+	require.NoError(t, err)
+	assert.True(t, ValidateAddress(p2shAddress))
+	assert.Equal(t, p2shScript(HashPubKey(addressScript(address))), addressScript(p2shAddress))
+	_, err = scriptHashAddress(make([]byte, maxScriptElementSize+1))
+	assert.Error(t, err, "The redeem script is pushed when spending")
+
+	activeNet = &mainNetParams
+	assert.False(t, ValidateAddress(address), "Multisig addresses are bound to their network")
+	assert.False(t, ValidateAddress(p2shAddress))
+}
+
+func TestMultisigTransaction(t *testing.T) {
+	t.Run("bare", func(t *testing.T) { testMultisigTransaction(t, false) })
+	t.Run("p2sh", func(t *testing.T) { testMultisigTransaction(t, true) })
+}
+
+// testMultisigTransaction has two of three officers spend from a treasury
+func testMultisigTransaction(t *testing.T, p2sh bool) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(dir)
+	activeNet = &regTestParams
+	defer func() { activeNet = &mainNetParams }()
+
+	officers := []*Wallet{NewWallet(""), NewWallet(""), NewWallet("")}
+	redeemScript := multisigScript(2, [][]byte{officers[0].PublicKey, officers[1].PublicKey, officers[2].PublicKey})
+	treasury, err := multisigAddress(2, [][]byte{officers[0].PublicKey, officers[1].PublicKey, officers[2].PublicKey})
+	require.NoError(t, err)
+	if p2sh {
+		treasury, err = scriptHashAddress(redeemScript)
+		require.NoError(t, err)
+	}
+	address := string(NewWallet("").getAddress())
+	bc := CreateBlockchain(address, "0")
+	defer bc.db.Close()
+	bc.MineBlock([]*Transaction{NewCoinbaseTransaction(treasury, "")})
+	utxoSet := UTXOSet{bc}
+	utxoSet.reindex()
+	require.Len(t, utxoSet.findUTXO(addressScript(treasury)), 1)
+
+	ptx := bc.NewMultisigTransaction(treasury, redeemScript, address, 100, TxOptions{Fee: 10}, utxoSet, nil)
+	require.Len(t, ptx.Tx.Vin, 1)
+	assert.Equal(t, 1, ptx.sign(officers[2]))
+	assert.Equal(t, 0, ptx.sign(officers[2]), "A key signs once")
+	assert.Equal(t, 1, ptx.missing())
+	_, err = ptx.finalize()
+	assert.Error(t, err)
+
+	// the transaction goes from one officer to the next in a file
+	file := "treasury.ptx"
+	ptx.saveToFile(file)
+	ptx, err = LoadPartialTransaction(file)
+	require.NoError(t, err)
+	assert.Equal(t, 1, ptx.sign(officers[0]))
+	tx, err := ptx.finalize()
+	require.NoError(t, err)
+
+	pool := NewTxPool(maxMempoolSize, mempoolExpiry)
+	sig := ptx.Signatures[0][hex.EncodeToString(officers[0].PublicKey)]
+	forged := *tx
+	forged.Vin = []TXInput{tx.Vin[0]}
+	forged.Vin[0].ScriptSig = pushData(pushData([]byte{OP_0}, sig), sig)
+	if p2sh {
+		forged.Vin[0].ScriptSig = pushData(forged.Vin[0].ScriptSig, redeemScript)
+	}
+	assert.Error(t, pool.add(&forged, bc), "One officer can't sign twice")
+	require.NoError(t, pool.add(tx, bc))
+	assert.Equal(t, activeNet.Subsidy-110, tx.Vout[1].Value, "The change goes back to the treasury")
+	assert.Equal(t, addressScript(treasury), tx.Vout[1].Script)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// NetParams defines a network: its genesis block and consensus rules, and
+// what tells its nodes and addresses apart from those of other networks
+type NetParams struct {
+	Name string
+	// AddressVersion is the first byte of the addresses
+	AddressVersion byte
+	// MultisigVersion is the first byte of the multisig addresses, which
+	// carry the whole locking script
+	MultisigVersion byte
+	// ScriptHashVersion is the first byte of the P2SH addresses
+	ScriptHashVersion byte
+	DefaultPort       string
+	DefaultSeeds      []string
+
+	// TargetBits is the proof of work difficulty
+	TargetBits int
+	// Subsidy is the reward of a coinbase
+	Subsidy int
+
+	// the genesis block pays Subsidy to a public key hash nobody has the
+	// key of, GenesisHash checks it is built right
+	GenesisTimestamp int64
+	GenesisNonce     int
+	GenesisHash      string
+}
+
+var mainNetParams = NetParams{
+	Name:              "mainnet",
+	AddressVersion:    0x00,
+	MultisigVersion:   0x0d,
+	ScriptHashVersion: 0x05,
+	DefaultPort:       "3000",
+	DefaultSeeds:      []string{"localhost:3000"},
+	TargetBits:        15,
+	Subsidy:           2100,
+	GenesisTimestamp:  1231006505,
+	GenesisNonce:      114339,
+	GenesisHash:       "0000d4d9948251ad96257fac26a0e57db98004edbcd9d248d9019e702738433c",
+}
+
+var testNetParams = NetParams{
+	Name:              "testnet",
+	AddressVersion:    0x6f,
+	MultisigVersion:   0x7d,
+	ScriptHashVersion: 0xc4,
+	DefaultPort:       "13000",
+	DefaultSeeds:      []string{"localhost:13000"},
+	TargetBits:        15,
+	Subsidy:           2100,
+	GenesisTimestamp:  1296688602,
+	GenesisNonce:      15735,
+	GenesisHash:       "0001c977582ccbb2f1fa8da113048a522c0861eebe0b77556ed2b93bf8ddd8c6",
+}
+
+// regTestParams is for tests on a private network: blocks are cheap to
+// mine and there are no seeds to reach out to
+var regTestParams = NetParams{
+	Name:              "regtest",
+	AddressVersion:    0x6f,
+	MultisigVersion:   0x7d,
+	ScriptHashVersion: 0xc4,
+	DefaultPort:       "23000",
+	TargetBits:        8,
+	Subsidy:           2100,
+	GenesisTimestamp:  1296688602,
+	GenesisNonce:      14,
+	GenesisHash:       "007c1d40b2c4799cfb204856bc1a450f864239e65a2034b0b5518dc04a154c28",
+}
+
+// activeNet is the network the node is on, chosen with -network
+var activeNet = &mainNetParams
+
+// netParamsByName finds the parameters of a network
+func netParamsByName(name string) (*NetParams, error) {
+	for _, params := range []*NetParams{&mainNetParams, &testNetParams, &regTestParams} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown network %q", name)
+}
+
+// genesisBlock builds the genesis block of the network
+func (params *NetParams) genesisBlock() *Block {
+	txin := TXInput{[]byte{}, -1, nil, []byte(genesisCoinbaseData), nil, 0}
+	txout := TXOutput{params.Subsidy, make([]byte, 20), nil}
+	coinbase := Transaction{nil, []TXInput{txin}, []TXOutput{txout}, false, 0}
+	coinbase.ID = coinbase.hash()
+
+	block := &Block{params.GenesisTimestamp, []*Transaction{&coinbase}, []byte{}, nil, params.GenesisNonce, 0}
+	hash := sha256.Sum256(headerData(block.PrevBlockHash, block.hashTransactions(), block.Timestamp, params.TargetBits, block.Nonce))
+	block.Hash = hash[:]
+	if hex.EncodeToString(block.Hash) != params.GenesisHash {
+		log.Panicf("genesis block of %s has hash %x", params.Name, block.Hash)
+	}
+
+	return block
+}
+
+// genesisHash returns the hash of the genesis block of the network
+func (params *NetParams) genesisHash() []byte {
+	hash, err := hex.DecodeString(params.GenesisHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return hash
+}
+
+// magic starts every message on the network. It comes from the genesis
+// block, so networks starting from different blocks don't talk to each other.
+func (params *NetParams) magic() []byte {
+	hash := params.genesisHash()
+
+	return hash[len(hash)-4:]
+}
+
+// isGenesis tells whether a block hash is the one of the genesis block
+func (params *NetParams) isGenesis(hash []byte) bool {
+	return bytes.Equal(hash, params.genesisHash())
+}
+
+// dataID is the ID the files of a node on the network are named after,
+// mainnet keeps the plain node ID so the files of older nodes still load
+func (params *NetParams) dataID(nodeID string) string {
+	if params == &mainNetParams {
+		return nodeID
+	}
+
+	return nodeID + "_" + params.Name
+}
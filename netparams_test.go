@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetParams(t *testing.T) {
+	defer func() { activeNet = &mainNetParams }()
+
+	networks := []*NetParams{&mainNetParams, &testNetParams, &regTestParams}
+	magics := make(map[string]string)
+	for _, params := range networks {
+		activeNet = params
+		block := params.genesisBlock()
+		header := block.header()
+		assert.NoError(t, header.validate(), "The genesis block of %s has a valid proof of work", params.Name)
+		assert.True(t, params.isGenesis(block.Hash))
+
+		found, err := netParamsByName(params.Name)
+		require.NoError(t, err)
+		assert.Equal(t, params, found)
+
+		other, seen := magics[string(params.magic())]
+		assert.False(t, seen, "%s has the magic of %s", params.Name, other)
+		magics[string(params.magic())] = params.Name
+	}
+	_, err := netParamsByName("nonet")
+	assert.Error(t, err)
+
+	activeNet = &mainNetParams
+	address := string(NewWallet("").getAddress())
+	assert.True(t, ValidateAddress(address))
+	activeNet = &testNetParams
+	assert.False(t, ValidateAddress(address), "A mainnet address isn't valid on testnet")
+	assert.True(t, ValidateAddress(string(NewWallet("").getAddress())))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxOrphans caps the transactions waiting for their parents, a peer
+// sending transactions nobody can check would fill the memory otherwise
+const maxOrphans = 100
+
+// maxOrphanSize caps the encoded size of an orphan
+const maxOrphanSize = 100000
+
+// orphanExpiry is how long an orphan waits for its parents
+const orphanExpiry = 20 * time.Minute
+
+var errOrphanTooLarge = errors.New("orphan transaction is too large")
+
+// orphanEntry is a transaction waiting for its parents, with the peer it
+// came from to ask for them
+type orphanEntry struct {
+	tx      Transaction
+	from    string
+	parents [][]byte
+	expires time.Time
+}
+
+// OrphanPool holds the transactions received before the transactions they
+// spend the outputs of, until those come in or they expire
+type OrphanPool struct {
+	orphans map[string]*orphanEntry
+	// byParent maps the missing parents to the orphans spending them, by hex ID
+	byParent   map[string]map[string]bool
+	maxOrphans int
+	expiry     time.Duration
+	mu         sync.Mutex
+}
+
+// NewOrphanPool creates an empty pool of up to maxOrphans transactions, each
+// kept for at most expiry
+func NewOrphanPool(maxOrphans int, expiry time.Duration) *OrphanPool {
+	return &OrphanPool{
+		orphans:    make(map[string]*orphanEntry),
+		byParent:   make(map[string]map[string]bool),
+		maxOrphans: maxOrphans,
+		expiry:     expiry,
+	}
+}
+
+// add keeps a transaction missing parents, evicting a random orphan when the
+// pool is full
+func (pool *OrphanPool) add(tx *Transaction, from string, parents [][]byte) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.expire()
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := pool.orphans[txID]; ok {
+		return errTxInPool
+	}
+	if len(tx.encode()) > maxOrphanSize {
+		return errOrphanTooLarge
+	}
+	// map iteration order is random, so a peer can't pick the orphans of
+	// others to push out
+	for evicted := range pool.orphans {
+		if len(pool.orphans) < pool.maxOrphans {
+			break
+		}
+		fmt.Printf("Evicting orphan transaction %s\n", evicted)
+		pool.remove(evicted)
+	}
+
+	pool.orphans[txID] = &orphanEntry{*tx, from, parents, time.Now().Add(pool.expiry)}
+	for _, parent := range parents {
+		parentID := hex.EncodeToString(parent)
+		if pool.byParent[parentID] == nil {
+			pool.byParent[parentID] = make(map[string]bool)
+		}
+		pool.byParent[parentID][txID] = true
+	}
+
+	return nil
+}
+
+func (pool *OrphanPool) remove(txID string) bool {
+	entry, ok := pool.orphans[txID]
+	if !ok {
+		return false
+	}
+	delete(pool.orphans, txID)
+	for _, parent := range entry.parents {
+		parentID := hex.EncodeToString(parent)
+		delete(pool.byParent[parentID], txID)
+		if len(pool.byParent[parentID]) == 0 {
+			delete(pool.byParent, parentID)
+		}
+	}
+
+	return true
+}
+
+// expire drops the orphans whose parents didn't come in time
+func (pool *OrphanPool) expire() {
+	now := time.Now()
+	for txID, entry := range pool.orphans {
+		if now.After(entry.expires) {
+			pool.remove(txID)
+		}
+	}
+}
+
+// take removes and returns the orphans spending the outputs of a
+// transaction, to try them again now that it's known
+func (pool *OrphanPool) take(parentID []byte) []orphanEntry {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var taken []orphanEntry
+	for txID := range pool.byParent[hex.EncodeToString(parentID)] {
+		taken = append(taken, *pool.orphans[txID])
+		pool.remove(txID)
+	}
+
+	return taken
+}
+
+// has tells whether a transaction is in the pool
+func (pool *OrphanPool) has(txID []byte) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	_, ok := pool.orphans[hex.EncodeToString(txID)]
+	return ok
+}
+
+func (pool *OrphanPool) count() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return len(pool.orphans)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrphanPool(t *testing.T) {
+	address := string(NewWallet("").getAddress())
+	parent := NewCoinbaseTransaction(address, "")
+	orphan := func() *Transaction {
+		tx := Transaction{nil, []TXInput{{parent.ID, 0, nil, nil, nil, 0}}, []TXOutput{*NewTXOutput(1, address)}, false, 0}
+		tx.ID = NewCoinbaseTransaction(address, "").ID
+		return &tx
+	}
+
+	pool := NewOrphanPool(2, orphanExpiry)
+	first := orphan()
+	require.NoError(t, pool.add(first, "peer", [][]byte{parent.ID}))
+	assert.Equal(t, errTxInPool, pool.add(first, "peer", [][]byte{parent.ID}))
+	require.NoError(t, pool.add(orphan(), "peer", [][]byte{parent.ID}))
+	require.NoError(t, pool.add(orphan(), "peer", [][]byte{parent.ID}))
+	assert.Equal(t, 2, pool.count(), "The pool is bounded")
+
+	large := orphan()
+	large.Vout[0].PubKeyHash = make([]byte, maxOrphanSize)
+	assert.Equal(t, errOrphanTooLarge, pool.add(large, "peer", [][]byte{parent.ID}))
+
+	taken := pool.take(parent.ID)
+	assert.Len(t, taken, 2)
+	assert.Equal(t, "peer", taken[0].from)
+	assert.Equal(t, 0, pool.count())
+	assert.Empty(t, pool.take(parent.ID))
+
+	pool = NewOrphanPool(maxOrphans, time.Millisecond)
+	require.NoError(t, pool.add(orphan(), "peer", [][]byte{parent.ID}))
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, pool.add(first, "peer", [][]byte{parent.ID}))
+	assert.Equal(t, 1, pool.count(), "Orphans expire")
+}
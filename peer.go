@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Misbehavior points; a peer reaching banThreshold is disconnected and banned
+const (
+	banThreshold      = 100
+	scoreMalformed    = 20
+	scoreUnrequested  = 10
+	scoreInvalidBlock = 100
+	// scoreFlooding is charged for every message over the rate or inflight limits
+	scoreFlooding = 1
+)
+
+const peerInfoFile = "peerinfo_%s.dat"
+const pingInterval = 30 * time.Second
+const pingTimeout = 2 * time.Minute
+const maxKnownInventory = 5000
+
+// maxPeerEntries caps the peers and the peer IDs tracked, the least
+// recently seen go first; entries not seen for peerEntryExpiry are dropped
+const maxPeerEntries = 1000
+const peerEntryExpiry = time.Hour
+
+// Peer holds what we track about a remote node
+type Peer struct {
+	Addr string
+	// Misbehavior is the score of the peer ID of the peer
+	Misbehavior int
+	// Version is the protocol version the peer runs
+	Version    int
+	BestHeight int
+	// Light is set for light clients, which have headers but no blocks
+	Light bool
+	// PingNonce is the nonce of the ping waiting for a pong, 0 when there is none
+	PingNonce uint64
+	PingSent  time.Time
+	LastPong  time.Time
+	// Latency is the round trip time of the last ping
+	Latency time.Duration
+	// NodeKey is the static key the peer authenticated with over the encrypted transport
+	NodeKey []byte
+
+	// knownInventory holds the blocks and transactions the peer is known to
+	// have, so we don't announce them back; knownOrder evicts the oldest
+	knownInventory map[string]bool
+	knownOrder     []string
+
+	// filter is the bloom filter of a light client, nil for full nodes
+	filter *BloomFilter
+	// lastSeen is when the peer was last heard of or talked to
+	lastSeen time.Time
+}
+
+// identity holds the misbehavior score and the message allowance of a peer
+// ID, which outlive the connections of the peer
+type identity struct {
+	misbehavior int
+	// tokens is the message allowance refilled at messageRate since lastRefill
+	tokens     float64
+	lastRefill time.Time
+	// inflight counts the messages of the peer being handled
+	inflight int
+	lastSeen time.Time
+}
+
+// getIdentity returns the state of a peer ID, adding it on first contact;
+// the caller holds peersMutex
+func (server *Server) getIdentity(id string) *identity {
+	state, ok := server.identities[id]
+	if !ok {
+		if len(server.identities) >= maxPeerEntries {
+			var oldest string
+			for other, entry := range server.identities {
+				if oldest == "" || entry.lastSeen.Before(server.identities[oldest].lastSeen) {
+					oldest = other
+				}
+			}
+			delete(server.identities, oldest)
+		}
+		state = &identity{}
+		server.identities[id] = state
+	}
+	state.lastSeen = time.Now()
+
+	return state
+}
+
+// peerID identifies the sender of a message by the node key it
+// authenticated with over the encrypted transport, by the address it
+// advertises otherwise. Peers on one host each have an ID of their own.
+// Messages too broken to tell their sender go by the remote address of the
+// connection.
+func peerID(conn net.Conn, from string) string {
+	if sc, ok := conn.(interface{ RemoteKey() []byte }); ok && sc.RemoteKey() != nil {
+		return hex.EncodeToString(sc.RemoteKey())
+	}
+	if from == "" {
+		from = conn.RemoteAddr().String()
+	}
+
+	return normalizeAddress(from)
+}
+
+// getPeer returns the peer of an address, adding it on first contact;
+// the caller holds peersMutex
+func (server *Server) getPeer(addr string) *Peer {
+	peer, ok := server.peers[addr]
+	if !ok {
+		if len(server.peers) >= maxPeerEntries {
+			var oldest string
+			for other, entry := range server.peers {
+				if oldest == "" || entry.lastSeen.Before(server.peers[oldest].lastSeen) {
+					oldest = other
+				}
+			}
+			delete(server.peers, oldest)
+		}
+		peer = &Peer{Addr: addr}
+		server.peers[addr] = peer
+	}
+	peer.lastSeen = time.Now()
+
+	return peer
+}
+
+// prunePeers drops the peers and peer IDs not seen for peerEntryExpiry
+func (server *Server) prunePeers() {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	for addr, peer := range server.peers {
+		if time.Since(peer.lastSeen) > peerEntryExpiry {
+			delete(server.peers, addr)
+		}
+	}
+	for id, state := range server.identities {
+		if state.inflight == 0 && time.Since(state.lastSeen) > peerEntryExpiry {
+			delete(server.identities, id)
+		}
+	}
+}
+
+// misbehaving adds points to the peer ID a message came from and bans it
+// once the threshold is reached
+func (server *Server) misbehaving(id string, howmuch int, reason string) {
+	server.peersMutex.Lock()
+	state := server.getIdentity(id)
+	state.misbehavior += howmuch
+	score := state.misbehavior
+	server.peersMutex.Unlock()
+
+	fmt.Printf("Peer %s misbehaving (+%d, score %d): %s\n", id, howmuch, score, reason)
+	if score >= banThreshold {
+		server.banPeer(id)
+	}
+}
+
+// misbehaviorError is returned by message handlers for messages that are
+// well formed but shouldn't have been sent, with the points they're worth
+type misbehaviorError struct {
+	score  int
+	reason string
+}
+
+func (e *misbehaviorError) Error() string {
+	return e.reason
+}
+
+// banPeer bans a peer ID and forgets about the peers it stands for
+func (server *Server) banPeer(id string) {
+	fmt.Printf("Banning %s for %s\n", id, server.banTime)
+	server.metrics.inc("peers_banned")
+	server.bans.ban(id, server.banTime)
+
+	server.peersMutex.Lock()
+	var banned []string
+	for _, peer := range server.peers {
+		if peer.id() == id {
+			banned = append(banned, peer.Addr)
+		}
+	}
+	server.peersMutex.Unlock()
+	for _, node := range server.getKnownNodes() {
+		if normalizeAddress(node) == id {
+			banned = append(banned, node)
+		}
+	}
+	for _, addr := range banned {
+		server.disconnectPeer(addr)
+	}
+}
+
+// id returns the peer ID the messages of a peer go by, see peerID
+func (peer *Peer) id() string {
+	if len(peer.NodeKey) > 0 {
+		return hex.EncodeToString(peer.NodeKey)
+	}
+
+	return normalizeAddress(peer.Addr)
+}
+
+// disconnectPeer drops a peer and stops sending it anything
+func (server *Server) disconnectPeer(addr string) {
+	server.peersMutex.Lock()
+	delete(server.peers, addr)
+	server.peersMutex.Unlock()
+
+	server.removeNode(addr)
+}
+
+// isBanned checks a peer ID against the ban list, along with its host,
+// which setban bans as a whole when given no port
+func (server *Server) isBanned(id string) bool {
+	return server.bans.isBanned(id) || server.bans.isBanned(addressHost(id))
+}
+
+// addressIsBanned checks a peer address against the ban list
+func (server *Server) addressIsBanned(addr string) bool {
+	return server.isBanned(normalizeAddress(addr))
+}
+
+// remoteHost returns the host part of the remote end of a connection
+func remoteHost(conn net.Conn) string {
+	return addressHost(conn.RemoteAddr().String())
+}
+
+// addressHost returns the host part of an address
+func addressHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// normalizeAddress spells the host of an address the same way whichever way
+// a peer wrote it, so localhost:3000 and 127.0.0.1:3000 compare equal
+func normalizeAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	host = strings.ToLower(host)
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	if port == "" {
+		return host
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// pingPeers pings every connected peer, dropping those that left the last ping unanswered for too long
+func (server *Server) pingPeers() {
+	for _, node := range server.getKnownNodes() {
+		if node == server.nodeAddress {
+			continue
+		}
+
+		server.peersMutex.Lock()
+		peer := server.getPeer(node)
+		waiting := peer.PingNonce != 0
+		timedOut := waiting && time.Since(peer.PingSent) > pingTimeout
+		if !waiting {
+			peer.PingNonce = rand.Uint64() | 1
+			peer.PingSent = time.Now()
+		}
+		nonce := peer.PingNonce
+		server.peersMutex.Unlock()
+
+		if timedOut {
+			fmt.Printf("Peer %s didn't answer ping in %s, disconnecting\n", node, pingTimeout)
+			server.disconnectPeer(node)
+			server.addrManager.markAttempt(node, false)
+			continue
+		}
+		if !waiting {
+			server.SendPing(node, nonce)
+		}
+	}
+}
+
+// pongReceived records the round trip of an answered ping
+func (server *Server) pongReceived(addr string, nonce uint64) {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	peer, ok := server.peers[addr]
+	if !ok || peer.PingNonce == 0 || peer.PingNonce != nonce {
+		return
+	}
+	peer.Latency = time.Since(peer.PingSent)
+	peer.LastPong = time.Now()
+	peer.PingNonce = 0
+}
+
+// markInventoryKnown records that a peer has a block or transaction
+func (server *Server) markInventoryKnown(addr string, id []byte) {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	peer := server.getPeer(addr)
+	if peer.knownInventory == nil {
+		peer.knownInventory = make(map[string]bool)
+	}
+
+	key := hex.EncodeToString(id)
+	if peer.knownInventory[key] {
+		return
+	}
+	if len(peer.knownOrder) >= maxKnownInventory {
+		delete(peer.knownInventory, peer.knownOrder[0])
+		peer.knownOrder = peer.knownOrder[1:]
+	}
+	peer.knownInventory[key] = true
+	peer.knownOrder = append(peer.knownOrder, key)
+}
+
+// peerKnowsInventory checks whether a peer already has a block or transaction
+func (server *Server) peerKnowsInventory(addr string, id []byte) bool {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	peer, ok := server.peers[addr]
+	return ok && peer.knownInventory[hex.EncodeToString(id)]
+}
+
+// setPeerKey records the static key a peer authenticated with
+func (server *Server) setPeerKey(addr string, key []byte) {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	server.getPeer(addr).NodeKey = key
+}
+
+// setPeerVersion records the protocol version, best height and kind of
+// node a peer told us about
+func (server *Server) setPeerVersion(addr string, version, height int, light bool) {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	peer := server.getPeer(addr)
+	peer.Version = version
+	peer.BestHeight = height
+	peer.Light = light
+}
+
+// peerSupportsCompactBlocks tells whether a peer understands compact
+// blocks, light clients have no mempool to rebuild them from
+func (server *Server) peerSupportsCompactBlocks(addr string) bool {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	peer, ok := server.peers[addr]
+	return ok && peer.Version >= compactBlocksVersion && !peer.Light
+}
+
+// setPeerFilter loads the bloom filter of a light client, nil clears it
+func (server *Server) setPeerFilter(addr string, filter *BloomFilter) {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	server.getPeer(addr).filter = filter
+}
+
+// addToPeerFilter adds an element to the filter of a peer, reporting false
+// when the peer has no filter loaded
+func (server *Server) addToPeerFilter(addr string, data []byte) bool {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	peer, ok := server.peers[addr]
+	if !ok || peer.filter == nil {
+		return false
+	}
+	peer.filter.add(data)
+
+	return true
+}
+
+// peerHasFilter tells whether a peer is a light client with a filter loaded
+func (server *Server) peerHasFilter(addr string) bool {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	peer, ok := server.peers[addr]
+	return ok && peer.filter != nil
+}
+
+// peerWantsTransaction tells whether a transaction matches the filter of a
+// peer, peers without a filter want them all
+func (server *Server) peerWantsTransaction(addr string, tx *Transaction) bool {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	peer, ok := server.peers[addr]
+	return !ok || peer.filter == nil || peer.filter.matchTransaction(tx)
+}
+
+// filterBlock builds the merkle block of a block for a peer, nil when the
+// peer has no filter
+func (server *Server) filterBlock(addr string, block *Block) *MerkleBlock {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	peer, ok := server.peers[addr]
+	if !ok || peer.filter == nil {
+		return nil
+	}
+
+	return NewMerkleBlock(block, peer.filter)
+}
+
+// fastestPeer picks the peer with the lowest measured latency among the
+// full nodes having at least minHeight blocks, peers not measured yet come last
+func (server *Server) fastestPeer(minHeight int) string {
+	nodes := server.getKnownNodes()
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	var best *Peer
+	for _, node := range nodes {
+		peer, ok := server.peers[node]
+		if !ok || node == server.nodeAddress || peer.Light || peer.BestHeight < minHeight {
+			continue
+		}
+		if best == nil || peer.isFasterThan(best) {
+			best = peer
+		}
+	}
+	if best == nil {
+		return ""
+	}
+
+	return best.Addr
+}
+
+func (peer *Peer) isFasterThan(other *Peer) bool {
+	if peer.Latency == 0 {
+		return false
+	}
+
+	return other.Latency == 0 || peer.Latency < other.Latency
+}
+
+// getPeers returns a copy of the connected peers ordered by address
+func (server *Server) getPeers() []Peer {
+	nodes := server.getKnownNodes()
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	var connected []Peer
+	for _, node := range nodes {
+		if peer, ok := server.peers[node]; ok && node != server.nodeAddress {
+			info := *peer
+			if state, ok := server.identities[peer.id()]; ok {
+				info.Misbehavior = state.misbehavior
+			}
+			connected = append(connected, info)
+		}
+	}
+	sort.Slice(connected, func(i, j int) bool {
+		return connected[i].Addr < connected[j].Addr
+	})
+
+	return connected
+}
+
+// savePeerInfo writes the connected peers to a file for getpeerinfo to read
+func (server *Server) savePeerInfo() {
+	var content bytes.Buffer
+	peerInfoFile := fmt.Sprintf(peerInfoFile, server.nodeID)
+
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(server.getPeers())
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = ioutil.WriteFile(peerInfoFile, content.Bytes(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// LoadPeerInfo reads the peers a running node saved last
+func LoadPeerInfo(nodeID string) ([]Peer, error) {
+	var connected []Peer
+
+	peerInfoFile := fmt.Sprintf(peerInfoFile, nodeID)
+	if _, err := os.Stat(peerInfoFile); os.IsNotExist(err) {
+		return connected, err
+	}
+	fileContent, err := ioutil.ReadFile(peerInfoFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&connected)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return connected, nil
+}
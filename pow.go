@@ -13,8 +13,6 @@ var (
 	maxNonce = math.MaxInt64
 )
 
-const targetBits = 15 // target diffculty
-
 type ProofOfWork struct {
 	block  *Block
 	target *big.Int
@@ -22,7 +20,7 @@ type ProofOfWork struct {
 
 func NewProofOfWork(b *Block) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+	target.Lsh(target, uint(256-activeNet.TargetBits))
 
 	pow := &ProofOfWork{b, target}
 
@@ -30,11 +28,17 @@ func NewProofOfWork(b *Block) *ProofOfWork {
 }
 
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
+	return headerData(pow.block.PrevBlockHash, pow.block.hashTransactions(), pow.block.Timestamp, activeNet.TargetBits, nonce)
+}
+
+// headerData is what a block hash commits to, the transactions only
+// through their Merkle root
+func headerData(prevBlockHash, merkleRoot []byte, timestamp int64, targetBits, nonce int) []byte {
 	data := bytes.Join(
 		[][]byte{
-			pow.block.PrevBlockHash,
-			pow.block.hashTransactions(),
-			IntToHex(pow.block.Timestamp),
+			prevBlockHash,
+			merkleRoot,
+			IntToHex(timestamp),
 			IntToHex(int64(targetBits)),
 			IntToHex(int64(nonce))},
 		[]byte{},
@@ -76,3 +80,11 @@ func (pow *ProofOfWork) validate() bool {
 
 	return isValid
 }
+
+// meetsTarget tells whether a hash is below the proof of work target
+func meetsTarget(hash []byte) bool {
+	var hashInt big.Int
+	hashInt.SetBytes(hash)
+
+	return hashInt.Cmp(NewProofOfWork(nil).target) == -1
+}
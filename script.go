@@ -0,0 +1,731 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Scripts lock outputs and unlock the inputs spending them. The unlocking
+// script runs first and only pushes data, then the locking script runs on
+// the stack it left, and the input is valid when the top of the stack is
+// true. Outputs without a script are locked with the P2PKH template.
+// P2SH outputs are locked with the hash of a redeem script, which the
+// unlocking script pushes last and which then runs on the rest of its stack.
+
+// The opcodes, numbered like in Bitcoin so scripts read the same
+const (
+	OP_0         = 0x00
+	OP_PUSHDATA1 = 0x4c
+	OP_PUSHDATA2 = 0x4d
+	OP_1NEGATE   = 0x4f
+	OP_1         = 0x51
+	OP_2         = 0x52
+	OP_3         = 0x53
+	OP_4         = 0x54
+	OP_5         = 0x55
+	OP_6         = 0x56
+	OP_7         = 0x57
+	OP_8         = 0x58
+	OP_9         = 0x59
+	OP_10        = 0x5a
+	OP_11        = 0x5b
+	OP_12        = 0x5c
+	OP_13        = 0x5d
+	OP_14        = 0x5e
+	OP_15        = 0x5f
+	OP_16        = 0x60
+
+	OP_NOP    = 0x61
+	OP_IF     = 0x63
+	OP_NOTIF  = 0x64
+	OP_ELSE   = 0x67
+	OP_ENDIF  = 0x68
+	OP_VERIFY = 0x69
+	OP_RETURN = 0x6a
+
+	OP_DROP = 0x75
+	OP_DUP  = 0x76
+	OP_SWAP = 0x7c
+	OP_SIZE = 0x82
+
+	OP_EQUAL          = 0x87
+	OP_EQUALVERIFY    = 0x88
+	OP_NOT            = 0x91
+	OP_ADD            = 0x93
+	OP_SUB            = 0x94
+	OP_NUMEQUAL       = 0x9c
+	OP_NUMEQUALVERIFY = 0x9d
+	OP_LESSTHAN       = 0x9f
+	OP_GREATERTHAN    = 0xa0
+
+	OP_SHA256         = 0xa8
+	OP_HASH160        = 0xa9
+	OP_HASH256        = 0xaa
+	OP_CHECKSIG       = 0xac
+	OP_CHECKSIGVERIFY = 0xad
+
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+)
+
+var opcodeNames = map[byte]string{
+	OP_0: "OP_0", OP_PUSHDATA1: "OP_PUSHDATA1", OP_PUSHDATA2: "OP_PUSHDATA2", OP_1NEGATE: "OP_1NEGATE",
+	OP_NOP: "OP_NOP", OP_IF: "OP_IF", OP_NOTIF: "OP_NOTIF", OP_ELSE: "OP_ELSE", OP_ENDIF: "OP_ENDIF",
+	OP_VERIFY: "OP_VERIFY", OP_RETURN: "OP_RETURN",
+	OP_DROP: "OP_DROP", OP_DUP: "OP_DUP", OP_SWAP: "OP_SWAP", OP_SIZE: "OP_SIZE",
+	OP_EQUAL: "OP_EQUAL", OP_EQUALVERIFY: "OP_EQUALVERIFY", OP_NOT: "OP_NOT", OP_ADD: "OP_ADD", OP_SUB: "OP_SUB",
+	OP_NUMEQUAL: "OP_NUMEQUAL", OP_NUMEQUALVERIFY: "OP_NUMEQUALVERIFY",
+	OP_LESSTHAN: "OP_LESSTHAN", OP_GREATERTHAN: "OP_GREATERTHAN",
+	OP_SHA256: "OP_SHA256", OP_HASH160: "OP_HASH160", OP_HASH256: "OP_HASH256",
+	OP_CHECKSIG: "OP_CHECKSIG", OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG: "OP_CHECKMULTISIG", OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY", OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+// The bounds keeping a script from taking too long or too much memory
+const maxScriptSize = 10000
+const maxScriptOps = 201
+const maxStackSize = 1000
+const maxScriptElementSize = 520
+
+// maxMultisigKeys caps the public keys of an OP_CHECKMULTISIG, each of them
+// counts as an operation
+const maxMultisigKeys = 20
+
+// maxScriptNumSize caps the numbers arithmetic takes, the results may
+// overflow it
+const maxScriptNumSize = 4
+
+// maxLockNumSize caps the locks OP_CHECKLOCKTIMEVERIFY and
+// OP_CHECKSEQUENCEVERIFY take, times don't fit in 4 bytes
+const maxLockNumSize = 5
+
+var errScriptFalse = errors.New("script evaluated to false")
+
+// scriptChecker checks what scripts ask of the transaction they unlock an
+// input of: checkSig whether a signature of it is valid for a public key,
+// checkLockTime and checkSequence whether it and the input are locked for
+// at least as long as the script wants
+type scriptChecker interface {
+	checkSig(sig, pubKey []byte) bool
+	checkLockTime(lockTime int64) bool
+	checkSequence(sequence int64) bool
+}
+
+// scriptEngine runs scripts on a stack. Without a checker, the checks of
+// the transaction fail.
+type scriptEngine struct {
+	stack   [][]byte
+	checker scriptChecker
+	// ops counts the operations the running script went through
+	ops int
+}
+
+// verifyScripts runs the unlocking script of an input, then the locking
+// script of the output it spends
+func verifyScripts(unlocking, locking []byte, checker scriptChecker) error {
+	if !isPushOnly(unlocking) {
+		return errors.New("unlocking script doesn't only push data")
+	}
+
+	vm := &scriptEngine{checker: checker}
+	err := vm.execute(unlocking)
+	if err != nil {
+		return err
+	}
+	// the locking script of a P2SH output only checks the hash, the redeem
+	// script runs on what the unlocking script left under it
+	var unlocked [][]byte
+	if isP2SHScript(locking) {
+		unlocked = append(unlocked, vm.stack...)
+	}
+	err = vm.execute(locking)
+	if err != nil {
+		return err
+	}
+	if len(vm.stack) == 0 || !castToBool(vm.stack[len(vm.stack)-1]) {
+		return errScriptFalse
+	}
+	if !isP2SHScript(locking) {
+		return nil
+	}
+
+	redeem := unlocked[len(unlocked)-1]
+	vm.stack = unlocked[:len(unlocked)-1]
+	err = vm.execute(redeem)
+	if err != nil {
+		return err
+	}
+	if len(vm.stack) == 0 || !castToBool(vm.stack[len(vm.stack)-1]) {
+		return errScriptFalse
+	}
+
+	return nil
+}
+
+// parseOp reads the operation at pc, returning it with the data it pushes
+// and where the next one starts
+func parseOp(script []byte, pc int) (byte, []byte, int, error) {
+	op := script[pc]
+	pc++
+
+	var size int
+	switch {
+	case op > OP_0 && op < OP_PUSHDATA1:
+		size = int(op)
+	case op == OP_PUSHDATA1:
+		if pc+1 > len(script) {
+			return op, nil, pc, errors.New("script ends in OP_PUSHDATA1")
+		}
+		size = int(script[pc])
+		pc++
+	case op == OP_PUSHDATA2:
+		if pc+2 > len(script) {
+			return op, nil, pc, errors.New("script ends in OP_PUSHDATA2")
+		}
+		size = int(binary.LittleEndian.Uint16(script[pc:]))
+		pc += 2
+	default:
+		return op, nil, pc, nil
+	}
+	if pc+size > len(script) {
+		return op, nil, pc, fmt.Errorf("script pushes %d bytes past its end", size)
+	}
+
+	return op, script[pc : pc+size], pc + size, nil
+}
+
+// isPushOnly tells whether a script only pushes data
+func isPushOnly(script []byte) bool {
+	for pc := 0; pc < len(script); {
+		op, _, next, err := parseOp(script, pc)
+		if err != nil || op > OP_16 {
+			return false
+		}
+		pc = next
+	}
+
+	return true
+}
+
+func (vm *scriptEngine) push(data []byte) {
+	vm.stack = append(vm.stack, data)
+}
+
+func (vm *scriptEngine) pop() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, errors.New("script pops an empty stack")
+	}
+	top := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+
+	return top, nil
+}
+
+func (vm *scriptEngine) popNum() (int64, error) {
+	data, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+
+	return decodeScriptNum(data, maxScriptNumSize)
+}
+
+func (vm *scriptEngine) popBool() (bool, error) {
+	data, err := vm.pop()
+	if err != nil {
+		return false, err
+	}
+
+	return castToBool(data), nil
+}
+
+// execute runs a script on the stack of the engine
+func (vm *scriptEngine) execute(script []byte) error {
+	if len(script) > maxScriptSize {
+		return fmt.Errorf("script is %d bytes, the limit is %d", len(script), maxScriptSize)
+	}
+
+	// conds holds whether each branch of the nested OP_IFs runs
+	var conds []bool
+	vm.ops = 0
+	for pc := 0; pc < len(script); {
+		op, data, next, err := parseOp(script, pc)
+		if err != nil {
+			return err
+		}
+		pc = next
+
+		if len(data) > maxScriptElementSize {
+			return fmt.Errorf("script pushes %d bytes, the limit is %d", len(data), maxScriptElementSize)
+		}
+		if op > OP_16 {
+			err = vm.countOps(1)
+			if err != nil {
+				return err
+			}
+		}
+
+		executing := true
+		for _, cond := range conds {
+			executing = executing && cond
+		}
+		// the branches that don't run are still read for their OP_ELSE
+		// and OP_ENDIF
+		switch op {
+		case OP_IF, OP_NOTIF:
+			cond := false
+			if executing {
+				cond, err = vm.popBool()
+				if err != nil {
+					return err
+				}
+				if op == OP_NOTIF {
+					cond = !cond
+				}
+			}
+			conds = append(conds, cond)
+			continue
+		case OP_ELSE:
+			if len(conds) == 0 {
+				return errors.New("script has OP_ELSE without OP_IF")
+			}
+			conds[len(conds)-1] = !conds[len(conds)-1]
+			continue
+		case OP_ENDIF:
+			if len(conds) == 0 {
+				return errors.New("script has OP_ENDIF without OP_IF")
+			}
+			conds = conds[:len(conds)-1]
+			continue
+		}
+		if !executing {
+			continue
+		}
+
+		err = vm.step(op, data)
+		if err != nil {
+			return err
+		}
+		if len(vm.stack) > maxStackSize {
+			return fmt.Errorf("script stack grows over %d items", maxStackSize)
+		}
+	}
+	if len(conds) > 0 {
+		return errors.New("script has OP_IF without OP_ENDIF")
+	}
+
+	return nil
+}
+
+func (vm *scriptEngine) countOps(n int) error {
+	vm.ops += n
+	if vm.ops > maxScriptOps {
+		return fmt.Errorf("script runs more than %d operations", maxScriptOps)
+	}
+
+	return nil
+}
+
+// step runs an operation that isn't flow control
+func (vm *scriptEngine) step(op byte, data []byte) error {
+	switch {
+	case op == OP_0:
+		vm.push(nil)
+		return nil
+	case op < OP_PUSHDATA1 || op == OP_PUSHDATA1 || op == OP_PUSHDATA2:
+		vm.push(data)
+		return nil
+	case op == OP_1NEGATE:
+		vm.push(encodeScriptNum(-1))
+		return nil
+	case op >= OP_1 && op <= OP_16:
+		vm.push(encodeScriptNum(int64(op - OP_1 + 1)))
+		return nil
+	}
+
+	switch op {
+	case OP_NOP:
+	case OP_VERIFY:
+		ok, err := vm.popBool()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("OP_VERIFY failed")
+		}
+	case OP_RETURN:
+		return errors.New("script is unspendable, it runs OP_RETURN")
+
+	case OP_DROP:
+		_, err := vm.pop()
+		return err
+	case OP_DUP:
+		top, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		vm.push(top)
+		vm.push(top)
+	case OP_SWAP:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		vm.push(a)
+		vm.push(b)
+	case OP_SIZE:
+		if len(vm.stack) == 0 {
+			return errors.New("script pops an empty stack")
+		}
+		vm.push(encodeScriptNum(int64(len(vm.stack[len(vm.stack)-1]))))
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if op == OP_EQUALVERIFY {
+			if !bytes.Equal(a, b) {
+				return errors.New("OP_EQUALVERIFY failed")
+			}
+			return nil
+		}
+		vm.push(encodeBool(bytes.Equal(a, b)))
+	case OP_NOT:
+		n, err := vm.popNum()
+		if err != nil {
+			return err
+		}
+		vm.push(encodeBool(n == 0))
+	case OP_ADD, OP_SUB, OP_NUMEQUAL, OP_NUMEQUALVERIFY, OP_LESSTHAN, OP_GREATERTHAN:
+		b, err := vm.popNum()
+		if err != nil {
+			return err
+		}
+		a, err := vm.popNum()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case OP_ADD:
+			vm.push(encodeScriptNum(a + b))
+		case OP_SUB:
+			vm.push(encodeScriptNum(a - b))
+		case OP_NUMEQUAL:
+			vm.push(encodeBool(a == b))
+		case OP_NUMEQUALVERIFY:
+			if a != b {
+				return errors.New("OP_NUMEQUALVERIFY failed")
+			}
+		case OP_LESSTHAN:
+			vm.push(encodeBool(a < b))
+		case OP_GREATERTHAN:
+			vm.push(encodeBool(a > b))
+		}
+
+	case OP_SHA256, OP_HASH160, OP_HASH256:
+		data, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case OP_SHA256:
+			hash := sha256.Sum256(data)
+			vm.push(hash[:])
+		case OP_HASH160:
+			vm.push(HashPubKey(data))
+		case OP_HASH256:
+			first := sha256.Sum256(data)
+			hash := sha256.Sum256(first[:])
+			vm.push(hash[:])
+		}
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		ok := vm.checker != nil && vm.checker.checkSig(sig, pubKey)
+		if op == OP_CHECKSIGVERIFY {
+			if !ok {
+				return errors.New("OP_CHECKSIGVERIFY failed")
+			}
+			return nil
+		}
+		vm.push(encodeBool(ok))
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := vm.checkMultisig()
+		if err != nil {
+			return err
+		}
+		if op == OP_CHECKMULTISIGVERIFY {
+			if !ok {
+				return errors.New("OP_CHECKMULTISIGVERIFY failed")
+			}
+			return nil
+		}
+		vm.push(encodeBool(ok))
+	case OP_CHECKLOCKTIMEVERIFY, OP_CHECKSEQUENCEVERIFY:
+		// the lock stays on the stack, like with the OP_NOPs these were
+		if len(vm.stack) == 0 {
+			return errors.New("script pops an empty stack")
+		}
+		lock, err := decodeScriptNum(vm.stack[len(vm.stack)-1], maxLockNumSize)
+		if err != nil {
+			return err
+		}
+		if lock < 0 {
+			return fmt.Errorf("%s takes a negative lock", opcodeNames[op])
+		}
+		if op == OP_CHECKLOCKTIMEVERIFY {
+			if vm.checker == nil || !vm.checker.checkLockTime(lock) {
+				return errors.New("OP_CHECKLOCKTIMEVERIFY failed")
+			}
+			return nil
+		}
+		// locks with the disable flag are left for later uses
+		if lock&sequenceDisableFlag != 0 {
+			return nil
+		}
+		if vm.checker == nil || !vm.checker.checkSequence(lock) {
+			return errors.New("OP_CHECKSEQUENCEVERIFY failed")
+		}
+
+	default:
+		return fmt.Errorf("script runs unknown opcode 0x%02x", op)
+	}
+
+	return nil
+}
+
+// checkMultisig pops n public keys and m signatures, each with its count
+// on top, and tells whether the signatures are valid for m of the keys.
+// The signatures are in the order of the keys, so each key is tried once.
+// Like in Bitcoin, one more item is popped, which has to be empty.
+func (vm *scriptEngine) checkMultisig() (bool, error) {
+	n, err := vm.popNum()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > maxMultisigKeys {
+		return false, fmt.Errorf("OP_CHECKMULTISIG takes %d keys, the limit is %d", n, maxMultisigKeys)
+	}
+	err = vm.countOps(int(n))
+	if err != nil {
+		return false, err
+	}
+	keys := make([][]byte, n)
+	for i := len(keys) - 1; i >= 0; i-- {
+		keys[i], err = vm.pop()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	m, err := vm.popNum()
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, fmt.Errorf("OP_CHECKMULTISIG takes %d signatures for %d keys", m, n)
+	}
+	sigs := make([][]byte, m)
+	for i := len(sigs) - 1; i >= 0; i-- {
+		sigs[i], err = vm.pop()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	dummy, err := vm.pop()
+	if err != nil {
+		return false, err
+	}
+	if len(dummy) != 0 {
+		return false, errors.New("OP_CHECKMULTISIG pops a dummy item that isn't empty")
+	}
+
+	key := 0
+	for _, sig := range sigs {
+		for key < len(keys) && !(vm.checker != nil && vm.checker.checkSig(sig, keys[key])) {
+			key++
+		}
+		if key == len(keys) {
+			return false, nil
+		}
+		key++
+	}
+
+	return true, nil
+}
+
+// castToBool tells whether stack data is true: anything but zero, negative
+// zero included
+func castToBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			// the sign bit alone is negative zero
+			return !(i == len(data)-1 && b == 0x80)
+		}
+	}
+
+	return false
+}
+
+func encodeBool(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+
+	return nil
+}
+
+// encodeScriptNum encodes a number as the stack holds it: little endian
+// magnitude, with the sign in the top bit of the last byte
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+
+	negative := n < 0
+	magnitude := uint64(n)
+	if negative {
+		magnitude = uint64(-n)
+	}
+	var data []byte
+	for magnitude > 0 {
+		data = append(data, byte(magnitude))
+		magnitude >>= 8
+	}
+	if data[len(data)-1]&0x80 != 0 {
+		data = append(data, 0)
+	}
+	if negative {
+		data[len(data)-1] |= 0x80
+	}
+
+	return data
+}
+
+// decodeScriptNum reads a number of up to maxSize bytes from the stack
+func decodeScriptNum(data []byte, maxSize int) (int64, error) {
+	if len(data) > maxSize {
+		return 0, fmt.Errorf("number of %d bytes is over the %d bytes limit", len(data), maxSize)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	var n int64
+	for i, b := range data {
+		n |= int64(b) << uint(8*i)
+	}
+	last := data[len(data)-1]
+	if last&0x80 != 0 {
+		n &^= int64(0x80) << uint(8*(len(data)-1))
+		n = -n
+	}
+
+	return n, nil
+}
+
+// pushData appends the operation pushing data to a script
+func pushData(script []byte, data []byte) []byte {
+	switch {
+	case len(data) == 0:
+		return append(script, OP_0)
+	case len(data) < OP_PUSHDATA1:
+		script = append(script, byte(len(data)))
+	case len(data) <= 0xff:
+		script = append(script, OP_PUSHDATA1, byte(len(data)))
+	default:
+		script = append(script, OP_PUSHDATA2, byte(len(data)), byte(len(data)>>8))
+	}
+
+	return append(script, data...)
+}
+
+// pushNum appends the operation pushing a number to a script
+func pushNum(script []byte, n int64) []byte {
+	if n == 0 {
+		return append(script, OP_0)
+	}
+	if n == -1 {
+		return append(script, OP_1NEGATE)
+	}
+	if n >= 1 && n <= 16 {
+		return append(script, byte(OP_1+n-1))
+	}
+
+	return pushData(script, encodeScriptNum(n))
+}
+
+// p2pkhScript is the locking script of an output paying a public key hash,
+// the one outputs without a script of their own have
+func p2pkhScript(pubKeyHash []byte) []byte {
+	script := []byte{OP_DUP, OP_HASH160}
+	script = pushData(script, pubKeyHash)
+
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+// p2shScript is the locking script of an output paying the hash of a
+// redeem script
+func p2shScript(scriptHash []byte) []byte {
+	script := pushData([]byte{OP_HASH160}, scriptHash)
+
+	return append(script, OP_EQUAL)
+}
+
+// isP2SHScript tells whether a locking script pays the hash of a redeem
+// script, which has to run too
+func isP2SHScript(script []byte) bool {
+	return len(script) == 23 && script[0] == OP_HASH160 && script[1] == 20 && script[22] == OP_EQUAL
+}
+
+// disassembleScript returns the operations of a script in words
+func disassembleScript(script []byte) string {
+	var words []string
+	for pc := 0; pc < len(script); {
+		op, data, next, err := parseOp(script, pc)
+		if err != nil {
+			words = append(words, "[error]")
+			break
+		}
+		pc = next
+
+		name, ok := opcodeNames[op]
+		switch {
+		case op > OP_0 && op <= OP_PUSHDATA2:
+			words = append(words, hex.EncodeToString(data))
+		case op >= OP_1 && op <= OP_16:
+			words = append(words, fmt.Sprintf("OP_%d", op-OP_1+1))
+		case ok:
+			words = append(words, name)
+		default:
+			words = append(words, fmt.Sprintf("OP_UNKNOWN%d", op))
+		}
+	}
+
+	return strings.Join(words, " ")
+}
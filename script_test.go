@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScriptNum(t *testing.T) {
+	for _, n := range []int64{0, 1, -1, 127, 128, -128, 255, 256, -32768, 1<<31 - 1} {
+		decoded, err := decodeScriptNum(encodeScriptNum(n), 5)
+		require.NoError(t, err)
+		assert.Equal(t, n, decoded)
+	}
+	assert.Equal(t, []byte{0x80, 0x00}, encodeScriptNum(128), "The sign bit gets a byte of its own")
+	assert.False(t, castToBool([]byte{0, 0x80}), "Negative zero is false")
+	assert.True(t, castToBool([]byte{0x80, 0}))
+	_, err := decodeScriptNum([]byte{1, 2, 3, 4, 5}, maxScriptNumSize)
+	assert.Error(t, err)
+}
+
+func TestScriptEngine(t *testing.T) {
+	run := func(unlocking, locking []byte) error {
+		return verifyScripts(unlocking, locking, nil)
+	}
+
+	preimage := []byte("secret")
+	hash := sha256.Sum256(preimage)
+	hashLock := append(pushData([]byte{OP_SHA256}, hash[:]), OP_EQUAL)
+	assert.NoError(t, run(pushData(nil, preimage), hashLock))
+	assert.Equal(t, errScriptFalse, run(pushData(nil, []byte("guess")), hashLock))
+
+	// the branch taken depends on what the unlocking script pushes
+	branches := []byte{OP_IF, OP_2, OP_ELSE, OP_3, OP_ENDIF, OP_3, OP_ADD, OP_5, OP_NUMEQUAL}
+	assert.NoError(t, run([]byte{OP_1}, branches))
+	assert.Equal(t, errScriptFalse, run([]byte{OP_0}, branches))
+	assert.NoError(t, run(nil, []byte{OP_2, OP_3, OP_LESSTHAN, OP_1, OP_1, OP_SUB, OP_NOT, OP_EQUAL}))
+
+	assert.Error(t, run(nil, []byte{OP_1, OP_IF, OP_1}), "OP_IF needs an OP_ENDIF")
+	assert.Error(t, run(nil, []byte{OP_1, OP_RETURN}))
+	assert.Error(t, run(nil, []byte{OP_DROP}), "Popping an empty stack fails")
+	assert.Error(t, run([]byte{OP_1, OP_DUP}, []byte{OP_1}), "Unlocking scripts only push data")
+	assert.Error(t, run(nil, []byte{OP_1, 0xff}), "Unknown opcodes fail")
+	assert.NoError(t, run(nil, []byte{OP_1, OP_0, OP_IF, 0xff, OP_ENDIF}), "Unknown opcodes in branches not taken don't run")
+	assert.Error(t, run(nil, []byte{OP_PUSHDATA1, 10, 1}), "Pushes can't go past the end")
+
+	tooLong := []byte{OP_1}
+	for i := 0; i <= maxScriptOps; i++ {
+		tooLong = append(tooLong, OP_NOP)
+	}
+	assert.Error(t, run(nil, tooLong), "Scripts are bounded")
+
+	assert.Equal(t, "OP_DUP OP_HASH160 0102 OP_EQUALVERIFY OP_CHECKSIG", disassembleScript(p2pkhScript([]byte{1, 2})))
+
+	// P2SH runs the redeem script once its hash matches
+	p2sh := p2shScript(HashPubKey(hashLock))
+	require.True(t, isP2SHScript(p2sh))
+	assert.NoError(t, run(pushData(pushData(nil, preimage), hashLock), p2sh))
+	assert.Equal(t, errScriptFalse, run(pushData(pushData(nil, []byte("guess")), hashLock), p2sh))
+	assert.Equal(t, errScriptFalse, run(pushData(pushData(nil, preimage), []byte{OP_1}), p2sh), "The redeem script has to match the hash")
+	assert.Error(t, run(nil, p2sh))
+}
+
+func TestScriptLocks(t *testing.T) {
+	run := func(lockTime int64, sequence uint32, locking []byte) error {
+		tx := &Transaction{nil, []TXInput{{nil, 0, nil, nil, nil, sequence}}, nil, false, lockTime}
+		return verifyScripts(nil, locking, &inputChecker{tx: tx})
+	}
+	cltv := func(lock int64) []byte {
+		return append(pushNum(nil, lock), OP_CHECKLOCKTIMEVERIFY)
+	}
+	csv := func(lock int64) []byte {
+		return append(pushNum(nil, lock), OP_CHECKSEQUENCEVERIFY)
+	}
+
+	assert.NoError(t, run(100, 0, cltv(100)))
+	assert.NoError(t, run(150, 0, cltv(100)))
+	assert.Error(t, run(99, 0, cltv(100)), "The transaction is locked for less long")
+	assert.Error(t, run(lockTimeThreshold+100, 0, cltv(100)), "Times don't satisfy heights")
+	assert.NoError(t, run(lockTimeThreshold+100, 0, cltv(lockTimeThreshold+100)), "Times take 5 bytes")
+	assert.Error(t, run(100, 0, cltv(-1)))
+	assert.Error(t, run(100, 0, []byte{OP_CHECKLOCKTIMEVERIFY}))
+
+	assert.NoError(t, run(0, 10, csv(10)))
+	assert.Error(t, run(0, 9, csv(10)), "The input is locked for less long")
+	assert.Error(t, run(0, sequenceDisableFlag|10, csv(10)), "The input isn't locked")
+	assert.Error(t, run(0, 10, csv(sequenceTypeFlag|10)), "Blocks don't satisfy times")
+	assert.NoError(t, run(0, sequenceTypeFlag|10, csv(sequenceTypeFlag|5)))
+	assert.NoError(t, run(0, 0, csv(sequenceDisableFlag)), "Locks with the disable flag pass")
+
+	assert.Equal(t, "OP_16 OP_CHECKLOCKTIMEVERIFY", disassembleScript(cltv(16)))
+}
+
+func TestScriptOutputs(t *testing.T) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(dir)
+	activeNet = &regTestParams
+	defer func() { activeNet = &mainNetParams }()
+
+	wallet := NewWallet("")
+	address := string(wallet.getAddress())
+	bc := CreateBlockchain(address, "0")
+	defer bc.db.Close()
+	utxoSet := UTXOSet{bc}
+	utxoSet.reindex()
+	funding, err := bc.getBlock(bc.getTip())
+	require.NoError(t, err)
+	pool := NewTxPool(maxMempoolSize, mempoolExpiry)
+
+	// lock the coins with a script anyone knowing the preimage unlocks
+	preimage := []byte("secret")
+	hash := sha256.Sum256(preimage)
+	hashLock := append(pushData([]byte{OP_SHA256}, hash[:]), OP_EQUAL)
+	coinbase := funding.Transactions[0]
+	locked := &Transaction{nil, []TXInput{{coinbase.ID, 0, nil, wallet.PublicKey, nil, 0}}, []TXOutput{{activeNet.Subsidy - 1, nil, hashLock}}, false, 0}
+	locked.ID = locked.hash()
+	bc.signTransaction(locked, wallet.PrivateKey, nil)
+	require.NoError(t, pool.add(locked, bc))
+
+	unlock := func(data []byte) *Transaction {
+		tx := &Transaction{nil, []TXInput{{locked.ID, 0, nil, nil, nil, 0}}, []TXOutput{*NewTXOutput(activeNet.Subsidy-2, address)}, false, 0}
+		// the ID is taken before the inputs are unlocked, like before they're signed
+		tx.ID = tx.hash()
+		tx.Vin[0].ScriptSig = pushData(nil, data)
+		return tx
+	}
+	assert.Error(t, pool.add(unlock([]byte("guess")), bc))
+	require.NoError(t, pool.add(unlock(preimage), bc))
+
+	// the P2PKH template checks the key hash too
+	stolen := &Transaction{nil, []TXInput{{coinbase.ID, 0, nil, NewWallet("").PublicKey, nil, 0}}, []TXOutput{*NewTXOutput(1, address)}, false, 0}
+	stolen.ID = stolen.hash()
+	bc.signTransaction(stolen, wallet.PrivateKey, nil)
+	assert.False(t, bc.verifyTransaction(stolen, nil))
+}
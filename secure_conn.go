@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The encrypted transport follows the Noise XX pattern: both sides send an
+// ephemeral X25519 key, then their static node key encrypted under the
+// ephemeral secret. Each side proves it owns its static key through the DH
+// results mixed into the session keys, so a peer that can't decrypt the
+// traffic also can't pretend to be someone else.
+
+const nodeKeyFile = "nodekey_%s.dat"
+const handshakeName = "Noise_XX_25519_ChaChaPoly_SHA256"
+const handshakeTimeout = 10 * time.Second
+const maxFrameLength = 65535
+const maxFramePayload = maxFrameLength - chacha20poly1305.Overhead
+
+// LoadNodeKey reads the static key of a node, generating it on first use
+func LoadNodeKey(nodeID string) *ecdh.PrivateKey {
+	nodeKeyFile := fmt.Sprintf(nodeKeyFile, nodeID)
+
+	raw, err := ioutil.ReadFile(nodeKeyFile)
+	if err == nil {
+		key, err := ecdh.X25519().NewPrivateKey(raw)
+		if err != nil {
+			log.Panic(err)
+		}
+		return key
+	}
+	if !os.IsNotExist(err) {
+		log.Panic(err)
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = ioutil.WriteFile(nodeKeyFile, key.Bytes(), 0600)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return key
+}
+
+// LoadAllowedKeys reads hex encoded node public keys, one per line;
+// empty lines and lines starting with # are skipped
+func LoadAllowedKeys(path string) (map[string]bool, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("invalid node key %q", line)
+		}
+		keys[hex.EncodeToString(key)] = true
+	}
+
+	return keys, nil
+}
+
+// secureConn encrypts a connection with the keys agreed in the handshake.
+// Data travels in frames of a 2 byte length followed by the sealed payload.
+type secureConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	sendKey   *cipherState
+	recvKey   *cipherState
+	remoteKey []byte
+	readBuf   []byte
+}
+
+// SecureClient runs the initiator side of the handshake on a dialed connection.
+// When allowed isn't nil the remote key has to be one of its hex encoded keys.
+func SecureClient(conn net.Conn, key *ecdh.PrivateKey, allowed map[string]bool) (*secureConn, error) {
+	return handshake(conn, key, allowed, true)
+}
+
+// SecureServer runs the responder side of the handshake on an accepted connection
+func SecureServer(conn net.Conn, key *ecdh.PrivateKey, allowed map[string]bool) (*secureConn, error) {
+	return handshake(conn, key, allowed, false)
+}
+
+// RemoteKey returns the static key the peer authenticated with
+func (sc *secureConn) RemoteKey() []byte {
+	return sc.remoteKey
+}
+
+func (sc *secureConn) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxFramePayload {
+			n = maxFramePayload
+		}
+		err := writeFrame(sc.Conn, sc.sendKey.encrypt(nil, data[:n]))
+		if err != nil {
+			return written, err
+		}
+		written += n
+		data = data[n:]
+	}
+
+	return written, nil
+}
+
+func (sc *secureConn) Read(data []byte) (int, error) {
+	for len(sc.readBuf) == 0 {
+		frame, err := readFrame(sc.reader)
+		if err != nil {
+			return 0, err
+		}
+		sc.readBuf, err = sc.recvKey.decrypt(nil, frame)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(data, sc.readBuf)
+	sc.readBuf = sc.readBuf[n:]
+
+	return n, nil
+}
+
+func handshake(conn net.Conn, key *ecdh.PrivateKey, allowed map[string]bool, initiator bool) (*secureConn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	hs := newHandshakeState()
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var remoteEphemeral, remoteStatic *ecdh.PublicKey
+	if initiator {
+		// -> e
+		hs.mixHash(ephemeral.PublicKey().Bytes())
+		err = writeFrame(conn, ephemeral.PublicKey().Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		// <- e, ee, s, es
+		msg, err := readFrame(reader)
+		if err != nil {
+			return nil, err
+		}
+		remoteEphemeral, remoteStatic, err = hs.readEphemeralAndStatic(msg, ephemeral)
+		if err != nil {
+			return nil, err
+		}
+
+		// -> s, se
+		err = writeFrame(conn, hs.writeStatic(key, remoteEphemeral))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// -> e
+		msg, err := readFrame(reader)
+		if err != nil {
+			return nil, err
+		}
+		remoteEphemeral, err = ecdh.X25519().NewPublicKey(msg)
+		if err != nil {
+			return nil, err
+		}
+		hs.mixHash(msg)
+
+		// <- e, ee, s, es
+		hs.mixHash(ephemeral.PublicKey().Bytes())
+		err = hs.mixDH(ephemeral, remoteEphemeral)
+		if err != nil {
+			return nil, err
+		}
+		reply := append(ephemeral.PublicKey().Bytes(), hs.writeStatic(key, remoteEphemeral)...)
+		err = writeFrame(conn, reply)
+		if err != nil {
+			return nil, err
+		}
+
+		// -> s, se
+		msg, err = readFrame(reader)
+		if err != nil {
+			return nil, err
+		}
+		remoteStatic, err = hs.readStatic(msg, ephemeral)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	remoteKey := remoteStatic.Bytes()
+	if allowed != nil && !allowed[hex.EncodeToString(remoteKey)] {
+		return nil, fmt.Errorf("node key %x is not allowed", remoteKey)
+	}
+
+	first, second := hs.split()
+	sc := &secureConn{Conn: conn, reader: reader, remoteKey: remoteKey}
+	if initiator {
+		sc.sendKey, sc.recvKey = first, second
+	} else {
+		sc.sendKey, sc.recvKey = second, first
+	}
+
+	return sc, nil
+}
+
+// handshakeState carries the chaining key and the transcript hash of a handshake
+type handshakeState struct {
+	ck []byte
+	h  []byte
+	cs *cipherState
+}
+
+func newHandshakeState() *handshakeState {
+	h := sha256.Sum256([]byte(handshakeName))
+
+	return &handshakeState{ck: h[:], h: h[:]}
+}
+
+func (hs *handshakeState) mixHash(data []byte) {
+	h := sha256.Sum256(append(append([]byte{}, hs.h...), data...))
+	hs.h = h[:]
+}
+
+// mixDH feeds a DH result into the chaining key and rekeys the handshake cipher
+func (hs *handshakeState) mixDH(private *ecdh.PrivateKey, public *ecdh.PublicKey) error {
+	secret, err := private.ECDH(public)
+	if err != nil {
+		return err
+	}
+
+	ck, k := hkdfPair(hs.ck, secret)
+	hs.ck = ck
+	hs.cs = newCipherState(k)
+
+	return nil
+}
+
+func (hs *handshakeState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := hs.cs.encrypt(hs.h, plaintext)
+	hs.mixHash(ciphertext)
+
+	return ciphertext
+}
+
+func (hs *handshakeState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := hs.cs.decrypt(hs.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	hs.mixHash(ciphertext)
+
+	return plaintext, nil
+}
+
+// writeStatic encrypts our static key and mixes in its DH with the remote ephemeral key
+func (hs *handshakeState) writeStatic(key *ecdh.PrivateKey, remoteEphemeral *ecdh.PublicKey) []byte {
+	ciphertext := hs.encryptAndHash(key.PublicKey().Bytes())
+	err := hs.mixDH(key, remoteEphemeral)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return ciphertext
+}
+
+// readStatic decrypts the remote static key and mixes in its DH with our ephemeral key
+func (hs *handshakeState) readStatic(ciphertext []byte, ephemeral *ecdh.PrivateKey) (*ecdh.PublicKey, error) {
+	plaintext, err := hs.decryptAndHash(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	remoteStatic, err := ecdh.X25519().NewPublicKey(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	err = hs.mixDH(ephemeral, remoteStatic)
+	if err != nil {
+		return nil, err
+	}
+
+	return remoteStatic, nil
+}
+
+// readEphemeralAndStatic handles the responder's message on the initiator side
+func (hs *handshakeState) readEphemeralAndStatic(msg []byte, ephemeral *ecdh.PrivateKey) (*ecdh.PublicKey, *ecdh.PublicKey, error) {
+	keyLen := len(ephemeral.PublicKey().Bytes())
+	if len(msg) < keyLen {
+		return nil, nil, errors.New("handshake message is too short")
+	}
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(msg[:keyLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.mixHash(msg[:keyLen])
+	err = hs.mixDH(ephemeral, remoteEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remoteStatic, err := hs.readStatic(msg[keyLen:], ephemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return remoteEphemeral, remoteStatic, nil
+}
+
+// split derives the two transport keys, the first one for initiator to responder traffic
+func (hs *handshakeState) split() (*cipherState, *cipherState) {
+	k1, k2 := hkdfPair(hs.ck, nil)
+
+	return newCipherState(k1), newCipherState(k2)
+}
+
+// cipherState is an AEAD key with its message counter as nonce
+type cipherState struct {
+	key   []byte
+	nonce uint64
+}
+
+func newCipherState(key []byte) *cipherState {
+	return &cipherState{key: key}
+}
+
+func (cs *cipherState) nextNonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	cs.nonce++
+
+	return nonce
+}
+
+func (cs *cipherState) encrypt(ad, plaintext []byte) []byte {
+	aead, err := chacha20poly1305.New(cs.key)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return aead.Seal(nil, cs.nextNonce(), plaintext, ad)
+}
+
+func (cs *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(cs.key)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return aead.Open(nil, cs.nextNonce(), ciphertext, ad)
+}
+
+func hkdfPair(ck, input []byte) ([]byte, []byte) {
+	kdf := hkdf.New(sha256.New, input, ck, nil)
+	out := make([]byte, 64)
+	_, err := io.ReadFull(kdf, out)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return out[:32], out[32:]
+}
+
+func writeFrame(w io.Writer, data []byte) error {
+	if len(data) > maxFrameLength {
+		return errors.New("frame is too long")
+	}
+
+	var frame bytes.Buffer
+	binary.Write(&frame, binary.BigEndian, uint16(len(data)))
+	frame.Write(data)
+	_, err := w.Write(frame.Bytes())
+
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var length uint16
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, length)
+	_, err = io.ReadFull(r, frame)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return frame, err
+}
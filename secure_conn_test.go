@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestKey(t *testing.T) *ecdh.PrivateKey {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	return key
+}
+
+// secureExchange sends data from a client to a server over an encrypted pipe
+func secureExchange(t *testing.T, clientKey, serverKey *ecdh.PrivateKey, allowed map[string]bool, data []byte) ([]byte, []byte, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		defer client.Close()
+		sc, err := SecureClient(client, clientKey, allowed)
+		if err == nil {
+			_, err = sc.Write(data)
+		}
+		done <- err
+	}()
+
+	sc, err := SecureServer(server, serverKey, allowed)
+	if err != nil {
+		return nil, nil, err
+	}
+	received, err := ioutil.ReadAll(sc)
+	assert.NoError(t, err)
+	assert.NoError(t, <-done)
+
+	return received, sc.RemoteKey(), nil
+}
+
+func TestSecureConn(t *testing.T) {
+	clientKey := newTestKey(t)
+	serverKey := newTestKey(t)
+
+	data := make([]byte, 3*maxFramePayload+17)
+	rand.Read(data)
+
+	received, remoteKey, err := secureExchange(t, clientKey, serverKey, nil, data)
+	assert.NoError(t, err)
+	assert.Equal(t, data, received, "Data survives the encrypted transport")
+	assert.Equal(t, clientKey.PublicKey().Bytes(), remoteKey, "Server learns the client's node key")
+}
+
+func TestSecureConnAllowList(t *testing.T) {
+	clientKey := newTestKey(t)
+	serverKey := newTestKey(t)
+
+	allowed := map[string]bool{
+		hex.EncodeToString(clientKey.PublicKey().Bytes()): true,
+		hex.EncodeToString(serverKey.PublicKey().Bytes()): true,
+	}
+	_, _, err := secureExchange(t, clientKey, serverKey, allowed, []byte("hello"))
+	assert.NoError(t, err, "Listed keys are accepted")
+
+	allowed = map[string]bool{
+		hex.EncodeToString(serverKey.PublicKey().Bytes()): true,
+	}
+	_, _, err = secureExchange(t, clientKey, serverKey, allowed, []byte("hello"))
+	assert.Error(t, err, "Unlisted keys are rejected")
+}
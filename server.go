@@ -6,28 +6,103 @@ import (
 	"io"
 	"log"
 	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
-	"io/ioutil"
 	"encoding/hex"
+	"sync"
+	"time"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-const protocol = "tcp"
 //const dnsNodeID = "3000"
-const nodeVersion = 1
+const nodeVersion = 2
+const compactBlocksVersion = 2
 const commandLength = 12
+const peersSaveInterval = time.Minute
+const mempoolSaveInterval = time.Minute
+const maxOutboundPeers = 8
+const maxInvItems = 50000
+
+// Server is a node of the network: its chain and mempool, the peers it
+// knows about and the transport it talks to them over
+type Server struct {
+	nodeID        string
+	nodeAddress   string
+	miningAddress string
+	connectOnly   bool
+	bc            *Blockchain
+	// spv is the header chain of a light client, which has no bc
+	spv           *SPVChain
+	transport     Transport
+	addrManager   *AddrManager
+	bans          *BanList
+	banTime       time.Duration
+	metrics       *Metrics
+
+	knownNodes      []string
+	// nodesMutex guards knownNodes, read them with getKnownNodes
+	nodesMutex      sync.Mutex
+	blocksInTransit [][]byte
+	requestedBlocks map[string]bool
+	// requestedMutex guards the blocks in transit and the requested ones
+	requestedMutex  sync.Mutex
+	partialBlocks   map[string]*partialBlock
+	partialMutex    sync.Mutex
+	mempool         *TxPool
+	orphans         *OrphanPool
+	feeEstimator    *FeeEstimator
+	peers           map[string]*Peer
+	// identities is keyed on peer IDs, see peerID
+	identities      map[string]*identity
+	peersMutex      sync.Mutex
+}
+
+// NewServer sets up a node on a blockchain without contacting anyone yet.
+// A server that doesn't listen, like the one the CLI sends transactions
+// with, has no address of its own.
+func NewServer(config ServerConfig, bc *Blockchain, transport Transport) *Server {
+	server := &Server{
+		nodeID:          config.NodeID,
+		miningAddress:   config.MinerAddress,
+		connectOnly:     len(config.Connect) > 0,
+		bc:              bc,
+		transport:       transport,
+		addrManager:     NewAddrManager(config.NodeID),
+		bans:            NewBanList(config.NodeID),
+		banTime:         config.BanTime,
+		metrics:         NewMetrics(),
+		requestedBlocks: make(map[string]bool),
+		partialBlocks:   make(map[string]*partialBlock),
+		mempool:         NewTxPool(maxMempoolSize, mempoolExpiry),
+		orphans:         NewOrphanPool(maxOrphans, orphanExpiry),
+		feeEstimator:    NewFeeEstimator(),
+		peers:           make(map[string]*Peer),
+		identities:      make(map[string]*identity),
+	}
+	if server.banTime == 0 {
+		server.banTime = defaultBanTime
+	}
+	if config.ListenAddr != "" {
+		address, err := config.advertisedAddress()
+		if err != nil {
+			log.Panic(err)
+		}
+		server.nodeAddress = address
+	}
 
-var nodeAddress string
-var miningAddress string
-var knownNodes = []string{"localhost:3000"}
-var blocksInTransit = [][]byte{}
-var mempool = make(map[string]Transaction)
+	return server
+}
 
 type addr struct {
+	AddrFrom string
 	AddrList []string
 }
 
 type tx struct {
-	AddFrom     string
+	AddrFrom    string
 	Transaction []byte
 }
 
@@ -35,12 +110,25 @@ type verzion struct {
 	Version  int
 	BestHeight int
 	AddrFrom string
+	// Light is set by light clients, they have no blocks to share
+	Light bool
 }
 
 type getblocks struct {
 	AddrFrom string
 }
 
+type getheaders struct {
+	AddrFrom string
+	// Locator lists the hashes of the best chain of the sender, newest first
+	Locator [][]byte
+}
+
+type headers struct {
+	AddrFrom string
+	Headers  []BlockHeader
+}
+
 type inv struct {
 	AddrFrom string
 	Type  string
@@ -58,6 +146,88 @@ type getdata struct {
 	ID       []byte
 }
 
+type notfound struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
+type cmpctblock struct {
+	AddrFrom string
+	Block    []byte
+}
+
+type getblocktxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Indexes   []int
+}
+
+type blocktxn struct {
+	AddrFrom     string
+	BlockHash    []byte
+	Transactions [][]byte
+}
+
+type merkleblock struct {
+	AddrFrom string
+	Block    []byte
+}
+
+type filterload struct {
+	AddrFrom string
+	Filter   BloomFilter
+}
+
+type filteradd struct {
+	AddrFrom string
+	Data     []byte
+}
+
+type filterclear struct {
+	AddrFrom string
+}
+
+type getcfilters struct {
+	AddrFrom    string
+	StartHeight int
+	StopHash    []byte
+}
+
+type cfilters struct {
+	AddrFrom string
+	StopHash []byte
+	Filters  []BlockFilter
+}
+
+type getcfheaders struct {
+	AddrFrom    string
+	StartHeight int
+	StopHash    []byte
+}
+
+type cfheaders struct {
+	AddrFrom string
+	StopHash []byte
+	// PrevHeader is the filter header of the block before StartHeight
+	PrevHeader   []byte
+	FilterHashes [][]byte
+}
+
+type mempoolreq struct {
+	AddrFrom string
+}
+
+type ping struct {
+	AddrFrom string
+	Nonce    uint64
+}
+
+type pong struct {
+	AddrFrom string
+	Nonce    uint64
+}
+
 func CommandToBytes(command string) []byte {
 	var bytes [commandLength]byte
 	for i, c := range command {
@@ -81,52 +251,52 @@ func ExtractCommand(request []byte) []byte {
 	return request[:commandLength]
 }
 
-func RequestBlocks() {
-	for _, node := range knownNodes {
-		SendGetBlocks(node)
+func (server *Server) RequestBlocks() {
+	for _, node := range server.getKnownNodes() {
+		server.SendGetBlocks(node)
 	}
 }
 
-func SendAddr(address string) {
-	nodes := addr{knownNodes}
-	nodes.AddrList = append(nodes.AddrList,nodeAddress)
+func (server *Server) SendAddr(address string) {
+	nodes := addr{server.nodeAddress, server.addrManager.getAddresses(maxAddrPerMessage - 1)}
+	nodes.AddrList = append(nodes.AddrList,server.nodeAddress)
+	server.sendAddrList(address, nodes)
+}
+
+func (server *Server) sendAddrList(address string, nodes addr) {
 	payload := GobEncode(nodes)
 	request := append(CommandToBytes("addr"),payload...)
-	SendData(address,request)
+	server.SendData(address,request)
 }
 
-func SendData(addr string, data []byte) {
+func (server *Server) SendData(addr string, data []byte) {
 	fmt.Printf("SendData addr is %s \n", addr)
-	conn, err := net.Dial(protocol,addr)
+	conn, err := server.transport.Dial(addr)
+	server.addrManager.markAttempt(addr, err == nil)
 	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
-
-		for _, node := range knownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
-
-		knownNodes = updatedNodes
+		fmt.Printf("%s is not available: %s\n", addr, err)
+		server.removeNode(addr)
 
 		return
 	}
 	defer conn.Close()
 	fmt.Printf("send data: %x\n", data)
-	_, err = io.Copy(conn,bytes.NewReader(data))
+	message := append(append([]byte{}, activeNet.magic()...), data...)
+	_, err = io.Copy(conn,bytes.NewReader(message))
 	if err != nil {
-		log.Panic(err)
+		// a peer going away while we write is no reason to stop the node
+		fmt.Printf("Failed to send to %s: %s\n", addr, err)
+		server.addrManager.markAttempt(addr, false)
 	}
 }
 
-func SendVersion(addr string, bc *Blockchain) {
-	bestHeight := bc.getBestHeight()
-	payload := GobEncode(verzion{nodeVersion, bestHeight,nodeAddress})
+func (server *Server) SendVersion(addr string) {
+	bestHeight := server.getBestHeight()
+	payload := GobEncode(verzion{nodeVersion, bestHeight,server.nodeAddress, server.spv != nil})
 
 	request := append(CommandToBytes("version"), payload...)
 
-	SendData(addr, request)
+	server.SendData(addr, request)
 
 }
 
@@ -136,78 +306,359 @@ func SendVersion(addr string, bc *Blockchain) {
 //	SendData(addr,request)
 //}
 
-func SendInv(address, kind string, items [][]byte) {
-	inventory := inv{nodeAddress, kind,items}
+func (server *Server) SendInv(address, kind string, items [][]byte) {
+	for _, item := range items {
+		server.markInventoryKnown(address, item)
+	}
+	inventory := inv{server.nodeAddress, kind,items}
 	payload := GobEncode(inventory)
 
 	request := append(CommandToBytes("inv"),payload...)
 
-	SendData(address,request)
+	server.SendData(address,request)
+}
+
+// RelayTransaction announces a transaction to every peer that doesn't have
+// it yet, except the one it came from. Light clients only hear about the
+// transactions matching their filter.
+func (server *Server) RelayTransaction(tx *Transaction, except string) {
+	for _, node := range server.getKnownNodes() {
+		if node == server.nodeAddress || node == except || server.peerKnowsInventory(node, tx.ID) {
+			continue
+		}
+		if server.peerWantsTransaction(node, tx) {
+			server.SendInv(node, "tx", [][]byte{tx.ID})
+		}
+	}
+}
+
+// RelayBlock announces a block to every peer that doesn't have it yet,
+// sending it compact to the peers that understand it. Light clients get
+// an inv to ask for the merkle block.
+func (server *Server) RelayBlock(b *Block, except string) {
+	for _, node := range server.getKnownNodes() {
+		if node == server.nodeAddress || node == except || server.peerKnowsInventory(node, b.Hash) {
+			continue
+		}
+		if server.peerSupportsCompactBlocks(node) && !server.peerHasFilter(node) {
+			server.SendCompactBlock(node, b)
+		} else {
+			server.SendInv(node, "block", [][]byte{b.Hash})
+		}
+	}
+}
+
+func (server *Server) SendCompactBlock(address string, b *Block) {
+	server.markInventoryKnown(address, b.Hash)
+	data := cmpctblock{server.nodeAddress, NewCompactBlock(b).Serialize()}
+	payload := GobEncode(data)
+	request := append(CommandToBytes("cmpctblock"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendGetBlockTxn(address string, blockHash []byte, indexes []int) {
+	payload := GobEncode(getblocktxn{server.nodeAddress, blockHash, indexes})
+	request := append(CommandToBytes("getblocktxn"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendBlockTxn(address string, blockHash []byte, txs []*Transaction) {
+	var data [][]byte
+	for _, tx := range txs {
+		data = append(data, tx.serialize())
+	}
+	payload := GobEncode(blocktxn{server.nodeAddress, blockHash, data})
+	request := append(CommandToBytes("blocktxn"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendMerkleBlock(address string, mb *MerkleBlock) {
+	payload := GobEncode(merkleblock{server.nodeAddress, mb.Serialize()})
+	request := append(CommandToBytes("merkleblock"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendFilterLoad(address string, filter *BloomFilter) {
+	payload := GobEncode(filterload{server.nodeAddress, *filter})
+	request := append(CommandToBytes("filterload"), payload...)
+
+	server.SendData(address, request)
 }
 
-func SendBlock(address string, b *Block) {
-	data := block{nodeAddress, b.Serialize()}
+func (server *Server) SendFilterAdd(address string, data []byte) {
+	payload := GobEncode(filteradd{server.nodeAddress, data})
+	request := append(CommandToBytes("filteradd"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendFilterClear(address string) {
+	payload := GobEncode(filterclear{server.nodeAddress})
+	request := append(CommandToBytes("filterclear"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendGetCFilters(address string, startHeight int, stopHash []byte) {
+	payload := GobEncode(getcfilters{server.nodeAddress, startHeight, stopHash})
+	request := append(CommandToBytes("getcfilters"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendCFilters(address string, stopHash []byte, filters []BlockFilter) {
+	payload := GobEncode(cfilters{server.nodeAddress, stopHash, filters})
+	request := append(CommandToBytes("cfilters"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendGetCFHeaders(address string, startHeight int, stopHash []byte) {
+	payload := GobEncode(getcfheaders{server.nodeAddress, startHeight, stopHash})
+	request := append(CommandToBytes("getcfheaders"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendCFHeaders(address string, stopHash, prevHeader []byte, filterHashes [][]byte) {
+	payload := GobEncode(cfheaders{server.nodeAddress, stopHash, prevHeader, filterHashes})
+	request := append(CommandToBytes("cfheaders"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendBlock(address string, b *Block) {
+	data := block{server.nodeAddress, b.Serialize()}
 	payload := GobEncode(data)
 	request := append(CommandToBytes("block"),payload...)
 
-	SendData(address,request)
+	server.SendData(address,request)
 }
 
-func SendTx(addr string, tnx *Transaction) {
-	data := tx{nodeAddress,tnx.serialize()}
+func (server *Server) SendTx(addr string, tnx *Transaction) {
+	data := tx{server.nodeAddress,tnx.serialize()}
 	payload := GobEncode(data)
 	request := append(CommandToBytes("tx"),payload...)
 
-	SendData(addr,request)
+	server.SendData(addr,request)
 }
 
-func SendGetData(address, kind string, id []byte) {
-	payload := GobEncode(getdata{nodeAddress,kind,id})
+func (server *Server) SendGetData(address, kind string, id []byte) {
+	if kind == "block" {
+		server.requestedMutex.Lock()
+		server.requestedBlocks[hex.EncodeToString(id)] = true
+		server.requestedMutex.Unlock()
+	}
+
+	payload := GobEncode(getdata{server.nodeAddress,kind,id})
 	request := append(CommandToBytes("getdata"),payload...)
 
-	SendData(address,request)
+	server.SendData(address,request)
 }
 
-func SendGetBlocks(address string) {
-	payload := GobEncode(getblocks{nodeAddress})
+// SendNotFound tells a peer we can't answer its getdata
+func (server *Server) SendNotFound(address, kind string, id []byte) {
+	payload := GobEncode(notfound{server.nodeAddress, kind, id})
+	request := append(CommandToBytes("notfound"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendGetBlocks(address string) {
+	payload := GobEncode(getblocks{server.nodeAddress})
 	fmt.Printf("SendGetBlocks is %s\n",payload)
 	request := append(CommandToBytes("getblocks"),payload...)
-	SendData(address,request)
+	server.SendData(address,request)
 }
 
-func HandleConnection(conn net.Conn, bc *Blockchain) {
-	request, err := ioutil.ReadAll(conn)
-	if err != nil {
-		log.Panic(err)
+// SendGetHeaders asks a peer for the headers following our best chain
+func (server *Server) SendGetHeaders(address string) {
+	payload := GobEncode(getheaders{server.nodeAddress, server.spv.locator()})
+	request := append(CommandToBytes("getheaders"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendHeaders(address string, blockHeaders []BlockHeader) {
+	payload := GobEncode(headers{server.nodeAddress, blockHeaders})
+	request := append(CommandToBytes("headers"), payload...)
+
+	server.SendData(address, request)
+}
+
+func (server *Server) SendMempool(address string) {
+	payload := GobEncode(mempoolreq{server.nodeAddress})
+	request := append(CommandToBytes("mempool"),payload...)
+
+	server.SendData(address,request)
+}
+
+func (server *Server) SendPing(address string, nonce uint64) {
+	payload := GobEncode(ping{server.nodeAddress, nonce})
+	request := append(CommandToBytes("ping"),payload...)
+
+	server.SendData(address,request)
+}
+
+func (server *Server) SendPong(address string, nonce uint64) {
+	payload := GobEncode(pong{server.nodeAddress, nonce})
+	request := append(CommandToBytes("pong"),payload...)
+
+	server.SendData(address,request)
+}
+
+func (server *Server) HandleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	// hosts banned with setban don't get to send anything
+	if server.isBanned(normalizeAddress(remoteHost(conn))) {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	request, err := readMessage(conn)
+	switch err {
+	case nil:
+		defer releaseMessage(request)
+	case errMessageTooLarge:
+		server.metrics.limitReached("message_size", "message from %s is over %d bytes", conn.RemoteAddr(), maxMessageSize)
+		server.misbehaving(peerID(conn, ""), scoreMalformed, err.Error())
+		return
+	case errBufferFull:
+		server.metrics.limitReached("buffered_bytes", "dropping message from %s, %d bytes buffered", conn.RemoteAddr(), maxBufferedBytes)
+		return
+	default:
+		fmt.Printf("Failed to read from %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	magic := activeNet.magic()
+	if len(request) < len(magic)+commandLength {
+		server.misbehaving(peerID(conn, ""), scoreMalformed, "message is too short")
+		return
+	}
+	// nodes of other networks have nothing to tell us
+	if !bytes.Equal(request[:len(magic)], magic) {
+		fmt.Printf("Dropping a message from %s, it's from another network\n", conn.RemoteAddr())
+		return
+	}
+	request = request[len(magic):]
+
+	// every message carries the address of its sender, fall back to the
+	// connection's host when it can't be decoded
+	from := senderAddress(request)
+	// scores, bans and limits go by the node key of the peer or the address
+	// it advertises, peers sharing a host don't answer for each other
+	id := peerID(conn, from)
+	if server.isBanned(id) {
+		return
+	}
+	if from == "" {
+		from = remoteHost(conn)
 	}
+	// the encrypted transport tells us which node key the peer has
+	if sc, ok := conn.(interface{ RemoteKey() []byte }); ok && sc.RemoteKey() != nil {
+		server.setPeerKey(from, sc.RemoteKey())
+	}
+	if !server.allowMessage(id) {
+		server.metrics.limitReached("message_rate", "%s sends over %d messages per second", id, messageRate)
+		server.misbehaving(id, scoreFlooding, "message rate exceeded")
+		return
+	}
+	if !server.startRequest(id) {
+		server.metrics.limitReached("inflight", "%s has %d messages being handled", id, maxInflightPerPeer)
+		server.misbehaving(id, scoreFlooding, "too many messages in flight")
+		return
+	}
+	defer server.finishRequest(id)
+
 	command := BytesToCommand(request[:commandLength])
 	fmt.Printf("Received %s command\n", command)
+	if server.spv != nil && !lightCommands[command] {
+		fmt.Printf("Ignoring %s, light clients don't handle it\n", command)
+		return
+	}
 	switch command {
 	case "addr":
-		HandleAddr(request)
+		err = server.HandleAddr(request)
 	case "version":
 		// send verack
 		// send addr
-		fmt.Printf("Received %s command\n", command)
-		HandleVersion(request, bc)
+		err = server.HandleVersion(request)
 	case "inv":
-		HandleInv(request, bc)
+		err = server.HandleInv(request)
 	case "getblocks":
-		HandleGetBlocks(request, bc)
+		err = server.HandleGetBlocks(request)
+	case "getheaders":
+		err = server.HandleGetHeaders(request)
+	case "headers":
+		err = server.HandleHeaders(request)
 	case "block":
-		HandleBlock(request, bc)
+		err = server.HandleBlock(request)
 	case "getdata":
-		HandleGetData(request, bc)
+		err = server.HandleGetData(request)
+	case "notfound":
+		err = server.HandleNotFound(request)
+	case "cmpctblock":
+		err = server.HandleCmpctBlock(request)
+	case "getblocktxn":
+		err = server.HandleGetBlockTxn(request)
+	case "blocktxn":
+		err = server.HandleBlockTxn(request)
+	case "merkleblock":
+		err = server.HandleMerkleBlock(request)
+	case "filterload":
+		err = server.HandleFilterLoad(request)
+	case "filteradd":
+		err = server.HandleFilterAdd(request)
+	case "filterclear":
+		err = server.HandleFilterClear(request)
+	case "getcfilters":
+		err = server.HandleGetCFilters(request)
+	case "cfilters":
+		err = server.HandleCFilters(request)
+	case "getcfheaders":
+		err = server.HandleGetCFHeaders(request)
+	case "cfheaders":
+		err = server.HandleCFHeaders(request)
 	case "tx":
-		HandleTx(request, bc)
+		err = server.HandleTx(request)
+	case "mempool":
+		err = server.HandleMempool(request)
+	case "ping":
+		err = server.HandlePing(request)
+	case "pong":
+		err = server.HandlePong(request)
 	default:
 		fmt.Println("Unknown command received!")
 	}
-	conn.Close()
 
+	if mb, ok := err.(*misbehaviorError); ok {
+		server.misbehaving(id, mb.score, mb.reason)
+	} else if err != nil {
+		server.misbehaving(id, scoreMalformed, fmt.Sprintf("malformed %s message: %s", command, err))
+	}
+}
+
+// senderAddress decodes the AddrFrom field shared by all message payloads
+func senderAddress(request []byte) string {
+	var payload struct {
+		AddrFrom string
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(request[commandLength:]))
+	err := dec.Decode(&payload)
+	if err != nil {
+		return ""
+	}
+
+	return payload.AddrFrom
 }
 
-func HandleVersion(request []byte, bc *Blockchain) {
+func (server *Server) HandleVersion(request []byte) error {
 	var buff bytes.Buffer
 	var payload verzion
 
@@ -215,28 +666,52 @@ func HandleVersion(request []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	fmt.Printf("HandleVersion payload is %s\n",payload)
+	fmt.Printf("HandleVersion payload is %v\n",payload)
 
-	myBestHeight := bc.getBestHeight()
+	myBestHeight := server.getBestHeight()
 	foreignerBestHeight := payload.BestHeight
+	server.setPeerVersion(payload.AddrFrom, payload.Version, foreignerBestHeight, payload.Light)
+	isNew := !server.nodeIsKnown(payload.AddrFrom)
 
-	if myBestHeight < foreignerBestHeight {
-		SendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		SendVersion(payload.AddrFrom, bc)
+	if server.spv != nil {
+		// light clients follow the headers of full nodes
+		if isNew {
+			server.SendVersion(payload.AddrFrom)
+		}
+		if !payload.Light && myBestHeight < foreignerBestHeight {
+			server.SendGetHeaders(payload.AddrFrom)
+		}
+	} else if myBestHeight < foreignerBestHeight && !payload.Light {
+		// any peer as far as this one will do, take the quickest
+		syncPeer := server.fastestPeer(foreignerBestHeight)
+		if syncPeer == "" {
+			syncPeer = payload.AddrFrom
+		}
+		server.SendGetBlocks(syncPeer)
+	} else if myBestHeight > foreignerBestHeight || isNew {
+		// a new peer learns our version too, to know what we support
+		server.SendVersion(payload.AddrFrom)
 	}
 
-	// sendAddr(payload.AddrFrom)
-	if !nodeIsKnown(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
+	if isNew && !server.connectOnly && server.addNode(payload.AddrFrom) {
+		server.SendAddr(payload.AddrFrom)
+		if server.spv == nil {
+			server.SendMempool(payload.AddrFrom)
+		} else if !payload.Light {
+			server.SendFilterLoad(payload.AddrFrom, server.spv.bloomFilter())
+		}
+	}
+	if server.addrManager.addAddress(payload.AddrFrom) {
+		server.addrManager.saveToFile()
 	}
 
+	return nil
 }
 
-func HandleAddr(request []byte) {
+func (server *Server) HandleAddr(request []byte) error {
 	var buff bytes.Buffer
 	var payload addr
 
@@ -244,220 +719,1085 @@ func HandleAddr(request []byte) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	knownNodes = append(knownNodes,payload.AddrList...)
-	fmt.Printf("There are %d known nodes now!\n", len(knownNodes))
-	RequestBlocks()
+	if len(payload.AddrList) > maxAddrPerMessage {
+		return fmt.Errorf("%d addresses in one message", len(payload.AddrList))
+	}
+
+	var newAddrs []string
+	for _, address := range payload.AddrList {
+		if address == server.nodeAddress || server.addressIsBanned(address) {
+			continue
+		}
+		if server.addrManager.addAddress(address) {
+			newAddrs = append(newAddrs, address)
+		}
+	}
+	fmt.Printf("Learned %d new addresses from %s, %d known now\n", len(newAddrs), payload.AddrFrom, server.addrManager.count())
+
+	if len(newAddrs) == 0 {
+		return nil
+	}
+	server.addrManager.saveToFile()
+
+	// pass the news on and get to know the new nodes
+	for _, node := range server.getKnownNodes() {
+		if node != server.nodeAddress && node != payload.AddrFrom {
+			server.sendAddrList(node, addr{server.nodeAddress, newAddrs})
+		}
+	}
+	for _, address := range newAddrs {
+		if !server.connectOnly && server.addNode(address) {
+			server.SendVersion(address)
+		}
+	}
+
+	return nil
 }
 
-func HandleInv(request []byte, bc *Blockchain) {
+// HandleMempool answers with the IDs of every transaction in our mempool,
+// or of those matching the filter of a light client
+func (server *Server) HandleMempool(request []byte) error {
 	var buff bytes.Buffer
-	var payload inv
+	var payload mempoolreq
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
-	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
 
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
-			}
+	var txIDs [][]byte
+	for _, tx := range server.mempoolTransactions() {
+		if server.peerWantsTransaction(payload.AddrFrom, &tx) {
+			txIDs = append(txIDs, tx.ID)
 		}
-		blocksInTransit = newInTransit
 	}
 
-	if payload.Type == "tx" {
-		txID := payload.Items[0]
-		if mempool[hex.EncodeToString(txID)].ID == nil {
-			SendGetData(payload.AddrFrom, "tx", txID)
+	for len(txIDs) > 0 {
+		n := len(txIDs)
+		if n > maxInvItems {
+			n = maxInvItems
 		}
+		server.SendInv(payload.AddrFrom, "tx", txIDs[:n])
+		txIDs = txIDs[n:]
 	}
+
+	return nil
 }
 
-//
-func HandleGetBlocks(request []byte, bc *Blockchain) {
+func (server *Server) HandlePing(request []byte) error {
 	var buff bytes.Buffer
-	var payload getblocks
+	var payload ping
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	blocks := bc.getBlockHashes()
+	server.SendPong(payload.AddrFrom, payload.Nonce)
 
-	fmt.Printf("HandleGetBlocks request is %s\n",string(request))
-	fmt.Printf("HandleGetBlocks payload is %s\n",payload)
-	SendInv(payload.AddrFrom,"block",blocks)
+	return nil
 }
 
-func HandleBlock(request []byte, bc *Blockchain) {
+func (server *Server) HandlePong(request []byte) error {
 	var buff bytes.Buffer
-	var payload block
+	var payload pong
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-	blockData := payload.Block
-	block := DeserializeBlock(blockData)
-	fmt.Println("Recevied a new block!")
-	bc.addBlock(block)
 
+	server.pongReceived(payload.AddrFrom, payload.Nonce)
 
-	fmt.Printf("Added block %x\n", block.Hash)
-	fmt.Printf("Added block %d\n", block.Height)
-	//UTXOSet := UTXOSet{bc}
-	//fmt.Println(blocksInTransit)
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
-
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.update(block)
-		UTXOSet.reindex()
-	}
+	return nil
 }
 
-func HandleGetData(request []byte, bc *Blockchain) {
+func (server *Server) HandleInv(request []byte) error {
 	var buff bytes.Buffer
-	var payload getdata
+	var payload inv
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
+	if len(payload.Items) == 0 {
+		return errors.New("empty inventory")
+	}
+	for _, item := range payload.Items {
+		server.markInventoryKnown(payload.AddrFrom, item)
+	}
+	if server.spv != nil {
+		// light clients keep no mempool, and learn of blocks from
+		// their headers
+		if payload.Type == "block" {
+			server.SendGetHeaders(payload.AddrFrom)
+		}
+		return nil
 	}
-
 	if payload.Type == "block" {
-		block, err := bc.getBlock([]byte(payload.ID))
-		if err != nil {
-			return
+		// the inventory lists the tip first, ask for the oldest blocks
+		// first so each block comes after its parent
+		var missing [][]byte
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			blockHash := payload.Items[i]
+			if _, err := server.bc.getBlock(blockHash); err != nil {
+				missing = append(missing, blockHash)
+			}
+		}
+		if len(missing) == 0 {
+			return nil
 		}
 
-		SendBlock(payload.AddrFrom,&block)
+		blockHash := missing[0]
+		server.requestedMutex.Lock()
+		server.blocksInTransit = missing[1:]
+		server.requestedMutex.Unlock()
+		server.SendGetData(payload.AddrFrom, "block", blockHash)
 	}
 
 	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := mempool[txID]
-
-		SendTx(payload.AddrFrom, &tx)
-		// delete(mempool, txID)
+		if len(payload.Items) > maxInvItems {
+			return fmt.Errorf("%d items in one inventory", len(payload.Items))
+		}
+		for _, txID := range payload.Items {
+			if !server.inMempool(txID) {
+				server.SendGetData(payload.AddrFrom, "tx", txID)
+			}
+		}
 	}
+
+	return nil
 }
 
-func HandleTx(request []byte, bc *Blockchain) {
+//
+func (server *Server) HandleGetBlocks(request []byte) error {
 	var buff bytes.Buffer
-	var payload tx
+	var payload getblocks
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	txData := payload.Transaction
-	tx := DeserializeTransaction(txData)
-	mempool[hex.EncodeToString(tx.ID)] = tx
+	blocks := server.bc.getBlockHashes()
 
-	if nodeAddress == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddFrom {
-				SendInv(node, "tx", [][]byte{tx.ID})
-			}
-		}
-	} else {
-		if len(mempool) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*Transaction
-
-			for id := range mempool {
-				tx := mempool[id]
-				if bc.verifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
+	fmt.Printf("HandleGetBlocks request is %s\n",string(request))
+	fmt.Printf("HandleGetBlocks payload is %s\n",payload)
+	server.SendInv(payload.AddrFrom,"block",blocks)
 
-			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
-			}
+	return nil
+}
 
-			cbTx := NewCoinbaseTransaction(miningAddress, "")
-			txs = append(txs, cbTx)
+// HandleGetHeaders answers a light client with the headers following the
+// last block of its locator on our chain
+func (server *Server) HandleGetHeaders(request []byte) error {
+	var buff bytes.Buffer
+	var payload getheaders
 
-			newBlock := bc.MineBlock(txs)
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.reindex()
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
 
-			fmt.Println("New block is mined!")
+	if len(payload.Locator) > maxLocatorSize {
+		return fmt.Errorf("%d hashes in one locator", len(payload.Locator))
+	}
+	// an empty answer tells the client it has all our headers
+	server.SendHeaders(payload.AddrFrom, server.bc.getHeaders(payload.Locator, maxHeadersPerMessage))
 
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(mempool, txID)
-			}
+	return nil
+}
 
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					SendInv(node, "block", [][]byte{newBlock.Hash})
-				}
-			}
+// HandleHeaders adds the headers a full node sent to our header chain,
+// asking for more while they come full, then for the filters of the blocks
+func (server *Server) HandleHeaders(request []byte) error {
+	var buff bytes.Buffer
+	var payload headers
 
-			if len(mempool) > 0 {
-				goto MineTransactions
-			}
-		}
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	if len(payload.Headers) > maxHeadersPerMessage {
+		return fmt.Errorf("%d headers in one message", len(payload.Headers))
+	}
+	added, err := server.spv.addHeaders(payload.Headers)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added %d headers, best height is %d\n", added, server.spv.getBestHeight())
+
+	if len(payload.Headers) == maxHeadersPerMessage {
+		server.SendGetHeaders(payload.AddrFrom)
+		return nil
+	}
+	server.syncFilters(payload.AddrFrom)
+
+	return nil
+}
+
+func (server *Server) HandleBlock(request []byte) error {
+	var buff bytes.Buffer
+	var payload block
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+	blockData := payload.Block
+	block, err := decodeBlock(blockData)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Recevied a new block!")
+	server.markInventoryKnown(payload.AddrFrom, block.Hash)
+
+	server.requestedMutex.Lock()
+	requested := server.requestedBlocks[hex.EncodeToString(block.Hash)]
+	delete(server.requestedBlocks, hex.EncodeToString(block.Hash))
+	server.requestedMutex.Unlock()
+	if !requested {
+		return &misbehaviorError{scoreUnrequested, fmt.Sprintf("sent unrequested block %x", block.Hash)}
+	}
+
+	err = block.validate()
+	if err == nil {
+		err = server.bc.checkBlock(block)
+	}
+	if err == errUnknownParent {
+		// we are behind, catch up the usual way
+		server.SendGetBlocks(payload.AddrFrom)
+		return nil
+	}
+	if err != nil {
+		return &misbehaviorError{scoreInvalidBlock, fmt.Sprintf("sent invalid block %x: %s", block.Hash, err)}
+	}
+	connected := server.bc.addBlock(block)
+
+
+	fmt.Printf("Added block %x\n", block.Hash)
+	fmt.Printf("Added block %d\n", block.Height)
+	server.chainConnected(connected)
+	// blocks are handled concurrently, only one of them takes the next
+	// block in transit
+	var next []byte
+	server.requestedMutex.Lock()
+	if len(server.blocksInTransit) > 0 {
+		next = server.blocksInTransit[0]
+		server.blocksInTransit = server.blocksInTransit[1:]
+	}
+	server.requestedMutex.Unlock()
+	if next != nil {
+		server.SendGetData(payload.AddrFrom, "block", next)
+	} else if bytes.Compare(server.bc.getTip(), block.Hash) == 0 {
+		server.RelayBlock(block, payload.AddrFrom)
+	}
+
+	return nil
+}
+
+// HandleCmpctBlock rebuilds an announced block from the mempool,
+// asking the sender for the transactions we don't have
+func (server *Server) HandleCmpctBlock(request []byte) error {
+	var buff bytes.Buffer
+	var payload cmpctblock
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+	cb, err := decodeCompactBlock(payload.Block)
+	if err != nil {
+		return err
 	}
+	fmt.Printf("Recevied compact block %x\n", cb.Hash)
+	server.markInventoryKnown(payload.AddrFrom, cb.Hash)
+
+	if _, err := server.bc.getBlock(cb.Hash); err == nil {
+		return nil
+	}
+	if _, err := server.bc.getBlock(cb.PrevBlockHash); err != nil {
+		// we are behind, catch up the usual way
+		server.SendGetBlocks(payload.AddrFrom)
+		return nil
+	}
+
+	pb, err := newPartialBlock(cb, server.mempoolTransactions())
+	if err != nil {
+		return err
+	}
+	missing := pb.missing()
+	if len(missing) == 0 {
+		server.connectCompactBlock(pb.block(), payload.AddrFrom)
+		return nil
+	}
+
+	fmt.Printf("Requesting %d missing transactions of block %x\n", len(missing), cb.Hash)
+	pb.peer = payload.AddrFrom
+	server.partialMutex.Lock()
+	server.partialBlocks[hex.EncodeToString(cb.Hash)] = pb
+	server.partialMutex.Unlock()
+	server.SendGetBlockTxn(payload.AddrFrom, cb.Hash, missing)
+
+	return nil
 }
 
-func StartServer(nodeID, minerAddress string) {
+func (server *Server) HandleGetBlockTxn(request []byte) error {
+	var buff bytes.Buffer
+	var payload getblocktxn
 
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	fmt.Printf("nodeAddress is %s\n", nodeAddress)
-	miningAddress = minerAddress
-	ln, err := net.Listen(protocol, nodeAddress)
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	block, err := server.bc.getBlock(payload.BlockHash)
+	if err != nil {
+		return nil
+	}
+
+	var txs []*Transaction
+	for _, index := range payload.Indexes {
+		if index < 0 || index >= len(block.Transactions) {
+			return fmt.Errorf("transaction index %d out of range", index)
+		}
+		txs = append(txs, block.Transactions[index])
+	}
+	server.SendBlockTxn(payload.AddrFrom, payload.BlockHash, txs)
+
+	return nil
+}
+
+// HandleBlockTxn completes a compact block with the transactions we asked for
+func (server *Server) HandleBlockTxn(request []byte) error {
+	var buff bytes.Buffer
+	var payload blocktxn
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	hash := hex.EncodeToString(payload.BlockHash)
+	server.partialMutex.Lock()
+	pb, ok := server.partialBlocks[hash]
+	if ok && pb.peer == payload.AddrFrom {
+		delete(server.partialBlocks, hash)
+	}
+	server.partialMutex.Unlock()
+	if !ok || pb.peer != payload.AddrFrom {
+		return &misbehaviorError{scoreUnrequested, fmt.Sprintf("sent unrequested transactions of block %x", payload.BlockHash)}
+	}
+
+	var txs []*Transaction
+	for _, data := range payload.Transactions {
+		tx, err := decodeTransaction(data)
+		if err != nil {
+			return err
+		}
+		txs = append(txs, &tx)
+	}
+	err = pb.fill(txs)
+	if err != nil {
+		return err
+	}
+	server.connectCompactBlock(pb.block(), payload.AddrFrom)
+
+	return nil
+}
+
+// connectCompactBlock adds a block rebuilt from a compact block. A block that
+// doesn't check out may come from short ID collisions in our mempool rather
+// than from the peer, so it's fetched in full instead of being held against it.
+func (server *Server) connectCompactBlock(block *Block, from string) {
+	err := block.validate()
+	if err == nil {
+		err = server.bc.checkBlock(block)
+	}
+	if err != nil {
+		fmt.Printf("Compact block %x didn't rebuild: %s, fetching it in full\n", block.Hash, err)
+		server.SendGetData(from, "block", block.Hash)
+		return
+	}
+
+	connected := server.bc.addBlock(block)
+	fmt.Printf("Added block %x\n", block.Hash)
+	server.chainConnected(connected)
+
+	if bytes.Compare(server.bc.getTip(), block.Hash) == 0 {
+		server.RelayBlock(block, from)
+	}
+}
+
+func (server *Server) HandleGetData(request []byte) error {
+	var buff bytes.Buffer
+	var payload getdata
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	if payload.Type == "block" {
+		block, err := server.bc.getBlock([]byte(payload.ID))
+		if err != nil {
+			return nil
+		}
+
+		server.SendBlock(payload.AddrFrom,&block)
+	}
+
+	if payload.Type == "merkleblock" {
+		block, err := server.bc.getBlock(payload.ID)
+		if err != nil {
+			return nil
+		}
+		mb := server.filterBlock(payload.AddrFrom, &block)
+		if mb == nil {
+			// the filterload may still be on its way, the client loads
+			// it again and retries
+			fmt.Printf("%s asks for a merkle block without a filter\n", payload.AddrFrom)
+			server.SendNotFound(payload.AddrFrom, payload.Type, payload.ID)
+			return nil
+		}
+
+		server.SendMerkleBlock(payload.AddrFrom, mb)
+	}
+
+	if payload.Type == "tx" {
+		tx, ok := server.mempool.get(payload.ID)
+		if !ok {
+			return nil
+		}
+
+		server.SendTx(payload.AddrFrom, &tx)
+		// delete(mempool, txID)
+	}
+
+	return nil
+}
+
+// HandleNotFound has a light client load its filter again when a peer
+// got the request for a merkle block before the filter, asking again once
+// the filter had time to arrive
+func (server *Server) HandleNotFound(request []byte) error {
+	var buff bytes.Buffer
+	var payload notfound
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s has no %s %x for us\n", payload.AddrFrom, payload.Type, payload.ID)
+	if server.spv == nil || payload.Type != "merkleblock" || !server.spv.nextToScan(payload.ID) {
+		return nil
+	}
+	server.SendFilterLoad(payload.AddrFrom, server.spv.bloomFilter())
+	time.AfterFunc(merkleBlockRetryDelay, func() {
+		server.SendGetData(payload.AddrFrom, payload.Type, payload.ID)
+	})
+
+	return nil
+}
+
+// HandleFilterLoad sets the bloom filter of a light client, from then on
+// it only hears about the transactions matching it
+func (server *Server) HandleFilterLoad(request []byte) error {
+	var buff bytes.Buffer
+	var payload filterload
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	err = payload.Filter.validate()
+	if err != nil {
+		return err
+	}
+	server.setPeerFilter(payload.AddrFrom, &payload.Filter)
+
+	return nil
+}
+
+func (server *Server) HandleFilterAdd(request []byte) error {
+	var buff bytes.Buffer
+	var payload filteradd
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	if len(payload.Data) > maxFilterElementSize {
+		return fmt.Errorf("filter element of %d bytes", len(payload.Data))
+	}
+	if !server.addToPeerFilter(payload.AddrFrom, payload.Data) {
+		return errors.New("filteradd without a filter loaded")
+	}
+
+	return nil
+}
+
+func (server *Server) HandleFilterClear(request []byte) error {
+	var buff bytes.Buffer
+	var payload filterclear
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	server.setPeerFilter(payload.AddrFrom, nil)
+
+	return nil
+}
+
+// HandleMerkleBlock checks a filtered block against its proof, a light
+// client keeps the transactions of a block it has the header of. Full nodes
+// don't ask for merkle blocks, so this only tells what a light client
+// would learn from it.
+func (server *Server) HandleMerkleBlock(request []byte) error {
+	var buff bytes.Buffer
+	var payload merkleblock
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+	mb, err := decodeMerkleBlock(payload.Block)
+	if err != nil {
+		return err
+	}
+
+	txs, err := mb.validate()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Recevied merkle block %x with %d matching transactions\n", mb.Hash, len(txs))
+	for _, tx := range txs {
+		fmt.Printf("Transaction %x is in block %x\n", tx.ID, mb.Hash)
+	}
+	if server.spv == nil {
+		return nil
+	}
+
+	// the header we have proves the block is in the chain, scanning
+	// goes in chain order
+	if !server.spv.nextToScan(mb.Hash) {
+		fmt.Printf("Ignoring merkle block %x, it isn't the next to scan\n", mb.Hash)
+		return nil
+	}
+	server.spv.addBlockTransactions(mb.Hash, txs)
+	server.syncFilters(payload.AddrFrom)
+
+	return nil
+}
+
+// HandleGetCFilters answers with the filters of the blocks from a height
+// up to a block
+func (server *Server) HandleGetCFilters(request []byte) error {
+	var buff bytes.Buffer
+	var payload getcfilters
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	if _, err := server.bc.getBlock(payload.StopHash); err != nil {
+		return nil
+	}
+	hashes, err := server.bc.getBlockRange(payload.StartHeight, payload.StopHash, maxCFiltersPerMessage)
+	if err != nil {
+		return err
+	}
+
+	var filters []BlockFilter
+	for _, hash := range hashes {
+		filter, _, err := server.bc.getFilter(hash)
+		if err != nil {
+			fmt.Printf("No filter of block %x: %s\n", hash, err)
+			return nil
+		}
+		filters = append(filters, BlockFilter{hash, filter})
+	}
+	server.SendCFilters(payload.AddrFrom, payload.StopHash, filters)
+
+	return nil
+}
+
+// HandleGetCFHeaders answers with the filter hashes of the blocks from a
+// height up to a block, and the filter header to chain them from
+func (server *Server) HandleGetCFHeaders(request []byte) error {
+	var buff bytes.Buffer
+	var payload getcfheaders
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	if _, err := server.bc.getBlock(payload.StopHash); err != nil {
+		return nil
+	}
+	hashes, err := server.bc.getBlockRange(payload.StartHeight, payload.StopHash, maxCFHeadersPerMessage)
+	if err != nil {
+		return err
+	}
+
+	prevHeader := make([]byte, sha256.Size)
+	if payload.StartHeight > 0 {
+		first, err := server.bc.getBlock(hashes[0])
+		if err != nil {
+			return nil
+		}
+		_, prevHeader, err = server.bc.getFilter(first.PrevBlockHash)
+		if err != nil {
+			fmt.Printf("No filter of block %x: %s\n", first.PrevBlockHash, err)
+			return nil
+		}
+	}
+
+	var filterHashes [][]byte
+	for _, hash := range hashes {
+		filter, _, err := server.bc.getFilter(hash)
+		if err != nil {
+			fmt.Printf("No filter of block %x: %s\n", hash, err)
+			return nil
+		}
+		filterHashes = append(filterHashes, filterHash(filter))
+	}
+	server.SendCFHeaders(payload.AddrFrom, payload.StopHash, prevHeader, filterHashes)
+
+	return nil
+}
+
+// HandleCFilters receives block filters, a light client checks them against
+// their filter headers and asks for the merkle block of the first matching
+// its wallets. Full nodes have filters of their own, so this only tells
+// what a light client would learn from them.
+func (server *Server) HandleCFilters(request []byte) error {
+	var buff bytes.Buffer
+	var payload cfilters
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	if len(payload.Filters) > maxCFiltersPerMessage {
+		return fmt.Errorf("%d filters in one message", len(payload.Filters))
+	}
+	fmt.Printf("Recevied %d block filters up to block %x\n", len(payload.Filters), payload.StopHash)
+	if server.spv == nil {
+		return nil
+	}
+
+	watched := server.spv.watched()
+	for _, f := range payload.Filters {
+		if server.spv.isScanned(f.BlockHash) {
+			continue
+		}
+		if !server.spv.nextToScan(f.BlockHash) {
+			return nil
+		}
+		err := server.spv.checkFilter(f.BlockHash, f.Filter)
+		if err != nil {
+			return err
+		}
+		matched, err := matchBlockFilter(f.BlockHash, f.Filter, watched)
+		if err != nil {
+			return err
+		}
+		if matched {
+			// the block may change what we watch, the rest is scanned
+			// once we have it
+			server.SendGetData(payload.AddrFrom, "merkleblock", f.BlockHash)
+			return nil
+		}
+		server.spv.addBlockTransactions(f.BlockHash, nil)
+	}
+	server.syncFilters(payload.AddrFrom)
+
+	return nil
+}
+
+// HandleCFHeaders receives filter hashes and chains them into filter
+// headers, a light client keeps them and asks for the filters
+func (server *Server) HandleCFHeaders(request []byte) error {
+	var buff bytes.Buffer
+	var payload cfheaders
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	if len(payload.FilterHashes) > maxCFHeadersPerMessage {
+		return fmt.Errorf("%d filter hashes in one message", len(payload.FilterHashes))
+	}
+	headers := filterHeaders(payload.PrevHeader, payload.FilterHashes)
+	if len(headers) > 0 {
+		fmt.Printf("Recevied %d filter headers, block %x has filter header %x\n", len(headers), payload.StopHash, headers[len(headers)-1])
+	}
+	if server.spv == nil || len(headers) == 0 {
+		return nil
+	}
+
+	err = server.spv.addFilterHeaders(payload.StopHash, payload.PrevHeader, payload.FilterHashes)
+	if err != nil {
+		return err
+	}
+	stop, err := server.spv.getHeader(payload.StopHash)
+	if err != nil {
+		return err
+	}
+	server.SendGetCFilters(payload.AddrFrom, stop.Height-len(headers)+1, payload.StopHash)
+
+	return nil
+}
+
+func (server *Server) HandleTx(request []byte) error {
+	var buff bytes.Buffer
+	var payload tx
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return err
+	}
+
+	txData := payload.Transaction
+	tx, err := decodeTransaction(txData)
+	if err != nil {
+		return err
+	}
+	server.markInventoryKnown(payload.AddrFrom, tx.ID)
+	if !server.acceptTransaction(&tx, payload.AddrFrom) {
+		return nil
+	}
+
+	server.RelayTransaction(&tx, payload.AddrFrom)
+	server.acceptOrphans([]*Transaction{&tx})
+
+	if server.mempoolSize() >= 2 && len(server.miningAddress) > 0 {
+	MineTransactions:
+		// parents come first, their children spend them in the block
+		txs := server.bc.pickTransactions(server.mempoolTransactions(), time.Now().Unix())
+
+		if len(txs) == 0 {
+			fmt.Println("All transactions are invalid! Waiting for new ones...")
+			return nil
+		}
+
+		cbTx := NewCoinbaseTransaction(server.miningAddress, "")
+		txs = append(txs, cbTx)
+
+		newBlock := server.bc.MineBlock(txs)
+		UTXOSet := UTXOSet{server.bc}
+		UTXOSet.reindex()
+
+		fmt.Println("New block is mined!")
+
+		server.blockConnected(newBlock)
+
+		server.RelayBlock(newBlock, "")
+
+		if server.mempoolSize() > 0 {
+			goto MineTransactions
+		}
+	}
+
+	return nil
+}
+
+// StartServer runs a node with the startnode options until it's killed
+func StartServer(config ServerConfig) {
+	var transport Transport = TCPTransport{}
+	if config.Encrypt || config.AllowKeysFile != "" {
+		nodeKey := LoadNodeKey(config.NodeID)
+		fmt.Printf("Encrypted transport on, node key %x\n", nodeKey.PublicKey().Bytes())
+
+		secure := &SecureTransport{Inner: transport, Key: nodeKey}
+		if config.AllowKeysFile != "" {
+			var err error
+			secure.Allowed, err = LoadAllowedKeys(config.AllowKeysFile)
+			if err != nil {
+				log.Panic(err)
+			}
+			fmt.Printf("Accepting %d allowed node keys only\n", len(secure.Allowed))
+		}
+		transport = secure
+	}
+
+	var server *Server
+	if config.SPV {
+		server = NewServer(config, nil, transport)
+		server.spv = NewSPVChain(config.NodeID, walletPubKeys(config.NodeID))
+		fmt.Printf("Light client following %d wallets\n", len(server.spv.pubKeys))
+	} else {
+		server = NewServer(config, NewBlockChain(config.NodeID), transport)
+		saved, loaded, err := server.mempool.loadFromFile(config.NodeID, server.bc)
+		if err == nil {
+			fmt.Printf("Loaded %d of the %d saved mempool transactions\n", loaded, saved)
+		}
+		server.feeEstimator, _ = LoadFeeEstimator(config.NodeID)
+	}
+	if secure, ok := transport.(*SecureTransport); ok {
+		secure.Metrics = server.metrics
+	}
+	fmt.Printf("nodeAddress is %s\n", server.nodeAddress)
+	ln, err := transport.Listen(config.ListenAddr)
 	if err != nil {
 		log.Panic(err)
 	}
 	defer ln.Close()
+	fmt.Printf("Listening on %s\n", ln.Addr())
+
+	go func() {
+		for range time.Tick(peersSaveInterval) {
+			server.addrManager.prune()
+			server.addrManager.saveToFile()
+		}
+	}()
+
+	go func() {
+		for range time.Tick(pingInterval) {
+			server.pingPeers()
+			server.prunePeers()
+			server.savePeerInfo()
+			server.metrics.saveToFile(server.nodeID)
+		}
+	}()
+
+	if server.spv == nil {
+		go func() {
+			for range time.Tick(mempoolSaveInterval) {
+				server.mempool.saveToFile(server.nodeID)
+				server.feeEstimator.saveToFile(server.nodeID)
+			}
+		}()
+	}
 
-	bc := NewBlockChain(nodeID)
+	// stopping closes the listener, Serve returns once the connections being
+	// handled are done and what the node keeps across restarts is saved
+	stopping := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Println("Shutting down")
+		close(stopping)
+		ln.Close()
+	}()
+
+	err = server.Serve(ln, config.initialPeers(server.addrManager))
+	select {
+	case <-stopping:
+		server.addrManager.saveToFile()
+		if server.spv == nil {
+			server.mempool.saveToFile(server.nodeID)
+			server.feeEstimator.saveToFile(server.nodeID)
+		}
+	default:
+		log.Panic(err)
+	}
+}
 
-	if nodeAddress != knownNodes[0] {
-		SendVersion(knownNodes[0], bc)
+// Serve contacts the initial peers, then handles the connections accepted
+// on ln until accepting fails, like when ln is closed. It returns once the
+// connections being handled are done.
+func (server *Server) Serve(ln net.Listener, initialPeers []string) error {
+	server.nodesMutex.Lock()
+	server.knownNodes = nil
+	server.nodesMutex.Unlock()
+	for _, address := range initialPeers {
+		if address != server.nodeAddress && !server.addressIsBanned(address) {
+			server.addNode(address)
+		}
+	}
+	for _, node := range server.getKnownNodes() {
+		server.SendVersion(node)
+		if server.spv == nil {
+			server.SendMempool(node)
+			continue
+		}
+		server.SendFilterLoad(node, server.spv.bloomFilter())
+		server.SendGetHeaders(node)
 	}
 
+	var handlers sync.WaitGroup
+	connSlots := make(chan struct{}, maxConnections)
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Panic(err)
+			handlers.Wait()
+			return err
 		}
 
-		go HandleConnection(conn,bc)
+		select {
+		case connSlots <- struct{}{}:
+			handlers.Add(1)
+			go func() {
+				server.HandleConnection(conn)
+				<-connSlots
+				handlers.Done()
+			}()
+		default:
+			server.metrics.limitReached("connections", "refusing %s, %d connections open", conn.RemoteAddr(), maxConnections)
+			conn.Close()
+		}
 	}
 }
 
+// acceptTransaction validates a transaction and adds it to the mempool,
+// reporting whether it was new and valid. A transaction spending unknown
+// ones waits for them in the orphan pool.
+func (server *Server) acceptTransaction(tx *Transaction, from string) bool {
+	err := server.mempool.add(tx, server.bc)
+	if err == errTxInPool {
+		return false
+	}
+	if missing, ok := err.(*missingParentsError); ok {
+		server.addOrphan(tx, from, missing.parents)
+		return false
+	}
+	if err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.ID, err)
+		return false
+	}
+	if fee, ok := server.mempool.fee(tx.ID); ok {
+		server.feeEstimator.track(tx.ID, fee, len(tx.encode()), server.bc.getBestHeight())
+	}
+
+	return true
+}
+
+// chainConnected brings the UTXO set up to the blocks that joined the best
+// chain and passes each of them to blockConnected. Blocks added to a side
+// branch join nothing.
+func (server *Server) chainConnected(blocks []*Block) {
+	if len(blocks) == 0 {
+		return
+	}
+	UTXOSet := UTXOSet{server.bc}
+	UTXOSet.reindex()
+	for _, block := range blocks {
+		server.blockConnected(block)
+	}
+}
+
+// blockConnected updates the pools and the fee statistics with a block
+// added to the chain
+func (server *Server) blockConnected(block *Block) {
+	server.mempool.removeForBlock(block)
+	server.feeEstimator.processBlock(block, server.mempool)
+	server.acceptOrphans(block.Transactions)
+}
+
+// addOrphan keeps a transaction until its parents come in, asking the peer
+// it came from for them
+func (server *Server) addOrphan(tx *Transaction, from string, parents [][]byte) {
+	err := server.orphans.add(tx, from, parents)
+	if err == errTxInPool {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Dropped orphan transaction %x: %s\n", tx.ID, err)
+		return
+	}
+	fmt.Printf("Orphan transaction %x, requesting %d parents\n", tx.ID, len(parents))
+
+	if from == "" {
+		return
+	}
+	for _, parent := range parents {
+		if !server.orphans.has(parent) {
+			server.SendGetData(from, "tx", parent)
+		}
+	}
+}
+
+// acceptOrphans tries the orphans spending the outputs of transactions that
+// just came in again, and the orphans of the ones accepted in turn
+func (server *Server) acceptOrphans(txs []*Transaction) {
+	for len(txs) > 0 {
+		parent := txs[0]
+		txs = txs[1:]
+		for _, orphan := range server.orphans.take(parent.ID) {
+			orphan := orphan
+			if server.acceptTransaction(&orphan.tx, orphan.from) {
+				fmt.Printf("Accepted orphan transaction %x\n", orphan.tx.ID)
+				server.RelayTransaction(&orphan.tx, orphan.from)
+				txs = append(txs, &orphan.tx)
+			}
+		}
+	}
+}
+
+func (server *Server) inMempool(txID []byte) bool {
+	return server.mempool.has(txID)
+}
+
+func (server *Server) mempoolSize() int {
+	return server.mempool.count()
+}
+
+// mempoolTransactions returns a snapshot of the mempool
+func (server *Server) mempoolTransactions() []Transaction {
+	return server.mempool.transactions()
+}
+
 func GobEncode(data interface{}) []byte {
 	var buff bytes.Buffer
 
@@ -470,8 +1810,11 @@ func GobEncode(data interface{}) []byte {
 	return buff.Bytes()
 }
 
-func nodeIsKnown(addr string) bool {
-	for _, node := range knownNodes {
+func (server *Server) nodeIsKnown(addr string) bool {
+	server.nodesMutex.Lock()
+	defer server.nodesMutex.Unlock()
+
+	for _, node := range server.knownNodes {
 		if node == addr {
 			return true
 		}
@@ -479,3 +1822,41 @@ func nodeIsKnown(addr string) bool {
 
 	return false
 }
+
+// getKnownNodes returns a copy of the nodes we talk to, to go through
+// while others are added or dropped
+func (server *Server) getKnownNodes() []string {
+	server.nodesMutex.Lock()
+	defer server.nodesMutex.Unlock()
+
+	return append([]string(nil), server.knownNodes...)
+}
+
+// addNode adds a node to talk to, reporting false when it's known already
+func (server *Server) addNode(addr string) bool {
+	server.nodesMutex.Lock()
+	defer server.nodesMutex.Unlock()
+
+	for _, node := range server.knownNodes {
+		if node == addr {
+			return false
+		}
+	}
+	server.knownNodes = append(server.knownNodes, addr)
+
+	return true
+}
+
+// removeNode stops talking to a node
+func (server *Server) removeNode(addr string) {
+	server.nodesMutex.Lock()
+	defer server.nodesMutex.Unlock()
+
+	var updatedNodes []string
+	for _, node := range server.knownNodes {
+		if node != addr {
+			updatedNodes = append(updatedNodes, node)
+		}
+	}
+	server.knownNodes = updatedNodes
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The simulator runs a network of nodes in one process, over a
+// MemoryTransport and with a blockchain database each in a temporary
+// directory. The nodes are on regtest and start from the same chain: the
+// genesis block and a block paying the wallet of node 0.
+
+const simTimeout = 30 * time.Second
+
+type simNode struct {
+	*Server
+	wallet *Wallet
+	ln     net.Listener
+	done   chan struct{}
+}
+
+type simNetwork struct {
+	t         *testing.T
+	transport *MemoryTransport
+	nodes     []*simNode
+}
+
+// newSimNetwork sets up n nodes, the miners mine whenever their mempool
+// holds two transactions. Nothing runs until start.
+func newSimNetwork(t *testing.T, n int, miners ...int) *simNetwork {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() { os.Chdir(dir) })
+	activeNet = &regTestParams
+	t.Cleanup(func() { activeNet = &mainNetParams })
+
+	sim := &simNetwork{t: t, transport: NewMemoryTransport()}
+	for i := 0; i < n; i++ {
+		sim.nodes = append(sim.nodes, &simNode{wallet: NewWallet(""), done: make(chan struct{})})
+	}
+
+	first := CreateBlockchain(sim.address(0), "0")
+	first.db.Close()
+	for i := range sim.nodes {
+		nodeID := fmt.Sprint(i)
+		if i > 0 {
+			copyFile(t, fmt.Sprintf(dbFile, "0"), fmt.Sprintf(dbFile, nodeID))
+		}
+
+		config := ServerConfig{NodeID: nodeID, ListenAddr: fmt.Sprintf("node%d:3000", i)}
+		for _, miner := range miners {
+			if miner == i {
+				config.MinerAddress = sim.address(i)
+			}
+		}
+		bc := NewBlockChain(nodeID)
+		utxoSet := UTXOSet{bc}
+		utxoSet.reindex()
+
+		node := sim.nodes[i]
+		node.Server = NewServer(config, bc, sim.transport.Node(config.ListenAddr))
+		node.ln, err = node.transport.Listen(config.ListenAddr)
+		require.NoError(t, err)
+	}
+	t.Cleanup(sim.stop)
+
+	return sim
+}
+
+// start runs the nodes, each connecting to the nodes given by peers
+func (sim *simNetwork) start(peers func(i int) []int) {
+	for i, node := range sim.nodes {
+		var initialPeers []string
+		for _, peer := range peers(i) {
+			initialPeers = append(initialPeers, sim.nodes[peer].nodeAddress)
+		}
+
+		go func(node *simNode) {
+			node.Serve(node.ln, initialPeers)
+			close(node.done)
+		}(node)
+	}
+}
+
+func (sim *simNetwork) stop() {
+	for _, node := range sim.nodes {
+		node.ln.Close()
+	}
+	for _, node := range sim.nodes {
+		<-node.done
+		node.bc.db.Close()
+	}
+}
+
+// line connects every node to the one before it
+func line(i int) []int {
+	if i == 0 {
+		return nil
+	}
+
+	return []int{i - 1}
+}
+
+// mesh connects every node to all the nodes before it
+func mesh(i int) []int {
+	var peers []int
+	for j := 0; j < i; j++ {
+		peers = append(peers, j)
+	}
+
+	return peers
+}
+
+func (sim *simNetwork) address(i int) string {
+	return string(sim.nodes[i].wallet.getAddress())
+}
+
+// mine makes node i mine a block with just its coinbase
+func (sim *simNetwork) mine(i int) *Block {
+	node := sim.nodes[i]
+	block := node.bc.MineBlock([]*Transaction{NewCoinbaseTransaction(sim.address(i), "")})
+	utxoSet := UTXOSet{node.bc}
+	utxoSet.reindex()
+	node.RelayBlock(block, "")
+
+	return block
+}
+
+// send pays amount from the wallet of node from to the one of node to,
+// handing the transaction to node at like the CLI does
+func (sim *simNetwork) send(at, from, to, amount int) *Transaction {
+	sender := sim.nodes[from]
+	tx := sender.bc.NewUTXOTransaction(sender.wallet, sim.address(to), amount, TxOptions{}, UTXOSet{sender.bc}, sender.mempool)
+	sim.submit(at, tx)
+
+	return tx
+}
+
+// submit hands a transaction to node at
+func (sim *simNetwork) submit(at int, tx *Transaction) {
+	client := NewServer(ServerConfig{NodeID: "client"}, nil, sim.transport.Node("client"))
+	client.SendTx(sim.nodes[at].nodeAddress, tx)
+}
+
+// partition cuts the network between groups of nodes
+func (sim *simNetwork) partition(groups ...[]int) {
+	var addresses [][]string
+	for _, group := range groups {
+		var members []string
+		for _, i := range group {
+			members = append(members, sim.nodes[i].nodeAddress)
+		}
+		addresses = append(addresses, members)
+	}
+	sim.transport.Partition(addresses...)
+}
+
+// heal joins the network again and has every node reconnect to the others,
+// like nodes do on restart
+func (sim *simNetwork) heal() {
+	sim.transport.Heal()
+	for _, node := range sim.nodes {
+		for _, other := range sim.nodes {
+			if other != node {
+				node.SendVersion(other.nodeAddress)
+			}
+		}
+	}
+}
+
+// waitConverged waits until the given nodes, all of them by default, agree
+// on the tip and the UTXO set, returning the tip. A node writes its tip
+// before it reindexes, so the UTXO sets also have to be up to date with
+// the chains, or the nodes would agree on the one before.
+func (sim *simNetwork) waitConverged(nodes ...int) []byte {
+	if len(nodes) == 0 {
+		for i := range sim.nodes {
+			nodes = append(nodes, i)
+		}
+	}
+
+	var tip []byte
+	converged := func() bool {
+		tip = chainTip(sim.nodes[nodes[0]].bc)
+		utxos := utxoDigest(sim.nodes[nodes[0]].bc)
+		for _, i := range nodes[1:] {
+			if !bytes.Equal(chainTip(sim.nodes[i].bc), tip) || !bytes.Equal(utxoDigest(sim.nodes[i].bc), utxos) {
+				return false
+			}
+		}
+		for _, i := range nodes {
+			if !utxoReindexed(sim.nodes[i].bc) {
+				return false
+			}
+		}
+		return true
+	}
+	require.Eventually(sim.t, converged, simTimeout, 50*time.Millisecond, "Nodes %v converge", nodes)
+
+	return tip
+}
+
+// waitHeight waits until node i reached height
+func (sim *simNetwork) waitHeight(i, height int) {
+	reached := func() bool {
+		return sim.nodes[i].bc.getBestHeight() >= height
+	}
+	require.Eventually(sim.t, reached, simTimeout, 50*time.Millisecond, "Node %d reaches height %d", i, height)
+}
+
+// waitMempool waits until node i has a transaction in its mempool
+func (sim *simNetwork) waitMempool(i int, tx *Transaction) {
+	received := func() bool {
+		return sim.nodes[i].inMempool(tx.ID)
+	}
+	require.Eventually(sim.t, received, simTimeout, 50*time.Millisecond, "Node %d receives transaction %x", i, tx.ID)
+}
+
+func (sim *simNetwork) balance(node, wallet int) int {
+	utxoSet := UTXOSet{sim.nodes[node].bc}
+
+	balance := 0
+	for _, out := range utxoSet.findUTXO(p2pkhScript(HashPubKey(sim.nodes[wallet].wallet.PublicKey))) {
+		balance += out.Value
+	}
+
+	return balance
+}
+
+// chainTip reads the tip from the database, the in-memory one belongs to
+// the node's goroutines
+func chainTip(bc *Blockchain) []byte {
+	var tip []byte
+	bc.db.View(func(tx *bolt.Tx) error {
+		tip = append(tip, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))...)
+		return nil
+	})
+
+	return tip
+}
+
+// utxoDigest hashes the whole UTXO set
+func utxoDigest(bc *Blockchain) []byte {
+	hash := sha256.New()
+	bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			hash.Write(k)
+			hash.Write(v)
+			return nil
+		})
+	})
+
+	return hash.Sum(nil)
+}
+
+// utxoReindexed tells whether the UTXO set holds the unspent outputs of the chain
+func utxoReindexed(bc *Blockchain) bool {
+	utxos := bc.findUTXO()
+
+	reindexed := true
+	bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		if b == nil || b.Stats().KeyN != len(utxos) {
+			reindexed = false
+			return nil
+		}
+		for txID, outs := range utxos {
+			key, _ := hex.DecodeString(txID)
+			if !bytes.Equal(b.Get(key), outs.Serialize()) {
+				reindexed = false
+			}
+		}
+		return nil
+	})
+
+	return reindexed
+}
+
+func copyFile(t *testing.T, from, to string) {
+	src, err := os.Open(from)
+	require.NoError(t, err)
+	defer src.Close()
+
+	dst, err := os.Create(to)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	require.NoError(t, err)
+}
+
+func TestSimTransactionRelay(t *testing.T) {
+	sim := newSimNetwork(t, 4, 3)
+	sim.start(line)
+
+	// give the wallets of nodes 1 and 2 some coins
+	sim.mine(1)
+	sim.waitConverged()
+	sim.mine(2)
+	sim.waitConverged()
+
+	// the transactions reach the miner from nodes it isn't connected to at first
+	tx := sim.send(0, 1, 0, 10)
+	sim.waitMempool(3, tx)
+	sim.send(1, 2, 0, 20)
+
+	sim.waitHeight(3, 4)
+	sim.waitConverged()
+	for i := range sim.nodes {
+		assert.Equal(t, activeNet.Subsidy+30, sim.balance(i, 0), "Node %d sees the payments", i)
+		// nodes drop the mined transactions after reindexing
+		emptied := func() bool {
+			return sim.nodes[i].mempoolSize() == 0
+		}
+		assert.Eventually(t, emptied, simTimeout, 50*time.Millisecond, "Node %d has the mined transactions out of its mempool", i)
+	}
+}
+
+func TestSimChainedTransactions(t *testing.T) {
+	sim := newSimNetwork(t, 3, 2)
+	sim.start(line)
+	sim.waitConverged()
+
+	// the second payment spends the change of the first before it's mined
+	first := sim.send(0, 0, 1, 10)
+	sim.waitMempool(2, first)
+	second := sim.send(0, 0, 1, 20)
+	assert.Equal(t, first.ID, second.Vin[0].Txid)
+
+	sim.waitHeight(2, 2)
+	sim.waitConverged()
+	for i := range sim.nodes {
+		assert.Equal(t, activeNet.Subsidy-30, sim.balance(i, 0), "Node %d sees both payments", i)
+		assert.Equal(t, 30, sim.balance(i, 1))
+	}
+}
+
+func TestSimOrphanTransactions(t *testing.T) {
+	sim := newSimNetwork(t, 2)
+	sim.start(line)
+	sim.waitConverged()
+
+	// node 0 sends the child alone, node 1 asks it for the parent
+	sender := sim.nodes[0]
+	parent := sender.bc.NewUTXOTransaction(sender.wallet, sim.address(1), 10, TxOptions{}, UTXOSet{sender.bc}, nil)
+	require.NoError(t, sender.mempool.add(parent, sender.bc))
+	child := sender.bc.NewUTXOTransaction(sender.wallet, sim.address(1), 20, TxOptions{}, UTXOSet{sender.bc}, sender.mempool)
+	sender.SendTx(sim.nodes[1].nodeAddress, child)
+
+	sim.waitMempool(1, parent)
+	sim.waitMempool(1, child)
+	assert.Equal(t, 0, sim.nodes[1].orphans.count())
+}
+
+func TestSimReplaceByFee(t *testing.T) {
+	sim := newSimNetwork(t, 3)
+	sim.start(line)
+	sim.waitConverged()
+
+	sender := sim.nodes[0]
+	original := sender.bc.NewUTXOTransaction(sender.wallet, sim.address(1), 10, TxOptions{Fee: 1, Replaceable: true}, UTXOSet{sender.bc}, nil)
+	sim.submit(0, original)
+	sim.waitMempool(2, original)
+
+	// spending the same outputs again without the mempool conflicts with it
+	replacement := sender.bc.NewUTXOTransaction(sender.wallet, sim.address(1), 10, TxOptions{Fee: 5}, UTXOSet{sender.bc}, nil)
+	sim.submit(0, replacement)
+	sim.waitMempool(2, replacement)
+	for i, node := range sim.nodes {
+		assert.False(t, node.inMempool(original.ID), "Node %d drops the replaced transaction", i)
+		assert.Equal(t, 1, node.mempoolSize())
+	}
+}
+
+func TestSimPartitionReorg(t *testing.T) {
+	sim := newSimNetwork(t, 4)
+	sim.start(mesh)
+	sim.waitConverged()
+
+	sim.partition([]int{0, 1}, []int{2, 3})
+	sim.mine(0)
+	shortTip := sim.waitConverged(0, 1)
+	sim.mine(2)
+	sim.waitHeight(3, 2)
+	sim.mine(3)
+	longTip := sim.waitConverged(2, 3)
+	assert.Equal(t, 2*activeNet.Subsidy, sim.balance(1, 0), "Node 1 follows node 0")
+
+	sim.heal()
+	assert.Equal(t, longTip, sim.waitConverged(), "The longer chain wins")
+	assert.NotEqual(t, shortTip, longTip)
+	for i := range sim.nodes {
+		assert.Equal(t, 3, sim.nodes[i].bc.getBestHeight())
+		assert.Equal(t, activeNet.Subsidy, sim.balance(i, 0), "The reward of the orphaned block is gone on node %d", i)
+	}
+}
+
+func TestSimSyncedBlocksLeaveMempool(t *testing.T) {
+	sim := newSimNetwork(t, 3)
+	sim.start(mesh)
+	sim.waitConverged()
+
+	tx := sim.send(0, 0, 1, 10)
+	sim.waitMempool(2, tx)
+
+	// node 2 misses two blocks, the first of them confirming the payment
+	sim.partition([]int{0, 1}, []int{2})
+	miner := sim.nodes[0]
+	block := miner.bc.MineBlock([]*Transaction{tx, NewCoinbaseTransaction(sim.address(0), "")})
+	utxoSet := UTXOSet{miner.bc}
+	utxoSet.reindex()
+	miner.blockConnected(block)
+	miner.RelayBlock(block, "")
+	sim.mine(0)
+	sim.waitConverged(0, 1)
+
+	// and gets them in one batch once it's back
+	sim.heal()
+	sim.waitConverged()
+	emptied := func() bool {
+		return sim.nodes[2].mempoolSize() == 0
+	}
+	assert.Eventually(t, emptied, simTimeout, 50*time.Millisecond, "Node 2 drops the payment confirmed before the last block")
+}
+
+func TestSimCompetingMiners(t *testing.T) {
+	sim := newSimNetwork(t, 3)
+	sim.start(line)
+	sim.waitConverged()
+
+	// both ends of the line find a block at the same height
+	var wg sync.WaitGroup
+	for _, i := range []int{0, 2} {
+		wg.Add(1)
+		go func(i int) {
+			sim.mine(i)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	for i := range sim.nodes {
+		sim.waitHeight(i, 2)
+	}
+
+	// the next block settles which one stays. One of the miners may have
+	// seen the other's block before it started, so the height varies.
+	block := sim.mine(1)
+	assert.Equal(t, block.Hash, sim.waitConverged())
+	for i := range sim.nodes {
+		assert.Equal(t, block.Height, sim.nodes[i].bc.getBestHeight())
+	}
+}
+
+func TestSimMerkleBlock(t *testing.T) {
+	sim := newSimNetwork(t, 2)
+	sim.start(line)
+	sim.mine(1)
+	sim.waitConverged()
+	block := sim.mine(0)
+	sim.waitConverged()
+
+	// a light client watching the wallet of node 0 asks node 1 for the block
+	light := NewServer(ServerConfig{NodeID: "light", ListenAddr: "light:3000"}, nil, sim.transport.Node("light:3000"))
+	ln, err := light.transport.Listen(light.nodeAddress)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	filter := NewBloomFilter(1, 0.0001, 0, BloomUpdateNone)
+	filter.add(HashPubKey(sim.nodes[0].wallet.PublicKey))
+	light.SendFilterLoad(sim.nodes[1].nodeAddress, filter)
+	// messages are handled concurrently, the filter has to be in place first
+	loaded := func() bool {
+		return sim.nodes[1].peerHasFilter(light.nodeAddress)
+	}
+	require.Eventually(t, loaded, simTimeout, 50*time.Millisecond, "Node 1 loads the filter")
+	light.SendGetData(sim.nodes[1].nodeAddress, "merkleblock", block.Hash)
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	request, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	request = request[len(activeNet.magic()):]
+	assert.Equal(t, "merkleblock", BytesToCommand(request[:commandLength]))
+
+	var payload merkleblock
+	require.NoError(t, gob.NewDecoder(bytes.NewReader(request[commandLength:])).Decode(&payload))
+	mb, err := decodeMerkleBlock(payload.Block)
+	require.NoError(t, err)
+	txs, err := mb.validate()
+	require.NoError(t, err)
+	require.Len(t, txs, 1)
+	assert.Equal(t, block.Transactions[0].ID, txs[0].ID, "The coinbase paying node 0 matches")
+}
+
+func TestSimBlockFilters(t *testing.T) {
+	sim := newSimNetwork(t, 2)
+	sim.start(line)
+	sim.mine(1)
+	sim.waitConverged()
+	sim.mine(0)
+	tip := sim.waitConverged()
+
+	for _, hash := range [][]byte{tip, sim.nodes[0].bc.getBlockHashes()[1]} {
+		_, header0, err := sim.nodes[0].bc.getFilter(hash)
+		assert.NoError(t, err)
+		_, header1, err := sim.nodes[1].bc.getFilter(hash)
+		assert.NoError(t, err)
+		assert.Equal(t, header0, header1, "Nodes agree on the filter header of block %x", hash)
+	}
+
+	light := NewServer(ServerConfig{NodeID: "light", ListenAddr: "light:3000"}, nil, sim.transport.Node("light:3000"))
+	ln, err := light.transport.Listen(light.nodeAddress)
+	require.NoError(t, err)
+	defer ln.Close()
+	receive := func(command string, payload interface{}) {
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		request, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		request = request[len(activeNet.magic()):]
+		require.Equal(t, command, BytesToCommand(request[:commandLength]))
+		require.NoError(t, gob.NewDecoder(bytes.NewReader(request[commandLength:])).Decode(payload))
+	}
+
+	light.SendGetCFHeaders(sim.nodes[1].nodeAddress, 2, tip)
+	var headers cfheaders
+	receive("cfheaders", &headers)
+	require.Len(t, headers.FilterHashes, 2)
+	_, prevHeader, err := sim.nodes[0].bc.getFilter(sim.nodes[0].bc.getBlockHashes()[2])
+	require.NoError(t, err)
+	assert.Equal(t, prevHeader, headers.PrevHeader)
+	_, tipHeader, err := sim.nodes[0].bc.getFilter(tip)
+	require.NoError(t, err)
+	assert.Equal(t, tipHeader, filterHeaders(headers.PrevHeader, headers.FilterHashes)[1])
+
+	light.SendGetCFilters(sim.nodes[1].nodeAddress, 2, tip)
+	var filters cfilters
+	receive("cfilters", &filters)
+	require.Len(t, filters.Filters, 2)
+
+	// only the tip pays the wallet of node 0
+	watched := [][]byte{HashPubKey(sim.nodes[0].wallet.PublicKey)}
+	for i, f := range filters.Filters {
+		assert.Equal(t, headers.FilterHashes[i], filterHash(f.Filter))
+		matched, err := matchBlockFilter(f.BlockHash, f.Filter, watched)
+		assert.NoError(t, err)
+		assert.Equal(t, i == 1, matched)
+	}
+}
+
+// startLight runs a light client following the wallets of the given nodes,
+// connected to node peer
+func (sim *simNetwork) startLight(peer int, wallets ...int) *Server {
+	config := ServerConfig{NodeID: "light", ListenAddr: "light:3000", SPV: true}
+	light := NewServer(config, nil, sim.transport.Node(config.ListenAddr))
+	var pubKeys [][]byte
+	for _, i := range wallets {
+		pubKeys = append(pubKeys, sim.nodes[i].wallet.PublicKey)
+	}
+	light.spv = NewSPVChain(config.NodeID, pubKeys)
+
+	ln, err := light.transport.Listen(config.ListenAddr)
+	require.NoError(sim.t, err)
+	done := make(chan struct{})
+	go func() {
+		light.Serve(ln, []string{sim.nodes[peer].nodeAddress})
+		close(done)
+	}()
+	sim.t.Cleanup(func() {
+		ln.Close()
+		<-done
+		light.spv.db.Close()
+	})
+
+	return light
+}
+
+// waitLightSynced waits until a light client scanned the chain up to the
+// tip of node i and sees the balance node i does for a wallet
+func (sim *simNetwork) waitLightSynced(light *Server, i, wallet int) {
+	pubKeyHash := HashPubKey(sim.nodes[wallet].wallet.PublicKey)
+	synced := func() bool {
+		return light.spv.isScanned(chainTip(sim.nodes[i].bc)) &&
+			light.spv.getBalance(pubKeyHash) == sim.balance(i, wallet)
+	}
+	require.Eventually(sim.t, synced, simTimeout, 50*time.Millisecond, "The light client catches up with node %d", i)
+}
+
+func TestSimLightClient(t *testing.T) {
+	sim := newSimNetwork(t, 3, 2)
+	sim.start(line)
+	sim.mine(1)
+	sim.waitConverged()
+	sim.mine(0)
+	tip := sim.waitConverged()
+
+	light := sim.startLight(1, 0)
+	sim.waitLightSynced(light, 1, 0)
+	assert.Equal(t, 2*activeNet.Subsidy, light.spv.getBalance(HashPubKey(sim.nodes[0].wallet.PublicKey)))
+	assert.Equal(t, 3, light.spv.getBestHeight())
+	header, err := light.spv.getHeader(tip)
+	require.NoError(t, err)
+	block, err := sim.nodes[1].bc.getBlock(tip)
+	require.NoError(t, err)
+	assert.Equal(t, block.header(), *header)
+
+	// the light client learns of the new block from its peer, and of the
+	// spend of its output by the key that signed it
+	sim.send(2, 0, 1, 10)
+	sim.send(2, 1, 0, 3)
+	sim.waitHeight(2, 4)
+	sim.waitConverged()
+	sim.waitLightSynced(light, 1, 0)
+	assert.Equal(t, 2*activeNet.Subsidy-7, light.spv.getBalance(HashPubKey(sim.nodes[0].wallet.PublicKey)))
+	assert.Equal(t, 0, light.spv.getBalance(HashPubKey(sim.nodes[2].wallet.PublicKey)), "Wallets not followed stay unknown")
+}
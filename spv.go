@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// A light client keeps the headers of the blocks, not the blocks. It tells
+// the blocks paying or spending from its wallets by their compact filters,
+// then gets them as merkle blocks, proving the transactions it is given are
+// in them. Those transactions are all it needs for the balance of its wallets.
+
+const spvDBFile = "spv_%s.db"
+const headersBucket = "headers"
+
+// spvFiltersBucket holds the filter header followed by the filter hash of
+// every block whose filter header we know
+const spvFiltersBucket = "spvfilters"
+
+// spvBlocksBucket holds the transactions of ours in a block, once the block
+// was scanned
+const spvBlocksBucket = "spvblocks"
+
+// spvUTXOBucket holds the outputs we can spend by outpoint
+const spvUTXOBucket = "spvutxo"
+
+// spvFilterFPRate is the false positive rate of the bloom filter a light
+// client loads, higher rates tell the peer less about the wallets
+const spvFilterFPRate = 0.001
+
+// merkleBlockRetryDelay is how long a light client waits for its filter to
+// be loaded before asking for a merkle block again
+const merkleBlockRetryDelay = 200 * time.Millisecond
+
+// lightCommands are the messages a light client handles, it has no blocks
+// or mempool to answer the others with
+var lightCommands = map[string]bool{
+	"addr":        true,
+	"version":     true,
+	"inv":         true,
+	"headers":     true,
+	"merkleblock": true,
+	"notfound":    true,
+	"cfheaders":   true,
+	"cfilters":    true,
+	"ping":        true,
+	"pong":        true,
+}
+
+// SPVChain is the header chain of a light client, along with what it knows
+// about the transactions of its wallets
+type SPVChain struct {
+	db *bolt.DB
+	// pubKeys are the public keys of the wallets followed
+	pubKeys [][]byte
+}
+
+// NewSPVChain opens the header chain of a node, creating it when needed
+func NewSPVChain(nodeID string, pubKeys [][]byte) *SPVChain {
+	db, err := bolt.Open(fmt.Sprintf(spvDBFile, nodeID), 0600, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{headersBucket, spvFiltersBucket, spvBlocksBucket, spvUTXOBucket} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return &SPVChain{db, pubKeys}
+}
+
+// walletPubKeys lists the public keys of the wallets of a node
+func walletPubKeys(nodeID string) [][]byte {
+	wallets, _ := NewWallets(nodeID)
+
+	var pubKeys [][]byte
+	for _, wallet := range wallets.Wallets {
+		pubKeys = append(pubKeys, wallet.PublicKey)
+	}
+
+	return pubKeys
+}
+
+// getBestHeight returns the height of the best header, -1 before the first
+func (spv *SPVChain) getBestHeight() int {
+	height := -1
+	err := spv.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(headersBucket))
+		if tip := b.Get([]byte("l")); tip != nil {
+			height = DeserializeHeader(b.Get(tip)).Height
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return height
+}
+
+// getHeader finds a header by its block hash
+func (spv *SPVChain) getHeader(hash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
+	err := spv.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(headersBucket)).Get(hash)
+		if data == nil {
+			return errors.New("Header is not found")
+		}
+		header = DeserializeHeader(data)
+		return nil
+	})
+
+	return header, err
+}
+
+// addHeaders checks headers received from a peer and stores them, the best
+// chain being the highest. It returns how many headers were new.
+func (spv *SPVChain) addHeaders(headers []BlockHeader) (int, error) {
+	added := 0
+	tipChanged := false
+	err := spv.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(headersBucket))
+		for i := range headers {
+			header := &headers[i]
+			err := header.validate()
+			if err != nil {
+				return err
+			}
+			if b.Get(header.Hash) != nil {
+				continue
+			}
+
+			tipHeight := -1
+			if tip := b.Get([]byte("l")); tip != nil {
+				tipHeight = DeserializeHeader(b.Get(tip)).Height
+			}
+			if len(header.PrevBlockHash) == 0 {
+				if !activeNet.isGenesis(header.Hash) || header.Height != 0 {
+					return fmt.Errorf("header %x claims to be the genesis block", header.Hash)
+				}
+			} else {
+				prevData := b.Get(header.PrevBlockHash)
+				if prevData == nil {
+					return fmt.Errorf("header %x doesn't connect", header.Hash)
+				}
+				if header.Height != DeserializeHeader(prevData).Height+1 {
+					return fmt.Errorf("header %x has height %d", header.Hash, header.Height)
+				}
+			}
+
+			err = b.Put(header.Hash, header.Serialize())
+			if err != nil {
+				log.Panic(err)
+			}
+			added++
+			if header.Height > tipHeight {
+				err = b.Put([]byte("l"), header.Hash)
+				if err != nil {
+					log.Panic(err)
+				}
+				tipChanged = true
+			}
+		}
+		return nil
+	})
+	// a reorg may take transactions of ours out of the chain
+	if tipChanged {
+		spv.reindexUTXO()
+	}
+
+	return added, err
+}
+
+// locator lists block hashes from the tip back to the genesis block, dense
+// near the tip and sparser further down, for a peer to find where our
+// chains fork
+func (spv *SPVChain) locator() [][]byte {
+	var locator [][]byte
+	err := spv.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(headersBucket))
+		hash := b.Get([]byte("l"))
+		step := 1
+		for hash != nil && len(locator) < maxLocatorSize-1 {
+			header := DeserializeHeader(b.Get(hash))
+			locator = append(locator, header.Hash)
+			if len(locator) >= 10 {
+				step *= 2
+			}
+			for i := 0; i < step && len(header.PrevBlockHash) > 0; i++ {
+				header = DeserializeHeader(b.Get(header.PrevBlockHash))
+			}
+			if bytes.Equal(header.Hash, locator[len(locator)-1]) {
+				break
+			}
+			hash = header.Hash
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return locator
+}
+
+// unscanned returns the headers of the best chain whose blocks weren't
+// scanned for our transactions yet, oldest first
+func (spv *SPVChain) unscanned() []BlockHeader {
+	var headers []BlockHeader
+	err := spv.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(headersBucket))
+		scanned := tx.Bucket([]byte(spvBlocksBucket))
+		for hash := b.Get([]byte("l")); hash != nil && scanned.Get(hash) == nil; {
+			header := DeserializeHeader(b.Get(hash))
+			headers = append([]BlockHeader{*header}, headers...)
+			hash = nil
+			if len(header.PrevBlockHash) > 0 {
+				hash = header.PrevBlockHash
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return headers
+}
+
+// nextToScan tells whether a block of the header chain may be scanned,
+// which goes in chain order: its parent has to be scanned first
+func (spv *SPVChain) nextToScan(hash []byte) bool {
+	next := false
+	err := spv.db.View(func(tx *bolt.Tx) error {
+		scanned := tx.Bucket([]byte(spvBlocksBucket))
+		data := tx.Bucket([]byte(headersBucket)).Get(hash)
+		if data == nil || scanned.Get(hash) != nil {
+			return nil
+		}
+		header := DeserializeHeader(data)
+		next = len(header.PrevBlockHash) == 0 || scanned.Get(header.PrevBlockHash) != nil
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return next
+}
+
+// isScanned tells whether the block was scanned for our transactions
+func (spv *SPVChain) isScanned(hash []byte) bool {
+	scanned := false
+	err := spv.db.View(func(tx *bolt.Tx) error {
+		scanned = tx.Bucket([]byte(spvBlocksBucket)).Get(hash) != nil
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return scanned
+}
+
+// addFilterHeaders checks the filter hashes of the blocks up to stopHash
+// against the filter header we have for the block before them, then
+// stores their filter headers
+func (spv *SPVChain) addFilterHeaders(stopHash, prevHeader []byte, filterHashes [][]byte) error {
+	return spv.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(headersBucket))
+		filters := tx.Bucket([]byte(spvFiltersBucket))
+
+		// the blocks the hashes are for, oldest first
+		hashes := make([][]byte, len(filterHashes))
+		hash := stopHash
+		for i := len(hashes) - 1; i >= 0; i-- {
+			data := b.Get(hash)
+			if data == nil {
+				return fmt.Errorf("filter hashes for unknown block %x", hash)
+			}
+			hashes[i] = hash
+			hash = DeserializeHeader(data).PrevBlockHash
+		}
+
+		expected := make([]byte, sha256.Size)
+		if len(hash) > 0 {
+			stored := filters.Get(hash)
+			if stored == nil {
+				return fmt.Errorf("no filter header for block %x", hash)
+			}
+			expected = stored[:sha256.Size]
+		}
+		if !bytes.Equal(prevHeader, expected) {
+			return errors.New("filter headers don't chain to ours")
+		}
+
+		for i, header := range filterHeaders(prevHeader, filterHashes) {
+			err := filters.Put(hashes[i], append(append([]byte{}, header...), filterHashes[i]...))
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+		return nil
+	})
+}
+
+// checkFilter tells whether a block filter is the one its filter header
+// commits to
+func (spv *SPVChain) checkFilter(blockHash, filter []byte) error {
+	return spv.db.View(func(tx *bolt.Tx) error {
+		stored := tx.Bucket([]byte(spvFiltersBucket)).Get(blockHash)
+		if stored == nil {
+			return fmt.Errorf("no filter header for block %x", blockHash)
+		}
+		if !bytes.Equal(stored[sha256.Size:], filterHash(filter)) {
+			return fmt.Errorf("filter of block %x doesn't match its header", blockHash)
+		}
+		return nil
+	})
+}
+
+// watched lists what the filter of a block of interest matches: the public
+// key hashes of our wallets and the outputs we can spend
+func (spv *SPVChain) watched() [][]byte {
+	var elements [][]byte
+	for _, pubKey := range spv.pubKeys {
+		elements = append(elements, HashPubKey(pubKey))
+	}
+
+	err := spv.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(spvUTXOBucket)).ForEach(func(k, v []byte) error {
+			elements = append(elements, append([]byte{}, k...))
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return elements
+}
+
+// bloomFilter builds the filter we load on full nodes, matching our public
+// keys, their hashes and the outputs we can spend
+func (spv *SPVChain) bloomFilter() *BloomFilter {
+	elements := spv.watched()
+	filter := NewBloomFilter(len(elements)+len(spv.pubKeys), spvFilterFPRate, rand.Uint32(), BloomUpdateAll)
+	for _, element := range elements {
+		filter.add(element)
+	}
+	for _, pubKey := range spv.pubKeys {
+		filter.add(pubKey)
+	}
+
+	return filter
+}
+
+// addBlockTransactions marks a block of the header chain as scanned,
+// keeping the transactions of ours found in it
+func (spv *SPVChain) addBlockTransactions(blockHash []byte, txs []*Transaction) {
+	var stored []Transaction
+	for _, tx := range txs {
+		stored = append(stored, *tx)
+	}
+
+	err := spv.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(spvBlocksBucket)).Put(blockHash, GobEncode(stored))
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if len(txs) > 0 {
+		spv.reindexUTXO()
+	}
+}
+
+// reindexUTXO rebuilds our unspent outputs from the transactions of ours
+// found in the best chain
+func (spv *SPVChain) reindexUTXO() {
+	ours := make(map[string]bool)
+	for _, pubKey := range spv.pubKeys {
+		ours[string(HashPubKey(pubKey))] = true
+	}
+
+	err := spv.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(headersBucket))
+		blocks := tx.Bucket([]byte(spvBlocksBucket))
+
+		UTXO := make(map[string]TXOutput)
+		spent := make(map[string]bool)
+		// newest first, so spends are seen before the outputs they spend
+		for hash := b.Get([]byte("l")); hash != nil; {
+			var txs []Transaction
+			if data := blocks.Get(hash); data != nil {
+				err := gob.NewDecoder(bytes.NewReader(data)).Decode(&txs)
+				if err != nil {
+					log.Panic(err)
+				}
+			}
+			for i := len(txs) - 1; i >= 0; i-- {
+				tx := txs[i]
+				for outIdx, out := range tx.Vout {
+					key := string(outpoint(tx.ID, outIdx))
+					if ours[string(out.PubKeyHash)] && !spent[key] {
+						UTXO[key] = out
+					}
+				}
+				if !tx.isCoinbase() {
+					for _, vin := range tx.Vin {
+						spent[string(outpoint(vin.Txid, vin.Vout))] = true
+					}
+				}
+			}
+
+			prev := DeserializeHeader(b.Get(hash)).PrevBlockHash
+			hash = nil
+			if len(prev) > 0 {
+				hash = prev
+			}
+		}
+
+		err := tx.DeleteBucket([]byte(spvUTXOBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		utxos, err := tx.CreateBucket([]byte(spvUTXOBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		for key, out := range UTXO {
+			err = utxos.Put([]byte(key), GobEncode(out))
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// getBalance adds up the outputs we can spend with a public key hash
+func (spv *SPVChain) getBalance(pubKeyHash []byte) int {
+	balance := 0
+	err := spv.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(spvUTXOBucket)).ForEach(func(k, v []byte) error {
+			var out TXOutput
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(&out)
+			if err != nil {
+				log.Panic(err)
+			}
+			if out.canUnlockedWith(pubKeyHash) {
+				balance += out.Value
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return balance
+}
+
+// getBestHeight returns the height of our best block, or header for a
+// light client
+func (server *Server) getBestHeight() int {
+	if server.spv != nil {
+		return server.spv.getBestHeight()
+	}
+
+	return server.bc.getBestHeight()
+}
+
+// syncFilters asks a full node for the filter headers of the blocks we
+// haven't scanned yet, the filters follow once they check out
+func (server *Server) syncFilters(address string) {
+	unscanned := server.spv.unscanned()
+	if len(unscanned) == 0 {
+		fmt.Printf("Wallets are up to date at height %d\n", server.spv.getBestHeight())
+		return
+	}
+	if len(unscanned) > maxCFiltersPerMessage {
+		unscanned = unscanned[:maxCFiltersPerMessage]
+	}
+
+	server.SendGetCFHeaders(address, unscanned[0].Height, unscanned[len(unscanned)-1].Hash)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSPVChainHeaders(t *testing.T) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(dir)
+
+	wallet := NewWallet("")
+	bc := CreateBlockchain(string(wallet.getAddress()), "0")
+	defer bc.db.Close()
+	for i := 0; i < 12; i++ {
+		bc.MineBlock([]*Transaction{NewCoinbaseTransaction(string(wallet.getAddress()), fmt.Sprint(i))})
+	}
+	spv := NewSPVChain("light", nil)
+	defer spv.db.Close()
+
+	headers := bc.getHeaders(spv.locator(), 5)
+	require.Len(t, headers, 5)
+	assert.Equal(t, 0, headers[0].Height, "A client without headers starts from the genesis block")
+	added, err := spv.addHeaders(headers)
+	require.NoError(t, err)
+	assert.Equal(t, 5, added)
+
+	rest := bc.getHeaders(spv.locator(), maxHeadersPerMessage)
+	require.Len(t, rest, 9)
+	assert.Equal(t, 5, rest[0].Height)
+
+	tampered := append([]BlockHeader{}, rest...)
+	tampered[1].Nonce++
+	_, err = spv.addHeaders(tampered)
+	assert.Error(t, err, "Headers have to carry their proof of work")
+
+	skipped := append([]BlockHeader{}, rest[1:]...)
+	_, err = spv.addHeaders(skipped)
+	assert.Error(t, err, "Headers have to connect")
+
+	_, err = spv.addHeaders(rest)
+	require.NoError(t, err)
+	assert.Equal(t, 13, spv.getBestHeight())
+	assert.Empty(t, bc.getHeaders(spv.locator(), maxHeadersPerMessage))
+
+	locator := spv.locator()
+	assert.Equal(t, bc.getTip(), locator[0])
+	assert.Equal(t, headers[0].Hash, locator[len(locator)-1], "The locator ends with the genesis block")
+	assert.Len(t, spv.unscanned(), 14)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// lockTimeThreshold tells heights from times: lock times below it are
+// block heights, the others unix times
+const lockTimeThreshold = 500000000
+
+// The sequence of an input locks it relative to the block the output it
+// spends is in, like in BIP 68. The low bits hold the lock, in blocks or,
+// with sequenceTypeFlag, in units of sequenceGranularity seconds. Inputs
+// with sequenceDisableFlag aren't locked.
+const sequenceDisableFlag = 1 << 31
+const sequenceTypeFlag = 1 << 22
+const sequenceMask = 0x0000ffff
+const sequenceGranularity = 512
+
+// isFinal tells whether a transaction can go in a block at height with
+// timestamp blockTime, its lock time being before them
+func (tx *Transaction) isFinal(height int, blockTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	if tx.LockTime < lockTimeThreshold {
+		return tx.LockTime < int64(height)
+	}
+
+	return tx.LockTime < blockTime
+}
+
+// sequenceLock returns how many blocks or seconds an input waits after the
+// block of the output it spends, and whether it's a time
+func (input *TXInput) sequenceLock() (int64, bool) {
+	if input.Sequence&sequenceDisableFlag != 0 {
+		return 0, false
+	}
+	lock := int64(input.Sequence & sequenceMask)
+	if input.Sequence&sequenceTypeFlag != 0 {
+		return lock * sequenceGranularity, true
+	}
+
+	return lock, false
+}
+
+// txBlockFinder finds the block a transaction is in, on the best chain for
+// a Blockchain and on its own branch for a chainView
+type txBlockFinder interface {
+	findTransactionBlock(ID []byte) (*Block, error)
+}
+
+// checkLocks checks a transaction can go in the next block of the best
+// chain at height with timestamp blockTime. pending holds the transactions
+// going in the same block before it, which the outputs it spends may come from.
+func (bc *Blockchain) checkLocks(tx *Transaction, height int, blockTime int64, pending map[string]Transaction) error {
+	return checkTxLocks(bc, tx, height, blockTime, pending)
+}
+
+// checkTxLocks checks the locks of a transaction going in a block at height
+// with timestamp blockTime on the chain
+func checkTxLocks(chain txBlockFinder, tx *Transaction, height int, blockTime int64, pending map[string]Transaction) error {
+	if tx.LockTime < 0 {
+		return errors.New("transaction has a negative lock time")
+	}
+	if !tx.isFinal(height, blockTime) {
+		return fmt.Errorf("transaction is locked until after %s", formatLockTime(tx.LockTime))
+	}
+	if tx.isCoinbase() {
+		return nil
+	}
+
+	for _, vin := range tx.Vin {
+		lock, isTime := vin.sequenceLock()
+		if lock == 0 {
+			continue
+		}
+		// outputs of the same block were just confirmed
+		prevHeight, prevTime := height, blockTime
+		if _, ok := pending[hex.EncodeToString(vin.Txid)]; !ok {
+			block, err := chain.findTransactionBlock(vin.Txid)
+			if err != nil {
+				return err
+			}
+			prevHeight, prevTime = block.Height, block.Timestamp
+		}
+		if isTime && prevTime+lock > blockTime {
+			return fmt.Errorf("input %x:%d is locked until %s", vin.Txid, vin.Vout, formatTime(time.Unix(prevTime+lock, 0)))
+		}
+		if !isTime && int64(prevHeight)+lock > int64(height) {
+			return fmt.Errorf("input %x:%d is locked until block %d", vin.Txid, vin.Vout, int64(prevHeight)+lock)
+		}
+	}
+
+	return nil
+}
+
+// checkBlockLocks checks the relative locks of the transactions of a block
+// against the chain it extends, their lock times don't depend on the chain
+// and the block checks them itself
+func (bc *Blockchain) checkBlockLocks(block *Block) error {
+	return bc.db.View(func(tx *bolt.Tx) error {
+		view, err := newChainView(tx, block.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+		for _, transaction := range block.Transactions {
+			err := checkTxLocks(view, transaction, block.Height, block.Timestamp, nil)
+			if err != nil {
+				return err
+			}
+			view.addTransaction(transaction, block)
+		}
+
+		return nil
+	})
+}
+
+// formatLockTime prints a lock time as the height or the time it is
+func formatLockTime(lockTime int64) string {
+	if lockTime < lockTimeThreshold {
+		return fmt.Sprintf("block %d", lockTime)
+	}
+
+	return formatTime(time.Unix(lockTime, 0))
+}
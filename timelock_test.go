@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeLocks(t *testing.T) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(dir)
+	activeNet = &regTestParams
+	defer func() { activeNet = &mainNetParams }()
+
+	wallet := NewWallet("")
+	address := string(wallet.getAddress())
+	bc := CreateBlockchain(address, "0")
+	defer bc.db.Close()
+	utxoSet := UTXOSet{bc}
+	utxoSet.reindex()
+	var funding []*Transaction
+	for i := 0; i < 4; i++ {
+		block := mineBlock(bc, NewCoinbaseTransaction(address, ""))
+		funding = append(funding, block.Transactions[0])
+	}
+	height := bc.getBestHeight()
+
+	pay := func(prev *Transaction, lockTime int64, sequence uint32, pending map[string]Transaction) *Transaction {
+		tx := &Transaction{nil, []TXInput{{prev.ID, 0, nil, wallet.PublicKey, nil, sequence}}, []TXOutput{*NewTXOutput(prev.Vout[0].Value, address)}, false, lockTime}
+		tx.ID = tx.hash()
+		bc.signTransaction(tx, wallet.PrivateKey, pending)
+		return tx
+	}
+
+	// a lock time is the last height or time the transaction can't be mined at
+	pool := NewTxPool(maxMempoolSize, mempoolExpiry)
+	assert.Error(t, pool.add(pay(funding[0], int64(height+1), 0, nil), bc))
+	assert.NoError(t, pool.add(pay(funding[0], int64(height), 0, nil), bc))
+	assert.Error(t, pool.add(pay(funding[1], time.Now().Add(time.Hour).Unix(), 0, nil), bc))
+	assert.NoError(t, pool.add(pay(funding[1], time.Now().Add(-time.Minute).Unix(), 0, nil), bc))
+	assert.Error(t, pool.add(pay(funding[2], -1, 0, nil), bc))
+
+	locked := pay(funding[2], int64(height+1), 0, nil)
+	assert.Panics(t, func() { bc.MineBlock([]*Transaction{locked}) })
+	block := NewBlock([]*Transaction{NewCoinbaseTransaction(address, ""), locked}, bc.getTip(), height+1)
+	assert.Error(t, block.validate(), "Blocks check the lock times")
+	block = NewBlock([]*Transaction{NewCoinbaseTransaction(address, ""), locked}, bc.getTip(), height+2)
+	assert.NoError(t, block.validate())
+
+	// the last funding output is confirmed at height, spending it 3 blocks
+	// later takes 2 more blocks
+	relative := pay(funding[3], 0, 3, nil)
+	assert.Error(t, pool.add(relative, bc))
+	tampered := *relative
+	tampered.Vin = []TXInput{relative.Vin[0]}
+	tampered.Vin[0].Sequence = 0
+	assert.False(t, bc.verifyTransaction(&tampered, nil), "The ID covers the sequences")
+	for i := 0; i < 2; i++ {
+		mineBlock(bc, NewCoinbaseTransaction(address, ""))
+	}
+	assert.NoError(t, pool.add(relative, bc))
+	child := pay(relative, 0, 1, pool.pending())
+	assert.Error(t, pool.add(child, bc), "Unconfirmed outputs can't be spent a block later")
+	assert.Error(t, bc.checkBlockLocks(&Block{PrevBlockHash: bc.getTip(), Height: height + 3, Transactions: []*Transaction{relative, child}}))
+	assert.NoError(t, bc.checkBlockLocks(&Block{PrevBlockHash: bc.getTip(), Height: height + 3, Transactions: []*Transaction{relative}}))
+	assert.Error(t, bc.checkBlockLocks(&Block{PrevBlockHash: bc.getTip(), Height: height + 2, Transactions: []*Transaction{relative}}))
+
+	timed := pay(funding[2], 0, sequenceTypeFlag|1, nil)
+	assert.Error(t, pool.add(timed, bc), "Blocks come faster than 512 seconds in the test")
+}
+
+func TestChainIndex(t *testing.T) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(dir)
+	activeNet = &regTestParams
+	defer func() { activeNet = &mainNetParams }()
+
+	address := string(NewWallet("").getAddress())
+	bc := CreateBlockchain(address, "0")
+	defer bc.db.Close()
+	fork := bc.getTip()
+	height := bc.getBestHeight()
+	replaced := bc.MineBlock([]*Transaction{NewCoinbaseTransaction(address, "a")})
+	block, err := bc.findTransactionBlock(replaced.Transactions[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, replaced.Hash, block.Hash)
+
+	// a longer branch from the fork takes over
+	first := NewBlock([]*Transaction{NewCoinbaseTransaction(address, "b")}, fork, height+1)
+	second := NewBlock([]*Transaction{NewCoinbaseTransaction(address, "c")}, first.Hash, height+2)
+	bc.addBlock(first)
+	_, err = bc.findTransactionBlock(first.Transactions[0].ID)
+	assert.Equal(t, errTxNotFound, err, "Side branches aren't indexed")
+	bc.addBlock(second)
+	assert.Equal(t, second.Hash, bc.getTip())
+	_, err = bc.findTransactionBlock(replaced.Transactions[0].ID)
+	assert.Equal(t, errTxNotFound, err, "The blocks of the replaced branch are unindexed")
+	block, err = bc.findTransactionBlock(first.Transactions[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, first.Hash, block.Hash)
+}
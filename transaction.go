@@ -14,12 +14,33 @@ import (
 	"math/big"
 )
 
-const subsidy = 2100
 
 type Transaction struct {
 	ID   []byte
 	Vin  []TXInput
 	Vout []TXOutput
+	// Replaceable lets a conflicting transaction paying more replace it
+	// while it's unconfirmed
+	Replaceable bool
+	// LockTime is the height, or the time from lockTimeThreshold on, the
+	// transaction can't be mined at or before
+	LockTime int64
+}
+
+// txFieldReplaceable, txFieldScripts, txFieldLockTime and txFieldSequences
+// tag the fields added later in the canonical encoding
+const txFieldReplaceable = 1
+const txFieldScripts = 2
+const txFieldLockTime = 3
+const txFieldSequences = 4
+
+// TxOptions are the choices of the sender of a transaction. The fee is at
+// least Fee, and FeeRate per 1000 bytes of the transaction.
+type TxOptions struct {
+	Fee         int
+	FeeRate     int
+	Replaceable bool
+	LockTime    int64
 }
 
 func (tx *Transaction) isCoinbase() bool {
@@ -39,6 +60,85 @@ func (tx *Transaction) serialize() []byte {
 	return encoded.Bytes()
 }
 
+// encode returns the canonical encoding of a Transaction used for hashing.
+// Gob output depends on which types the process encoded before, so it
+// can't be hashed by nodes that have to agree on the result.
+//
+// IDs used to be hashed over the gob serialization. Hashing this instead
+// changed the ID of every transaction, and so the hash of every block: chains
+// created before don't validate any more and have to be created again, and
+// nodes from before don't agree with nodes from after on any ID.
+func (tx *Transaction) encode() []byte {
+	var buff bytes.Buffer
+
+	writeBytes(&buff, tx.ID)
+	writeUint(&buff, uint64(len(tx.Vin)))
+	for _, in := range tx.Vin {
+		writeBytes(&buff, in.Txid)
+		writeUint(&buff, uint64(int64(in.Vout)))
+		writeBytes(&buff, in.Signature)
+		writeBytes(&buff, in.PubKey)
+	}
+	writeUint(&buff, uint64(len(tx.Vout)))
+	for _, out := range tx.Vout {
+		writeUint(&buff, uint64(int64(out.Value)))
+		writeBytes(&buff, out.PubKeyHash)
+	}
+	// fields added later are only written when set, so the transactions
+	// from before them keep their IDs
+	if tx.Replaceable {
+		writeUint(&buff, txFieldReplaceable)
+	}
+	if tx.hasScripts() {
+		writeUint(&buff, txFieldScripts)
+		for _, in := range tx.Vin {
+			writeBytes(&buff, in.ScriptSig)
+		}
+		for _, out := range tx.Vout {
+			writeBytes(&buff, out.Script)
+		}
+	}
+	if tx.LockTime != 0 {
+		writeUint(&buff, txFieldLockTime)
+		writeUint(&buff, uint64(tx.LockTime))
+	}
+	if tx.hasSequences() {
+		writeUint(&buff, txFieldSequences)
+		for _, in := range tx.Vin {
+			writeUint(&buff, uint64(in.Sequence))
+		}
+	}
+
+	return buff.Bytes()
+}
+
+// hasSequences tells whether an input has a sequence set
+func (tx *Transaction) hasSequences() bool {
+	for _, in := range tx.Vin {
+		if in.Sequence != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasScripts tells whether an input or an output has a script of its own
+func (tx *Transaction) hasScripts() bool {
+	for _, in := range tx.Vin {
+		if len(in.ScriptSig) > 0 {
+			return true
+		}
+	}
+	for _, out := range tx.Vout {
+		if len(out.Script) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Hash returns the hash of the Transaction
 func (tx *Transaction) hash() []byte {
 	var hash [32]byte
@@ -46,7 +146,7 @@ func (tx *Transaction) hash() []byte {
 	txCopy := *tx
 	txCopy.ID = []byte{}
 
-	hash = sha256.Sum256(txCopy.serialize())
+	hash = sha256.Sum256(txCopy.encode())
 
 	return hash[:]
 }
@@ -56,6 +156,9 @@ func (tx *Transaction) String() string {
 	var lines []string
 
 	lines = append(lines, fmt.Sprintf("Transaction %x:", tx.ID))
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("  LockTime: %d", tx.LockTime))
+	}
 
 	for i, input := range tx.Vin {
 		lines = append(lines, fmt.Sprintf("  Input %d:", i))
@@ -63,13 +166,19 @@ func (tx *Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("    Out:       %d", input.Vout))
 		lines = append(lines, fmt.Sprintf("    Signature: %x", input.Signature))
 		lines = append(lines, fmt.Sprintf("    PubKey:    %x", input.PubKey))
+		if len(input.ScriptSig) > 0 {
+			lines = append(lines, fmt.Sprintf("    ScriptSig: %s", disassembleScript(input.ScriptSig)))
+		}
+		if input.Sequence != 0 {
+			lines = append(lines, fmt.Sprintf("    Sequence:  0x%08x", input.Sequence))
+		}
 
 	}
 
 	for i, output := range tx.Vout {
 		lines = append(lines, fmt.Sprintf("  Output %d:", i))
 		lines = append(lines, fmt.Sprintf("    Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("    Script: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("    Script: %s", disassembleScript(output.lockingScript())))
 	}
 
 	return strings.Join(lines, "\n")
@@ -80,18 +189,85 @@ func (tx *Transaction) trimmedCopy() Transaction {
 	var outputs []TXOutput
 
 	for _, in := range tx.Vin {
-		inputs = append(inputs, TXInput{in.Txid, in.Vout, nil, nil})
+		inputs = append(inputs, TXInput{in.Txid, in.Vout, nil, nil, nil, in.Sequence})
 	}
 
 	for _, out := range tx.Vout {
-		outputs = append(outputs,TXOutput{out.Value,out.PubKeyHash})
+		outputs = append(outputs,TXOutput{out.Value,out.PubKeyHash,out.Script})
 	}
 
-	txCopy := Transaction{tx.ID,inputs,outputs}
+	txCopy := Transaction{tx.ID,inputs,outputs,tx.Replaceable,tx.LockTime}
 
 	return txCopy
 }
 
+// signatureData returns what the signatures of an input cover: a trimmed
+// copy with the script of the output it spends in place of its public key.
+// The fields added later are left out so the signatures from before them
+// stay valid, the ID commits to them.
+func (tx *Transaction) signatureData(inID int, prevOut TXOutput) []byte {
+	txCopy := tx.trimmedCopy()
+	txCopy.Vin[inID].PubKey = prevOut.signedScript()
+
+	type signedInput struct {
+		Txid      []byte
+		Vout      int
+		Signature []byte
+		PubKey    []byte
+	}
+	type signedOutput struct {
+		Value      int
+		PubKeyHash []byte
+	}
+	signed := struct {
+		ID   []byte
+		Vin  []signedInput
+		Vout []signedOutput
+	}{ID: txCopy.ID}
+	for _, in := range txCopy.Vin {
+		signed.Vin = append(signed.Vin, signedInput{in.Txid, in.Vout, in.Signature, in.PubKey})
+	}
+	for _, out := range txCopy.Vout {
+		signed.Vout = append(signed.Vout, signedOutput{out.Value, out.PubKeyHash})
+	}
+
+	return []byte(fmt.Sprintf("%x\n", signed))
+}
+
+// signData signs data with a private key
+func signData(privkey ecdsa.PrivateKey, data []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, &privkey, data)
+	if err != nil {
+		log.Panic(err)
+	}
+	// both halves take 32 bytes, verify splits the signature in the middle
+	return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+}
+
+// verifySignature checks a signature of data by the owner of a public key
+func verifySignature(data, signature, pubKey []byte) bool {
+	if len(signature) == 0 || len(pubKey) == 0 {
+		return false
+	}
+
+	r := big.Int{}
+	s := big.Int{}
+	sigLen := len(signature)
+	r.SetBytes(signature[:(sigLen / 2)])
+	s.SetBytes(signature[(sigLen / 2):])
+
+	x := big.Int{}
+	y := big.Int{}
+	keyLen := len(pubKey)
+	x.SetBytes(pubKey[:(keyLen / 2)])
+	y.SetBytes(pubKey[(keyLen / 2):])
+
+	rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: &x, Y: &y}
+	return ecdsa.Verify(&rawPubKey, data, &r, &s)
+}
+
+// sign signs the inputs spending outputs paying a public key hash, the
+// ones spending outputs with scripts of their own are signed for those
 func (tx *Transaction) sign(privkey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
 	if tx.isCoinbase() {
 		return
@@ -103,74 +279,95 @@ func (tx *Transaction) sign(privkey ecdsa.PrivateKey, prevTXs map[string]Transac
 		}
 	}
 
-	txCopy := tx.trimmedCopy()
-
 	for inID, vin := range tx.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-
-		//txCopy.hash()
-		//txCopy.Vin[inID].PubKey = nil
-		dataToSign := fmt.Sprintf("%x\n", txCopy)
-		r, s, err := ecdsa.Sign(rand.Reader, &privkey, []byte(dataToSign))
-		if err != nil {
-			log.Panic(err)
+		prevOut := prevTXs[hex.EncodeToString(vin.Txid)].Vout[vin.Vout]
+		if len(prevOut.Script) > 0 {
+			continue
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
-
-		tx.Vin[inID].Signature = signature
-		txCopy.Vin[inID].PubKey = nil
+		tx.Vin[inID].Signature = signData(privkey, tx.signatureData(inID, prevOut))
 	}
 
 }
 
+// verify runs the scripts of the inputs against the outputs they spend
 func (tx *Transaction) verify(prevTXs map[string]Transaction) bool {
 	if tx.isCoinbase() {
 		return true
 	}
 
+	// transactions come from the network, a missing one makes them invalid
+	// rather than taking the node down
 	for _, vin := range tx.Vin {
 		if prevTXs[hex.EncodeToString(vin.Txid)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
+			return false
 		}
 	}
-
-	txCopy := tx.trimmedCopy()
-	curve := elliptic.P256()
+	// the signatures cover the ID, which has to cover the rest of the
+	// transaction as it was before signing
+	unsigned := *tx
+	unsigned.Vin = make([]TXInput, len(tx.Vin))
+	for i, vin := range tx.Vin {
+		unsigned.Vin[i] = TXInput{vin.Txid, vin.Vout, nil, vin.PubKey, nil, vin.Sequence}
+	}
+	if !bytes.Equal(tx.ID, unsigned.hash()) {
+		return false
+	}
 
 	for inID, vin := range tx.Vin {
 		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
+		if vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return false
+		}
+		prevOut := prevTx.Vout[vin.Vout]
 
-		//txCopy.hash()
-		//txCopy.Vin[inID].PubKey = nil
+		checker := &inputChecker{tx: tx, inID: inID, prevOut: prevOut}
+		if verifyScripts(vin.unlockingScript(), prevOut.lockingScript(), checker) != nil {
+			return false
+		}
+	}
 
+	return true
+}
 
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
+// inputChecker checks what the scripts of an input ask of its transaction
+type inputChecker struct {
+	tx      *Transaction
+	inID    int
+	prevOut TXOutput
+	// data is what the signatures cover, computed at the first one
+	data []byte
+}
 
+func (c *inputChecker) checkSig(sig, pubKey []byte) bool {
+	if c.data == nil {
+		c.data = c.tx.signatureData(c.inID, c.prevOut)
+	}
 
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
+	return verifySignature(c.data, sig, pubKey)
+}
 
+// checkLockTime tells whether the transaction can't be mined before
+// lockTime, a height or a time like its own lock time
+func (c *inputChecker) checkLockTime(lockTime int64) bool {
+	if (lockTime < lockTimeThreshold) != (c.tx.LockTime < lockTimeThreshold) {
+		return false
+	}
 
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
-			return false
-		}
-		txCopy.Vin[inID].PubKey = nil
+	return lockTime <= c.tx.LockTime
+}
+
+// checkSequence tells whether the input is locked for at least sequence,
+// blocks or time like its own relative lock
+func (c *inputChecker) checkSequence(sequence int64) bool {
+	inSequence := int64(c.tx.Vin[c.inID].Sequence)
+	if inSequence&sequenceDisableFlag != 0 {
+		return false
+	}
+	if sequence&sequenceTypeFlag != inSequence&sequenceTypeFlag {
+		return false
 	}
 
-	return true
+	return sequence&sequenceMask <= inSequence&sequenceMask
 }
 
 func NewCoinbaseTransaction(to, sig string) *Transaction {
@@ -184,28 +381,57 @@ func NewCoinbaseTransaction(to, sig string) *Transaction {
 		sig = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TXInput{[]byte{}, -1, nil, []byte(sig)}
-	txout := NewTXOutput(subsidy, to)
-	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}}
+	txin := TXInput{[]byte{}, -1, nil, []byte(sig), nil, 0}
+	txout := NewTXOutput(activeNet.Subsidy, to)
+	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}, false, 0}
 	tx.ID = tx.hash()
 
 	return &tx
 }
 
-func (bc *Blockchain) NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet UTXOSet) *Transaction {
+// NewUTXOTransaction pays amount from the wallet to an address. With a
+// mempool it spends unconfirmed outputs too.
+func (bc *Blockchain) NewUTXOTransaction(wallet *Wallet, to string, amount int, options TxOptions, UTXOSet UTXOSet, mempool *TxPool) *Transaction {
+	// a higher fee may take more inputs, which takes a higher fee again
+	fee := options.Fee
+	for {
+		tx := bc.newPayment(wallet, to, amount, fee, options, UTXOSet, mempool)
+		needed := feeForRate(options.FeeRate, len(tx.encode()))
+		if needed <= fee {
+			return tx
+		}
+		fee = needed
+	}
+}
+
+// newPayment builds and signs a transaction paying amount and fee, the fee
+// of the options is left out
+func (bc *Blockchain) newPayment(wallet *Wallet, to string, amount, fee int, options TxOptions, UTXOSet UTXOSet, mempool *TxPool) *Transaction {
+	from := fmt.Sprintf("%s", wallet.getAddress())
+	tx := bc.newUnsignedPayment(from, wallet.PublicKey, to, amount, fee, options, UTXOSet, mempool)
+	var pending map[string]Transaction
+	if mempool != nil {
+		pending = mempool.pending()
+	}
+	UTXOSet.Blockchain.signTransaction(tx, wallet.PrivateKey, pending)
+
+	return tx
+}
+
+// newUnsignedPayment builds a transaction paying amount and fee from the
+// outputs of an address, with the change going back to it. pubKey goes in
+// the inputs, the ones spending multisig outputs have none.
+func (bc *Blockchain) newUnsignedPayment(from string, pubKey []byte, to string, amount, fee int, options TxOptions, UTXOSet UTXOSet, mempool *TxPool) *Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 
-	//wallet := wallets.GetWallet(from)
-	pubKeyHash := HashPubKey(wallet.PublicKey)
-	acc, validOutputs := UTXOSet.findSpendableOutputs(pubKeyHash, amount)
+	acc, validOutputs := UTXOSet.findSpendableOutputs(addressScript(from), amount+fee, mempool)
 
-	if acc < amount {
+	if acc < amount+fee {
 		log.Panic("ERROR: Not enough funds")
 	}
 
 	// Build a list of inputs
-	from := fmt.Sprintf("%s", wallet.getAddress())
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
 		if err != nil {
@@ -213,33 +439,39 @@ func (bc *Blockchain) NewUTXOTransaction(wallet *Wallet, to string, amount int,
 		}
 
 		for _, out := range outs {
-			input := TXInput{txID, out, nil, wallet.PublicKey}
+			input := TXInput{txID, out, nil, pubKey, nil, 0}
 			inputs = append(inputs, input)
 		}
 	}
 
 	// Build a list of outputs
 	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from)) // a change
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from)) // a change
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, options.Replaceable, options.LockTime}
 	tx.ID = tx.hash()
-	UTXOSet.Blockchain.signTransaction(&tx, wallet.PrivateKey)
 
 	return &tx
 }
 
 // DeserializeTransaction deserializes a transaction
 func DeserializeTransaction(data []byte) Transaction {
-	var transaction Transaction
-
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&transaction)
+	transaction, err := decodeTransaction(data)
 	if err != nil {
 		log.Panic(err)
 	}
 
 	return transaction
 }
+
+// decodeTransaction deserializes a transaction received from the network
+func decodeTransaction(data []byte) (Transaction, error) {
+	var transaction Transaction
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&transaction)
+
+	return transaction, err
+}
@@ -7,6 +7,20 @@ type TXInput struct {
 	Vout      int
 	Signature []byte
 	PubKey    []byte
+	// ScriptSig unlocks outputs with a script of their own, the ones paying
+	// a public key hash take Signature and PubKey
+	ScriptSig []byte
+	// Sequence holds the relative lock of the input, see sequenceLock
+	Sequence uint32
+}
+
+// unlockingScript returns the script the input unlocks its output with
+func (input *TXInput) unlockingScript() []byte {
+	if len(input.ScriptSig) > 0 {
+		return input.ScriptSig
+	}
+
+	return pushData(pushData(nil, input.Signature), input.PubKey)
 }
 
 func (input *TXInput) canUnlockedWith(pubKeyHash []byte) bool {
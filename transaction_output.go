@@ -9,17 +9,50 @@ import (
 type TXOutput struct {
 	Value      int
 	PubKeyHash []byte
+	// Script locks the output instead of PubKeyHash when set
+	Script []byte
+}
+
+// lockingScript returns the script locking the output, the P2PKH template
+// for the outputs paying a public key hash
+func (out *TXOutput) lockingScript() []byte {
+	if len(out.Script) > 0 {
+		return out.Script
+	}
+
+	return p2pkhScript(out.PubKeyHash)
+}
+
+// signedScript returns what a signature spending the output covers in
+// place of the public key of the input
+func (out *TXOutput) signedScript() []byte {
+	if len(out.Script) > 0 {
+		return out.Script
+	}
+
+	return out.PubKeyHash
 }
 
 func (output *TXOutput) canUnlockedWith(pubKeyHash []byte) bool {
 	return  bytes.Compare(output.PubKeyHash, pubKeyHash) == 0
 }
 
+// isLockedWith tells whether the output is locked with a script
+func (out *TXOutput) isLockedWith(script []byte) bool {
+	return bytes.Equal(out.lockingScript(), script)
+}
+
 // Lock signs the output
 func (out *TXOutput) Lock(address []byte) {
-	pubKeyHash := Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+	version, payload, _ := decodeAddress(string(address))
+	switch version {
+	case activeNet.MultisigVersion:
+		out.Script = payload
+	case activeNet.ScriptHashVersion:
+		out.Script = p2shScript(payload)
+	default:
+		out.PubKeyHash = payload
+	}
 }
 
 // Unlock checks if the output can be used by the owner of the pubkey
@@ -27,17 +60,34 @@ func (out *TXOutput) Unlock(pubKeyHash []byte) bool {
 	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
 }
 
+// addressScript returns the locking script of the outputs paying an address
+func addressScript(address string) []byte {
+	return NewTXOutput(0, address).lockingScript()
+}
+
 // NewTXOutput create a new TXOutput
 func NewTXOutput(value int, address string) *TXOutput {
-	txo := &TXOutput{value, nil}
+	txo := &TXOutput{value, nil, nil}
 	txo.Lock([]byte(address))
 
 	return txo
 }
 
-// TXOutputs collects TXOutput
+// TXOutputs collects the unspent outputs of a transaction, Indexes holds
+// where each of them is in the transaction
 type TXOutputs struct {
 	Outputs []TXOutput
+	Indexes []int
+}
+
+// index returns where the i-th output is in its transaction. Sets saved
+// before the indexes were kept have them in place of the spent ones.
+func (outs TXOutputs) index(i int) int {
+	if outs.Indexes == nil {
+		return i
+	}
+
+	return outs.Indexes[i]
 }
 
 // Serialize serializes TXOutputs
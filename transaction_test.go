@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionSignature(t *testing.T) {
+	wallet := NewWallet("")
+	funding := NewCoinbaseTransaction(string(wallet.getAddress()), "")
+	prevTXs := map[string]Transaction{hex.EncodeToString(funding.ID): *funding}
+
+	// one in 128 signatures has a half with a leading zero byte
+	for i := 0; i < 1000; i++ {
+		tx := &Transaction{nil, []TXInput{{funding.ID, 0, nil, wallet.PublicKey, nil, 0}}, []TXOutput{*NewTXOutput(i, string(wallet.getAddress()))}, false, 0}
+		tx.ID = tx.hash()
+		tx.sign(wallet.PrivateKey, prevTXs)
+
+		assert.Len(t, tx.Vin[0].Signature, 64)
+		if !assert.True(t, tx.verify(prevTXs), "Signature %x verifies", tx.Vin[0].Signature) {
+			return
+		}
+	}
+}
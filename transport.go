@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transport carries the messages between nodes. Every message travels on a
+// stream of its own: Dial opens a stream to a node and the listener returned
+// by Listen accepts the streams other nodes open to us. TCP maps each stream
+// to a connection, backends that multiplex streams over one connection per
+// peer, like libp2p, open a new stream on that connection in Dial.
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(address string) (net.Conn, error)
+}
+
+// TCPTransport is the default transport, one TCP connection per stream
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (TCPTransport) Dial(address string) (net.Conn, error) {
+	return net.Dial("tcp", address)
+}
+
+// SecureTransport runs the encrypted handshake on every stream of another transport
+type SecureTransport struct {
+	Inner Transport
+	Key   *ecdh.PrivateKey
+	// Allowed restricts the node keys we talk to, any key is accepted when it's nil
+	Allowed map[string]bool
+	// Metrics counts the handshakes refused for being too many, when set
+	Metrics *Metrics
+}
+
+func (st *SecureTransport) Dial(address string) (net.Conn, error) {
+	conn, err := st.Inner.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := SecureClient(conn, st.Key, st.Allowed)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+func (st *SecureTransport) Listen(address string) (net.Listener, error) {
+	inner, err := st.Inner.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	ln := &secureListener{
+		Listener:   inner,
+		transport:  st,
+		conns:      make(chan net.Conn),
+		errs:       make(chan error, 1),
+		done:       make(chan struct{}),
+		handshakes: make(chan struct{}, maxConnections),
+	}
+	go ln.acceptLoop()
+
+	return ln, nil
+}
+
+// secureListener handshakes with the accepted streams in the background, so
+// a slow peer doesn't hold up the others
+type secureListener struct {
+	net.Listener
+	transport *SecureTransport
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+	// handshakes caps the handshakes running at once
+	handshakes chan struct{}
+}
+
+func (ln *secureListener) acceptLoop() {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			ln.errs <- err
+			return
+		}
+
+		select {
+		case ln.handshakes <- struct{}{}:
+		default:
+			if ln.transport.Metrics != nil {
+				ln.transport.Metrics.limitReached("handshakes", "refusing %s, %d handshakes running", conn.RemoteAddr(), maxConnections)
+			}
+			conn.Close()
+			continue
+		}
+
+		go func(conn net.Conn) {
+			sc, err := SecureServer(conn, ln.transport.Key, ln.transport.Allowed)
+			<-ln.handshakes
+			if err != nil {
+				fmt.Printf("Handshake with %s failed: %s\n", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			select {
+			case ln.conns <- sc:
+			case <-ln.done:
+				sc.Close()
+			}
+		}(conn)
+	}
+}
+
+func (ln *secureListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case err := <-ln.errs:
+		return nil, err
+	case <-ln.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (ln *secureListener) Close() error {
+	ln.closeOnce.Do(func() { close(ln.done) })
+
+	return ln.Listener.Close()
+}
+
+// memBacklog is how many dialed streams wait for Accept before dialing fails
+const memBacklog = 128
+
+// MemoryTransport connects nodes running in the same process through
+// in-memory streams, for tests. Writes never block, like writes into a
+// socket buffer, so two nodes dialing each other don't deadlock. Deadlines
+// are ignored.
+type MemoryTransport struct {
+	listeners map[string]*memListener
+	// groups holds the side of the partition every address is on
+	groups map[string]int
+	dialed int
+	mu     sync.Mutex
+}
+
+// NewMemoryTransport creates an empty in-memory network
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{listeners: make(map[string]*memListener)}
+}
+
+// Node returns the network as seen from address: the streams it dials come
+// from that address and can't cross a partition
+func (mt *MemoryTransport) Node(address string) Transport {
+	return &memNode{mt, address}
+}
+
+// Partition splits the network, dialing from one group to another fails
+// until Heal. Addresses in no group reach everyone.
+func (mt *MemoryTransport) Partition(groups ...[]string) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	mt.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, address := range group {
+			mt.groups[address] = i
+		}
+	}
+}
+
+// Heal joins a partitioned network again
+func (mt *MemoryTransport) Heal() {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	mt.groups = nil
+}
+
+func (mt *MemoryTransport) Listen(address string) (net.Listener, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if _, ok := mt.listeners[address]; ok {
+		return nil, fmt.Errorf("%s is already in use", address)
+	}
+	ln := &memListener{
+		transport: mt,
+		addr:      memAddr(address),
+		conns:     make(chan net.Conn, memBacklog),
+		done:      make(chan struct{}),
+	}
+	mt.listeners[address] = ln
+
+	return ln, nil
+}
+
+func (mt *MemoryTransport) Dial(address string) (net.Conn, error) {
+	mt.mu.Lock()
+	mt.dialed++
+	from := fmt.Sprintf("mem-%d", mt.dialed)
+	mt.mu.Unlock()
+
+	return mt.dial(from, address)
+}
+
+func (mt *MemoryTransport) dial(from, address string) (net.Conn, error) {
+	mt.mu.Lock()
+	ln, ok := mt.listeners[address]
+	fromGroup, fromPartitioned := mt.groups[from]
+	toGroup, toPartitioned := mt.groups[address]
+	mt.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	}
+	if fromPartitioned && toPartitioned && fromGroup != toGroup {
+		return nil, fmt.Errorf("dial %s: network is unreachable", address)
+	}
+
+	toServer, toClient := newMemPipe(), newMemPipe()
+	client := &memConn{toClient, toServer, memAddr(from), ln.addr}
+	server := &memConn{toServer, toClient, ln.addr, memAddr(from)}
+	select {
+	case <-ln.done:
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	default:
+	}
+	select {
+	case ln.conns <- server:
+		return client, nil
+	default:
+		return nil, fmt.Errorf("dial %s: backlog is full", address)
+	}
+}
+
+// memNode is the view of a MemoryTransport from one address
+type memNode struct {
+	transport *MemoryTransport
+	address   string
+}
+
+func (node *memNode) Listen(address string) (net.Listener, error) {
+	return node.transport.Listen(address)
+}
+
+func (node *memNode) Dial(address string) (net.Conn, error) {
+	return node.transport.dial(node.address, address)
+}
+
+type memAddr string
+
+func (memAddr) Network() string {
+	return "memory"
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
+
+// memPipe carries the bytes of one direction of a stream
+type memPipe struct {
+	buf    bytes.Buffer
+	closed bool
+	mu     sync.Mutex
+	cond   *sync.Cond
+}
+
+func newMemPipe() *memPipe {
+	pipe := &memPipe{}
+	pipe.cond = sync.NewCond(&pipe.mu)
+
+	return pipe
+}
+
+func (pipe *memPipe) Write(data []byte) (int, error) {
+	pipe.mu.Lock()
+	defer pipe.mu.Unlock()
+
+	if pipe.closed {
+		return 0, io.ErrClosedPipe
+	}
+	pipe.cond.Broadcast()
+
+	return pipe.buf.Write(data)
+}
+
+// Read waits for data, returning io.EOF once the pipe is closed and drained
+func (pipe *memPipe) Read(data []byte) (int, error) {
+	pipe.mu.Lock()
+	defer pipe.mu.Unlock()
+
+	for pipe.buf.Len() == 0 && !pipe.closed {
+		pipe.cond.Wait()
+	}
+	if pipe.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return pipe.buf.Read(data)
+}
+
+func (pipe *memPipe) Close() {
+	pipe.mu.Lock()
+	defer pipe.mu.Unlock()
+
+	pipe.closed = true
+	pipe.cond.Broadcast()
+}
+
+// memConn is one end of an in-memory stream
+type memConn struct {
+	in     *memPipe
+	out    *memPipe
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *memConn) Read(data []byte) (int, error) {
+	return c.in.Read(data)
+}
+
+func (c *memConn) Write(data []byte) (int, error) {
+	return c.out.Write(data)
+}
+
+// Close lets the other end read what was written, then io.EOF
+func (c *memConn) Close() error {
+	c.out.Close()
+	c.in.Close()
+
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type memListener struct {
+	transport *MemoryTransport
+	addr      memAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (ln *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (ln *memListener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.done)
+
+		ln.transport.mu.Lock()
+		delete(ln.transport.listeners, string(ln.addr))
+		ln.transport.mu.Unlock()
+	})
+
+	return nil
+}
+
+func (ln *memListener) Addr() net.Addr {
+	return ln.addr
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// exchange sends data over a stream dialed on a transport and returns what
+// the listening side received
+func exchange(t *testing.T, tr Transport, ln net.Listener, address string, data []byte) ([]byte, net.Conn) {
+	go func() {
+		conn, err := tr.Dial(address)
+		if assert.NoError(t, err) {
+			conn.Write(data)
+			conn.Close()
+		}
+	}()
+
+	conn, err := ln.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	received, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+
+	return received, conn
+}
+
+func TestMemoryTransport(t *testing.T) {
+	tr := NewMemoryTransport()
+
+	ln, err := tr.Listen("node1")
+	assert.NoError(t, err)
+
+	_, err = tr.Listen("node1")
+	assert.Error(t, err, "An address can only be listened on once")
+
+	received, conn := exchange(t, tr, ln, "node1", []byte("hello"))
+	assert.Equal(t, []byte("hello"), received)
+	assert.NotEqual(t, "node1", remoteHost(conn), "Every stream comes from an address of its own")
+
+	_, err = tr.Dial("node2")
+	assert.Error(t, err, "Dialing an address nobody listens on fails")
+
+	ln.Close()
+	_, err = tr.Dial("node1")
+	assert.Error(t, err, "Dialing a closed listener fails")
+}
+
+func TestSecureTransport(t *testing.T) {
+	memory := NewMemoryTransport()
+	server := &SecureTransport{Inner: memory, Key: newTestKey(t)}
+	client := &SecureTransport{Inner: memory, Key: newTestKey(t)}
+
+	ln, err := server.Listen("node1")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	received, conn := exchange(t, client, ln, "node1", []byte("hello"))
+	assert.Equal(t, []byte("hello"), received)
+	assert.Equal(t, client.Key.PublicKey().Bytes(), conn.(*secureConn).RemoteKey())
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+// heightsBucket maps the heights of the best chain to their block hash,
+// txIndexBucket the transactions of the best chain to their block height,
+// and spentIndexBucket the outputs they spend to the height spending them.
+// Relative locks look the block of the outputs they spend up in them, and
+// blocks of any branch are checked against them up to the fork.
+const heightsBucket = "heights"
+const txIndexBucket = "txindex"
+const spentIndexBucket = "spentindex"
+
+// heightKey encodes a height so the keys sort by height
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+
+	return key
+}
+
+// indexChain indexes the best chain ending at tipHash, walking back to the
+// last block already indexed at its height. The blocks of the chain it
+// replaces are unindexed on the way, so a reorg costs as much as its depth.
+// It returns the blocks that joined the best chain, oldest first.
+func indexChain(tx *bolt.Tx, tipHash []byte) []*Block {
+	blocks := tx.Bucket([]byte(blocksBucket))
+	heights, err := tx.CreateBucketIfNotExists([]byte(heightsBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+	txIndex, err := tx.CreateBucketIfNotExists([]byte(txIndexBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+	spentIndex, err := tx.CreateBucketIfNotExists([]byte(spentIndexBucket))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var connected []*Block
+	for hash := tipHash; ; {
+		blockData := blocks.Get(hash)
+		if blockData == nil {
+			break
+		}
+		block := DeserializeBlock(blockData)
+		key := heightKey(block.Height)
+		indexed := heights.Get(key)
+		if bytes.Equal(indexed, block.Hash) {
+			break
+		}
+
+		if indexed != nil {
+			if replacedData := blocks.Get(indexed); replacedData != nil {
+				for _, replaced := range DeserializeBlock(replacedData).Transactions {
+					if bytes.Equal(txIndex.Get(replaced.ID), key) {
+						err = txIndex.Delete(replaced.ID)
+						if err != nil {
+							log.Panic(err)
+						}
+					}
+					if replaced.isCoinbase() {
+						continue
+					}
+					for _, vin := range replaced.Vin {
+						spent := outpoint(vin.Txid, vin.Vout)
+						if bytes.Equal(spentIndex.Get(spent), key) {
+							err = spentIndex.Delete(spent)
+							if err != nil {
+								log.Panic(err)
+							}
+						}
+					}
+				}
+			}
+		}
+		err = heights.Put(key, block.Hash)
+		if err != nil {
+			log.Panic(err)
+		}
+		for _, transaction := range block.Transactions {
+			err = txIndex.Put(transaction.ID, key)
+			if err != nil {
+				log.Panic(err)
+			}
+			if transaction.isCoinbase() {
+				continue
+			}
+			for _, vin := range transaction.Vin {
+				err = spentIndex.Put(outpoint(vin.Txid, vin.Vout), key)
+				if err != nil {
+					log.Panic(err)
+				}
+			}
+		}
+
+		connected = append([]*Block{block}, connected...)
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+		hash = block.PrevBlockHash
+	}
+
+	return connected
+}
+
+// indexedHeight returns the height a key of the chain index was put at,
+// -1 for no key
+func indexedHeight(key []byte) int {
+	if len(key) != 8 {
+		return -1
+	}
+
+	return int(binary.BigEndian.Uint64(key))
+}
+
+// indexedBlock returns the block of the best chain a transaction is in, nil
+// when the chain has no such transaction
+func indexedBlock(tx *bolt.Tx, ID []byte) *Block {
+	txIndex := tx.Bucket([]byte(txIndexBucket))
+	heights := tx.Bucket([]byte(heightsBucket))
+	if txIndex == nil || heights == nil {
+		return nil
+	}
+	key := txIndex.Get(ID)
+	if key == nil {
+		return nil
+	}
+	blockData := tx.Bucket([]byte(blocksBucket)).Get(heights.Get(key))
+	if blockData == nil {
+		return nil
+	}
+
+	return DeserializeBlock(blockData)
+}
+
+// findTransactionBlock finds the block of the best chain a transaction is in
+func (bc *Blockchain) findTransactionBlock(ID []byte) (*Block, error) {
+	var block *Block
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		block = indexedBlock(tx, ID)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if block == nil {
+		return nil, errTxNotFound
+	}
+
+	return block, nil
+}
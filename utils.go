@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func IntToHex(num int64) []byte {
@@ -13,3 +17,37 @@ func ReverseBytes(data []byte) {
 		data[i], data[j] = data[j], data[i]
 	}
 }
+
+// writeUint appends a varint to a canonical encoding
+func writeUint(buff *bytes.Buffer, n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buff.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+// writeBytes appends a length prefixed byte slice to a canonical encoding
+func writeBytes(buff *bytes.Buffer, data []byte) {
+	writeUint(buff, uint64(len(data)))
+	buff.Write(data)
+}
+
+// splitAddresses splits a comma separated list of addresses, dropping empty entries
+func splitAddresses(list string) []string {
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+// formatTime prints a time, or "never" for the zero time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+
+	return t.Format(time.RFC3339)
+}
@@ -14,33 +14,30 @@ type UTXOSet struct{
 	Blockchain *Blockchain
 }
 
-// Reindex rebuilds the UTXO set
+// Reindex rebuilds the UTXO set. The set is swapped in a single
+// transaction, blocks connected meanwhile never find it empty.
 func (u *UTXOSet) reindex() {
+	// a reindex finding the outputs before a block and writing them after
+	// the reindex of that block would leave the block out
+	u.Blockchain.updateMutex.Lock()
+	defer u.Blockchain.updateMutex.Unlock()
+
 	db := u.Blockchain.db
 	bucketName := []byte(utxoBucket)
 
+	UTXO := u.Blockchain.findUTXO()
+	fmt.Printf("find all UTXO set. length is %d \n",len(UTXO))
 	err := db.Update(func(tx *bolt.Tx) error {
 		err := tx.DeleteBucket(bucketName)
 		if err != nil && err != bolt.ErrBucketNotFound {
 			log.Panic(err)
 		}
 
-		_, err = tx.CreateBucket(bucketName)
+		b, err := tx.CreateBucket(bucketName)
 		if err != nil {
 			log.Panic(err)
 		}
 
-		return nil
-	})
-	if err != nil {
-		log.Panic(err)
-	}
-
-	UTXO := u.Blockchain.findUTXO()
-	fmt.Printf("find all UTXO set. length is %d \n",len(UTXO))
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
-
 		for txID, outs := range UTXO {
 			key, err := hex.DecodeString(txID)
 			if err != nil {
@@ -55,10 +52,13 @@ func (u *UTXOSet) reindex() {
 
 		return nil
 	})
+	if err != nil {
+		log.Panic(err)
+	}
 }
 
-// FindUTXO finds UTXO for a public key hash
-func (u *UTXOSet) findUTXO(keyhash []byte) []TXOutput {
+// FindUTXO finds the UTXO locked with a script
+func (u *UTXOSet) findUTXO(lock []byte) []TXOutput {
 	var utxos []TXOutput
 
 	db := u.Blockchain.db
@@ -70,7 +70,7 @@ func (u *UTXOSet) findUTXO(keyhash []byte) []TXOutput {
 		b.ForEach(func(k, v []byte) error {
 			outs := DeserializeOutputs(v)
 			for _, out := range outs.Outputs {
-				if out.canUnlockedWith(keyhash) {
+				if out.isLockedWith(lock) {
 					utxos = append(utxos, out)
 				}
 			}
@@ -87,8 +87,10 @@ func (u *UTXOSet) findUTXO(keyhash []byte) []TXOutput {
 	return utxos
 }
 
-// FindSpendableOutputs finds and returns unspent outputs to reference in inputs
-func (u *UTXOSet) findSpendableOutputs(keyhash []byte, amount int) (int, map[string][]int) {
+// FindSpendableOutputs finds and returns unspent outputs to reference in inputs.
+// With a mempool, the unconfirmed outputs are spendable too and the ones its
+// transactions spend aren't.
+func (u *UTXOSet) findSpendableOutputs(lock []byte, amount int, mempool *TxPool) (int, map[string][]int) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
 	db := u.Blockchain.db
@@ -99,8 +101,12 @@ func (u *UTXOSet) findSpendableOutputs(keyhash []byte, amount int) (int, map[str
 		b.ForEach(func(k, v []byte) error {
 			txID := hex.EncodeToString(k)
 			outs := DeserializeOutputs(v)
-			for outIdx, out := range outs.Outputs {
-				if out.canUnlockedWith(keyhash) && accumulated < amount{
+			for i, out := range outs.Outputs {
+				outIdx := outs.index(i)
+				if mempool != nil && mempool.spends(k, outIdx) {
+					continue
+				}
+				if out.isLockedWith(lock) && accumulated < amount{
 					accumulated += out.Value
 					unspentOutputs[txID] = append(unspentOutputs[txID],outIdx)
 				}
@@ -115,6 +121,18 @@ func (u *UTXOSet) findSpendableOutputs(keyhash []byte, amount int) (int, map[str
 		log.Panic(err)
 	}
 
+	if mempool != nil {
+		for _, tx := range mempool.transactions() {
+			txID := hex.EncodeToString(tx.ID)
+			for outIdx, out := range tx.Vout {
+				if out.isLockedWith(lock) && accumulated < amount && !mempool.spends(tx.ID, outIdx) {
+					accumulated += out.Value
+					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+				}
+			}
+		}
+	}
+
 	return accumulated, unspentOutputs
 
 }
@@ -152,11 +170,16 @@ func (u *UTXOSet) update(block *Block) {
 				for _, vin := range tx.Vin {
 					updatedOuts := TXOutputs{}
 					outsBytes := b.Get(vin.Txid)
+					if outsBytes == nil {
+						// a reindex running along already spent it
+						continue
+					}
 					outs := DeserializeOutputs(outsBytes)
 
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
+					for i, out := range outs.Outputs {
+						if outs.index(i) != vin.Vout {
 							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+							updatedOuts.Indexes = append(updatedOuts.Indexes, outs.index(i))
 						}
 					}
 
@@ -176,8 +199,9 @@ func (u *UTXOSet) update(block *Block) {
 			}
 
 			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
+			for outIdx, out := range tx.Vout {
 				newOutputs.Outputs = append(newOutputs.Outputs, out)
+				newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
 			}
 
 			err := b.Put(tx.ID, newOutputs.Serialize())
@@ -10,7 +10,6 @@ import (
 	"bytes"
 )
 
-const version = byte(0x00)
 const addressChecksumLen = 4
 
 type Wallet struct {
@@ -21,25 +20,54 @@ type Wallet struct {
 
 func (w *Wallet) getAddress() []byte {
 	pubKeyHash := HashPubKey(w.PublicKey)
-	versionedPayload := append([]byte{version}, pubKeyHash...)
+
+	return encodeAddress(activeNet.AddressVersion, pubKeyHash)
+}
+
+// encodeAddress returns the address of a payload, a public key hash or a
+// script depending on the version
+func encodeAddress(version byte, payload []byte) []byte {
+	versionedPayload := append([]byte{version}, payload...)
 
 	checksum := checksum(versionedPayload)
 	fullPayload := append(versionedPayload, checksum...)
 
-	address := Base58Encode(fullPayload)
+	return Base58Encode(fullPayload)
+}
 
-	return address
+// decodeAddress returns the version and the payload of an address, or false
+// when its checksum is wrong
+func decodeAddress(address string) (byte, []byte, bool) {
+	decoded := Base58Decode([]byte(address))
+	if len(decoded) < 1+addressChecksumLen {
+		return 0, nil, false
+	}
+	actualChecksum := decoded[len(decoded)-addressChecksumLen:]
+	version := decoded[0]
+	payload := decoded[1 : len(decoded)-addressChecksumLen]
+	targetChecksum := checksum(append([]byte{version}, payload...))
+
+	return version, payload, bytes.Equal(actualChecksum, targetChecksum)
 }
 
-// ValidateAddress check if address if valid
+// ValidateAddress check if address if valid, addresses of other networks aren't
 func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
-	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
-	version := pubKeyHash[0]
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
-	targetChecksum := checksum(append([]byte{version}, pubKeyHash...))
+	version, payload, ok := decodeAddress(address)
+	if !ok {
+		return false
+	}
+
+	switch version {
+	case activeNet.AddressVersion:
+		return len(payload) == ripemd160.Size
+	case activeNet.MultisigVersion:
+		_, _, ok := parseMultisigScript(payload)
+		return ok
+	case activeNet.ScriptHashVersion:
+		return len(payload) == ripemd160.Size
+	}
 
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	return false
 }
 
 
@@ -50,7 +78,8 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 		log.Panic(err)
 	}
 
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	// both coordinates take 32 bytes, the key is split in the middle
+	pubKey := append(private.PublicKey.X.FillBytes(make([]byte, 32)), private.PublicKey.Y.FillBytes(make([]byte, 32))...)
 
 	return *private, pubKey
 }
@@ -14,6 +14,9 @@ const walletFile = "wallet_%s.dat"
 
 type Wallets struct {
 	Wallets map[string]*Wallet
+	// Sent holds the transactions sent from the wallets until they're
+	// mined, in the order they were sent
+	Sent []Transaction
 }
 
 // CreateWallet adds a Wallet to Wallets
@@ -51,6 +54,32 @@ func (ws *Wallets) getAddresses() []string {
 	return addresses
 }
 
+// pendingPool returns a pool of the transactions sent from the wallets that
+// aren't mined yet, forgetting the ones mined or replaced since
+func (ws *Wallets) pendingPool(bc *Blockchain) *TxPool {
+	pool := NewTxPool(maxMempoolSize, mempoolExpiry)
+	var sent []Transaction
+	for i := range ws.Sent {
+		if pool.add(&ws.Sent[i], bc) == nil {
+			sent = append(sent, ws.Sent[i])
+		}
+	}
+	ws.Sent = sent
+
+	return pool
+}
+
+// replaceSent swaps a sent transaction for the one replacing it
+func (ws *Wallets) replaceSent(txID []byte, tx *Transaction) {
+	for i := range ws.Sent {
+		if bytes.Equal(ws.Sent[i].ID, txID) {
+			ws.Sent[i] = *tx
+			return
+		}
+	}
+	ws.Sent = append(ws.Sent, *tx)
+}
+
 func (ws *Wallets) saveToFile(nodeID string) {
 	var content bytes.Buffer
 	walletFile := fmt.Sprintf(walletFile, nodeID)
@@ -85,6 +114,7 @@ func (ws *Wallets) loadFromFile(nodeID string) error {
 		log.Panic(err)
 	}
 	ws.Wallets = wallets.Wallets
+	ws.Sent = wallets.Sent
 	fmt.Printf("Load from local wallets\n")
 	return nil
 }
\ No newline at end of file